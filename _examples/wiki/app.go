@@ -105,6 +105,8 @@ func main() {
 	app.Renderer = cidre.NewHtmlTemplateRenderer(renderConfig)
 	// Use the session middleware for flash messaging
 	app.Use(cidre.NewSessionMiddleware(app, sessionConfig, nil))
+	// Protect forms from CSRF attacks
+	app.Use(cidre.NewCsrfMiddleware(app, cidre.DefaultCsrfConfig()))
 	root := app.MountPoint("/")
 
 	// serve static files
@@ -113,7 +115,7 @@ func main() {
 	root.Get("show_pages", "", func(w http.ResponseWriter, r *http.Request) {
 		files, err := filepath.Glob(filepath.Join(wikiConfig.DataDirectory, "*.txt"))
 		if err != nil {
-			app.OnPanic(w, r, err)
+			app.OnPanic(w, r, &cidre.PanicInfo{Recovered: err})
 		}
 		articles := make(Articles, 0, len(files))
 		for _, file := range files {
@@ -134,7 +136,7 @@ func main() {
 			case "NotFound":
 				app.OnNotFound(w, r)
 			default:
-				app.OnPanic(w, r, err)
+				app.OnPanic(w, r, &cidre.PanicInfo{Recovered: err})
 			}
 			return
 		}
@@ -168,7 +170,7 @@ func main() {
 		name := strings.Replace(ctx.PathParams.Get("name"), "..", "", -1)
 		file := filepath.Join(wikiConfig.DataDirectory, name+".txt")
 		if err := os.Remove(file); err != nil {
-			app.OnPanic(w, r, err)
+			app.OnPanic(w, r, &cidre.PanicInfo{Recovered: err})
 			return
 		}
 		ctx.Session.AddFlash("info", "Page deleted")
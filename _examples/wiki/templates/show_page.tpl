@@ -11,6 +11,11 @@ function deletePage() {
   hidden.name = "_method";
   hidden.value = "delete";
   form.appendChild(hidden);
+  var csrf = document.createElement("input");
+  csrf.type = "hidden";
+  csrf.name = "_csrf";
+  csrf.value = "{{ csrf_token }}";
+  form.appendChild(csrf);
   form.submit();
 }
 </script>
@@ -83,7 +83,8 @@ func DBTransactionMiddleware(w http.ResponseWriter, r *http.Request) {
 	ctx.Set("db", DB.Begin())
 	defer func() {
 		status := w.(cidre.ResponseWriter).Status()
-		if status >= 200 && status < 400 {
+		// rollbacks if the client has gone away
+		if status >= 200 && status < 400 && ctx.Err() == nil {
 			ctx.Get("db").(*gorm.DB).Commit()
 		} else {
 			ctx.Get("db").(*gorm.DB).Rollback()
@@ -126,6 +127,8 @@ func main() {
 	app.Use(DBTransactionMiddleware)
 	// Use the session middleware for flash messaging
 	app.Use(cidre.NewSessionMiddleware(app, sessionConfig, nil))
+	// Protect forms from CSRF attacks
+	app.Use(cidre.NewCsrfMiddleware(app, cidre.DefaultCsrfConfig()))
 
 	root := app.MountPoint("/")
 	// serve static files
@@ -145,7 +148,7 @@ func main() {
 			case gorm.RecordNotFound:
 				app.OnNotFound(w, r)
 			default:
-				app.OnPanic(w, r, err)
+				app.OnPanic(w, r, &cidre.PanicInfo{Recovered: err})
 			}
 			return
 		}
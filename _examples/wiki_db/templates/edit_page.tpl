@@ -3,6 +3,7 @@
 <h2> {{.Data.Name }} </h2>
 <form action="{{ .App.BuildUrl "save_page" .Data.Name }}" method="POST">
   <fieldset>
+    {{ csrf_field }}
     <textarea name="body" cols="100" rows="20">{{ .Data.Body }}</textarea><br />
     <input type="submit" value="submit" />
   </fieldset>
@@ -2,33 +2,61 @@ package cidre
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
+	"unsafe"
 )
 
 /* Context {{{ */
 
 // Context is a per-request context object. It allows us to share variables between middlewares.
+//
+// Context objects are reused after requests finish if AppConfig.ReuseContexts is true.
+// Call Detach if you keep a Context object(or its Dict and PathParams) after the request.
+// PathParams points to an empty url.Values unless the matched route has path parameters.
 type Context struct {
 	Dict
 	App             *App
 	Session         *Session
 	Id              string
+	Request         *http.Request
 	Route           *Route
 	PathParams      *url.Values
 	StartedAt       time.Time
 	ResponseTime    time.Duration
 	MiddlewareChain *MiddlewareChain
+	body            contextBody
+	detached        bool
+	writer          ResponseWriter
+	multipartErr    error
+	formErr         error
+	aborted         bool
+	pathParams      url.Values
 }
 
 type contextBody struct {
@@ -38,26 +66,211 @@ type contextBody struct {
 
 // Returns a new Context object.
 func NewContext(app *App, id string, r *http.Request) *Context {
-	tmp := r.Body
-	context := &Context{
-		Dict:       NewDict(),
-		App:        app,
-		Id:         id,
-		PathParams: &url.Values{},
-	}
-	r.Body = &contextBody{tmp, context}
+	context := &Context{Dict: NewDict()}
+	context.init(app, id, r)
 	return context
 }
 
+var contextPool = sync.Pool{
+	New: func() interface{} {
+		return &Context{Dict: NewDict()}
+	},
+}
+
+func (ctx *Context) init(app *App, id string, r *http.Request) {
+	ctx.App = app
+	ctx.Id = id
+	ctx.Request = r
+	ctx.PathParams = &ctx.pathParams
+	body := r.Body
+	if cb, ok := body.(*contextBody); ok {
+		body = cb.ReadCloser
+	}
+	ctx.body = contextBody{body, ctx}
+	r.Body = &ctx.body
+}
+
+func (ctx *Context) reset() {
+	clear(ctx.Dict)
+	*ctx = Context{Dict: ctx.Dict}
+}
+
+// Aborts the request. If the request is aborted in start_request hooks, routing is skipped.
+// If the request is aborted in start_action hooks, the route handler is not called.
+// Hooks after the aborting hook at the same hook point are not called.
+func (ctx *Context) Abort() {
+	ctx.aborted = true
+}
+
+// Returns true if the request has been aborted.
+func (ctx *Context) IsAborted() bool {
+	return ctx.aborted
+}
+
+const middlewareTimingsKey = "cidre.middleware_timings"
+
+// Returns time spent in each middleware of the route, excluding time spent in subsequent
+// middlewares and the handler. MiddlewareTimings returns nil if AppConfig.ProfileMiddlewares is false.
+func (ctx *Context) MiddlewareTimings() []time.Duration {
+	timings, _ := ctx.Get(middlewareTimingsKey).([]time.Duration)
+	return timings
+}
+
+// Redirects to the named route with path parameters. If code is 0, 303 See Other is used
+// for requests except GET and HEAD, otherwise 302 Found is used.
+// Redirect panics if code is not a 3xx status code.
+//
+//     ctx.Session.AddFlash("info", "Saved")
+//     ctx.Redirect(0, "show_page", "1")
+func (ctx *Context) Redirect(code int, routeName string, args ...string) {
+	ctx.RedirectURL(code, ctx.App.BuildUrl(routeName, args...))
+}
+
+// Builds an absolute url for the given named route with path parameters for emails, OAuth redirects
+// and so on. The scheme and the host are taken from the given request, or AppConfig.ExternalBaseUrl if it is set.
+// The Host header is sent by clients and is not checked, so AppConfig.ExternalBaseUrl must be set
+// if urls are used for security-sensitive links like password reset links.
+//
+//     link := ctx.AbsoluteUrl(r, "show_page", "1")
+//     // -> "https://www.example.com/pages/1"
+func (ctx *Context) AbsoluteUrl(r *http.Request, name string, args ...string) string {
+	path := ctx.App.BuildUrl(name, args...)
+	if base := ctx.App.Config.ExternalBaseUrl; len(base) != 0 {
+		return strings.TrimRight(base, "/") + path
+	}
+	return ctx.App.schemeOf(r) + "://" + r.Host + path
+}
+
+// Same as Redirect, but accepts an URL instead of a route name.
+func (ctx *Context) RedirectURL(code int, url string) {
+	if code == 0 {
+		code = http.StatusFound
+		if ctx.Request.Method != "GET" && ctx.Request.Method != "HEAD" {
+			code = http.StatusSeeOther
+		}
+	}
+	if code < 300 || code > 399 {
+		panic(fmt.Sprintf("Invalid redirect status code: %v", code))
+	}
+	http.Redirect(ctx.writer, ctx.Request, url, code)
+}
+
+// Writes the given status code without a response body.
+func (ctx *Context) NoContent(code int) {
+	ctx.writer.WriteHeader(code)
+}
+
+// Prevents the Context object from being reused by following requests.
+// Detach must be called during the request.
+func (ctx *Context) Detach() {
+	ctx.detached = true
+}
+
 // Returns true if the matched route is dynamic, false if there is no matched
 // routes or the matched route is for static files.
 func (ctx *Context) IsDynamicRoute() bool {
 	return ctx.Route != nil && !ctx.Route.IsStatic
 }
 
+// Returns a verified client certificate, or nil if the request is not
+// authenticated by a client certificate. Client certificates are verified by
+// the App.Server if AppConfig.ClientCAFile is set.
+func (ctx *Context) ClientCertificate() *x509.Certificate {
+	tlsState := ctx.Request.TLS
+	if tlsState == nil || len(tlsState.VerifiedChains) == 0 || len(tlsState.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsState.VerifiedChains[0][0]
+}
+
+// Returns a common name of the verified client certificate, or an empty string.
+func (ctx *Context) ClientCertCN() string {
+	if cert := ctx.ClientCertificate(); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
 // Returns a contenxt object associated with the given request.
+// The context object can be retrieved even if r.Body is replaced by other middlewares.
+// RequestContext panics if the request has not been passed through App.ServeHTTP.
 func RequestContext(r *http.Request) *Context {
-	return r.Body.(*contextBody).Context
+	if ctx, ok := r.Context().Value(contextKey{}).(*Context); ok {
+		return ctx
+	}
+	if body, ok := r.Body.(*contextBody); ok {
+		return body.Context
+	}
+	panic("cidre: no Context is associated with the request. The request has not been passed through App.ServeHTTP.")
+}
+
+type contextKey struct{}
+
+// Returns a context.Context of the request. The context is canceled when the client
+// disconnects, the server fails to shutdown gracefully or a timeout middleware expires.
+func (ctx *Context) StdContext() context.Context {
+	return ctx.Request.Context()
+}
+
+// Same as StdContext.
+//
+//     rows, err := db.QueryContext(cidre.RequestContext(r).Context(), query)
+func (ctx *Context) Context() context.Context {
+	return ctx.Request.Context()
+}
+
+// Returns the deadline of the request context. See context.Context.Deadline.
+func (ctx *Context) Deadline() (time.Time, bool) {
+	return ctx.Request.Context().Deadline()
+}
+
+// Returns a channel that is closed when the request context is canceled. See context.Context.Done.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.Request.Context().Done()
+}
+
+// Returns a reason why the request context is canceled. See context.Context.Err.
+func (ctx *Context) Err() error {
+	return ctx.Request.Context().Err()
+}
+
+// Returns a shallow copy of the request with the given context.Context.
+// The Context object is still accessible from the returned request and
+// Context.Request will be updated to the returned request.
+//
+//     stdctx, cancel := context.WithTimeout(r.Context(), time.Second)
+//     defer cancel()
+//     r = cidre.RequestWithContext(r, stdctx)
+func RequestWithContext(r *http.Request, stdctx context.Context) *http.Request {
+	ctx := RequestContext(r)
+	if _, ok := stdctx.Value(contextKey{}).(*Context); !ok {
+		stdctx = context.WithValue(stdctx, contextKey{}, ctx)
+	}
+	r = r.WithContext(stdctx)
+	ctx.Request = r
+	return r
+}
+
+// Stores the value in the request context.Context so that libraries that take a context.Context
+// can see the value. If the key is a string, the value is also stored in the Context Dict.
+// WithValue returns a request with the derived context and updates Context.Request.
+//
+//     r = ctx.WithValue(userKey{}, user)
+//     ctx.MiddlewareChain.DoNext(w, r)
+func (ctx *Context) WithValue(key, val interface{}) *http.Request {
+	if s, ok := key.(string); ok {
+		ctx.Set(s, val)
+	}
+	return RequestWithContext(ctx.Request, context.WithValue(ctx.Request.Context(), key, val))
+}
+
+// Returns a value associated with the key from the request context.Context.
+// FromRequestContext also finds values stored by Context.WithValue after the request was derived.
+func FromRequestContext(r *http.Request, key interface{}) interface{} {
+	if v := r.Context().Value(key); v != nil {
+		return v
+	}
+	return RequestContext(r).Request.Context().Value(key)
 }
 
 /* }}} */
@@ -65,12 +278,59 @@ func RequestContext(r *http.Request) *Context {
 /* Hooks {{{ */
 
 // Hooks is a container of Hook objects.
+// Methods of App.Hooks can be called while the application is serving requests, for example,
+// to remove the access log hook at runtime. Modifying the map directly is not safe while
+// hooks may be running. Other Hooks like ResponseWriter.Hooks are used only by the goroutine
+// that serves the request, so they are not guarded.
 type Hooks map[string][]Hook
 
+// Mutexes of Hooks that can be modified while hooks are running(App.Hooks), keyed by pointers
+// of the maps. Hooks are called without holding the mutex, so hooks can add or remove hooks.
+var hooksMutexes sync.Map
+
+// Makes methods of the hooks safe for concurrent use.
+func (hooks Hooks) makeConcurrent() {
+	hooksMutexes.LoadOrStore(*(*unsafe.Pointer)(unsafe.Pointer(&hooks)), &sync.RWMutex{})
+}
+
+// Returns a mutex that guards the hooks, or nil if the hooks are not used concurrently.
+func (hooks Hooks) mutex() *sync.RWMutex {
+	if mu, ok := hooksMutexes.Load(*(*unsafe.Pointer)(unsafe.Pointer(&hooks))); ok {
+		return mu.(*sync.RWMutex)
+	}
+	return nil
+}
+
+// HookId is an opaque identifier of a registered hook, returned by Hooks.Add.
+type HookId struct {
+	// a hook registered to the Hooks, which is a unique closure created by Add.
+	hook *Hook
+}
+
+// Returns a pointer that identifies the function value.
+func hookPointer(hook Hook) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&hook))
+}
+
+// Returns the hooks associated with the given name. Hooks never modify elements of
+// the returned slice, so it can be iterated without holding the lock.
+func (hooks Hooks) get(name string) []Hook {
+	if mu := hooks.mutex(); mu != nil {
+		mu.RLock()
+		defer mu.RUnlock()
+	}
+	return hooks[name]
+}
+
 // Hook is a mechanism for customization of cidre.
 // Hook is a function, to be called on some well-defined occasion.
 type Hook func(http.ResponseWriter, *http.Request, interface{})
 
+// AbortableHook is a Hook that can abort the request. If an AbortableHook returns false,
+// the request is aborted by Context.Abort. AbortableHooks can be used only at hook points
+// that have requests.
+type AbortableHook func(http.ResponseWriter, *http.Request, interface{}) bool
+
 // HookDirection represents execution order of Hooks.
 type HookDirection int
 
@@ -83,25 +343,101 @@ const (
 
 // Executes hooks associated with the given name.
 func (hooks Hooks) Run(name string, direction HookDirection, w http.ResponseWriter, r *http.Request, data interface{}) {
+	s := hooks.get(name)
 	if direction == HookDirectionNormal {
-		for _, hook := range hooks[name] {
+		for _, hook := range s {
 			hook(w, r, data)
 		}
 	} else {
-		s := hooks[name]
 		for i := len(s) - 1; i >= 0; i-- {
 			s[i](w, r, data)
 		}
 	}
 }
 
+// Same as Run, but stops calling hooks if the request is aborted by Context.Abort.
+// RunAbortable returns false if the request has been aborted.
+func (hooks Hooks) RunAbortable(name string, direction HookDirection, w http.ResponseWriter, r *http.Request, data interface{}) bool {
+	ctx := RequestContext(r)
+	s := hooks.get(name)
+	for i := range s {
+		if ctx.IsAborted() {
+			return false
+		}
+		if direction == HookDirectionNormal {
+			s[i](w, r, data)
+		} else {
+			s[len(s)-1-i](w, r, data)
+		}
+	}
+	return !ctx.IsAborted()
+}
+
 // Registers a hook to be executed at the given hook point.
-func (hooks Hooks) Add(name string, hook Hook) {
+// Add returns an id that can be passed to Remove.
+func (hooks Hooks) Add(name string, hook Hook) HookId {
+	// wraps the hook so that the registered function value is unique.
+	wrapped := Hook(func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		hook(w, r, data)
+	})
+	if mu := hooks.mutex(); mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
 	_, ok := hooks[name]
 	if !ok {
 		hooks[name] = make([]Hook, 0, 10)
 	}
-	hooks[name] = append(hooks[name], hook)
+	hooks[name] = append(hooks[name], wrapped)
+	return HookId{&wrapped}
+}
+
+// Removes the hook identified by the given id from the given hook point.
+// Remove does not modify the slice that may be iterated by Run, so hooks that
+// are currently running are not affected.
+func (hooks Hooks) Remove(name string, id HookId) {
+	if id.hook == nil {
+		return
+	}
+	if mu := hooks.mutex(); mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	s := hooks[name]
+	for i, hook := range s {
+		if hookPointer(hook) == hookPointer(*id.hook) {
+			newS := make([]Hook, 0, len(s))
+			newS = append(newS, s[:i]...)
+			hooks[name] = append(newS, s[i+1:]...)
+			return
+		}
+	}
+}
+
+// Removes all hooks from the given hook point.
+func (hooks Hooks) Clear(name string) {
+	if mu := hooks.mutex(); mu != nil {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	delete(hooks, name)
+}
+
+// Registers an AbortableHook to be executed at the given hook point.
+//
+//     app.Hooks.AddAbortable("start_request", func(w http.ResponseWriter, r *http.Request, data interface{}) bool {
+//         if !authorized(r) {
+//             http.Error(w, "Forbidden", http.StatusForbidden)
+//             return false
+//         }
+//         return true
+//     })
+func (hooks Hooks) AddAbortable(name string, hook AbortableHook) HookId {
+	return hooks.Add(name, func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		if !hook(w, r, data) {
+			RequestContext(r).Abort()
+		}
+	})
 }
 
 /* }}} */
@@ -122,24 +458,66 @@ type ResponseWriter interface {
 	Hooks() Hooks
 }
 
+// An optional interface for ResponseWriters that know the Context object of the response.
+type contextResponseWriter interface {
+	Context() *Context
+}
+
+// An optional interface for ResponseWriters that can drop the rest of the response
+// after an error response has been written by a hook.
+type discardingResponseWriter interface {
+	discard()
+}
+
+// Drops the rest of the response if w supports it.
+func discardResponse(w http.ResponseWriter) {
+	if dw, ok := w.(discardingResponseWriter); ok {
+		dw.discard()
+	}
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	status        int
 	contentLength int
 	hooks         Hooks
 	headerWritten bool
+	context       *Context
+	discarded     bool
 }
 
 // Returns a new ResponseWriter object wrap around the given http.ResponseWriter object.
 func NewResponseWriter(w http.ResponseWriter) ResponseWriter {
-	self := &responseWriter{w, 0, 0, make(Hooks), false}
+	self := &responseWriter{w, 0, 0, nil, false, nil, false}
 	return self
 }
 
+var responseWriterPool = sync.Pool{
+	New: func() interface{} { return &responseWriter{} },
+}
+
+func (w *responseWriter) reset() {
+	clear(w.hooks)
+	*w = responseWriter{hooks: w.hooks}
+}
+
+// Returns a Context object associated with the response, or nil.
+func (w *responseWriter) Context() *Context {
+	return w.context
+}
+
 func (w *responseWriter) Hooks() Hooks {
+	if w.hooks == nil {
+		w.hooks = make(Hooks)
+	}
 	return w.hooks
 }
 
+// Drops subsequent WriteHeader and Write calls.
+func (w *responseWriter) discard() {
+	w.discarded = true
+}
+
 func (w *responseWriter) SetHeader(status int) {
 	w.status = status
 }
@@ -148,11 +526,18 @@ func (w *responseWriter) WriteHeader(status int) {
 	if w.headerWritten {
 		return
 	}
-	w.Hooks().Run("before_write_header", HookDirectionReverse, w, nil, status)
+	w.hooks.Run("before_write_header", HookDirectionReverse, w, nil, status)
+	if w.headerWritten {
+		// a hook has written an error response instead.
+		return
+	}
+	if w.context != nil && w.context.App != nil && w.context.App.IsDraining() {
+		w.Header().Set("Connection", "close")
+	}
 	w.status = status
 	w.headerWritten = true
 	w.ResponseWriter.WriteHeader(status)
-	w.Hooks().Run("after_write_header", HookDirectionReverse, w, nil, status)
+	w.hooks.Run("after_write_header", HookDirectionReverse, w, nil, status)
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
@@ -162,15 +547,16 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 		}
 		w.WriteHeader(w.status)
 	}
+	if w.discarded {
+		return len(b), nil
+	}
 
 	if w.ContentLength() == 0 {
-		w.Hooks().Run("before_write_content", HookDirectionReverse, w, nil, b)
+		w.hooks.Run("before_write_content", HookDirectionReverse, w, nil, b)
 	}
 
 	i, err := w.ResponseWriter.Write(b)
-	if err == nil {
-		w.contentLength += len(b)
-	}
+	w.contentLength += i
 	return i, err
 }
 
@@ -182,6 +568,11 @@ func (w *responseWriter) Status() int {
 	return w.status
 }
 
+// Returns the wrapped http.ResponseWriter, so that http.ResponseController can flush responses.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 /* }}} */
 
 /* Middleware {{{ */
@@ -197,11 +588,13 @@ type Middleware http.Handler
 type MiddlewareChain struct {
 	middlewares []Middleware
 	sp          int
+	// time spent in each middleware, nil if middlewares are not profiled.
+	timings []time.Duration
 }
 
 // Returns a new MiddlewareChain object.
 func NewMiddlewareChain(middlewares []Middleware) *MiddlewareChain {
-	return &MiddlewareChain{middlewares, -1}
+	return &MiddlewareChain{middlewares: middlewares, sp: -1}
 }
 
 // Returns a copy of the MiddlewareChain object.
@@ -213,9 +606,27 @@ func (mc *MiddlewareChain) Copy() *MiddlewareChain {
 // the last middleware in the chain, causes the handler at the end of the chain to be invoked.
 func (mc *MiddlewareChain) DoNext(w http.ResponseWriter, r *http.Request) {
 	mc.sp += 1
+	if mc.timings != nil {
+		mc.doNextWithTiming(w, r)
+		return
+	}
 	mc.middlewares[mc.sp].ServeHTTP(w, r)
 }
 
+func (mc *MiddlewareChain) doNextWithTiming(w http.ResponseWriter, r *http.Request) {
+	i := mc.sp
+	start := time.Now()
+	mc.middlewares[i].ServeHTTP(w, r)
+	elapsed := time.Now().Sub(start)
+	if i < len(mc.timings) {
+		mc.timings[i] += elapsed
+	}
+	// excludes time spent in the next middleware from the calling middleware.
+	if i > 0 && i-1 < len(mc.timings) {
+		mc.timings[i-1] -= elapsed
+	}
+}
+
 func MiddlewareOf(arg interface{}) Middleware {
 	switch arg.(type) {
 	case http.Handler:
@@ -225,6 +636,18 @@ func MiddlewareOf(arg interface{}) Middleware {
 	}
 }
 
+// Returns a middleware that cancels the request context after the given duration.
+// Handlers should watch r.Context().Done() to stop long-running operations.
+//
+//     root.Get("report", "report", handler, cidre.NewTimeoutMiddleware(10 * time.Second))
+func NewTimeoutMiddleware(d time.Duration) Middleware {
+	return MiddlewareOf(func(w http.ResponseWriter, r *http.Request) {
+		stdctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		RequestContext(r).MiddlewareChain.DoNext(w, RequestWithContext(r, stdctx))
+	})
+}
+
 func MiddlewaresOf(args ...interface{}) []Middleware {
 	result := make([]Middleware, 0, len(args))
 	for _, arg := range args {
@@ -233,6 +656,46 @@ func MiddlewaresOf(args ...interface{}) []Middleware {
 	return result
 }
 
+// MiddlewareStack is a reusable list of middlewares that can be applied to
+// multiple mount points.
+//
+//     base := cidre.NewMiddlewareStack(logging, session)
+//     public := app.MountPoint("/")
+//     public.UseStack(base)
+//     admin := app.MountPoint("/admin")
+//     admin.UseStack(base.Append(adminAuth))
+type MiddlewareStack struct {
+	middlewares []Middleware
+}
+
+// Returns a new MiddlewareStack object.
+func NewMiddlewareStack(middlewares ...interface{}) *MiddlewareStack {
+	return &MiddlewareStack{MiddlewaresOf(middlewares...)}
+}
+
+// Returns a new MiddlewareStack object that has the given middlewares at the end of the stack.
+func (ms *MiddlewareStack) Append(middlewares ...interface{}) *MiddlewareStack {
+	result := make([]Middleware, 0, len(ms.middlewares)+len(middlewares))
+	result = append(result, ms.middlewares...)
+	result = append(result, MiddlewaresOf(middlewares...)...)
+	return &MiddlewareStack{result}
+}
+
+// Returns a new MiddlewareStack object that has the given middlewares at the front of the stack.
+func (ms *MiddlewareStack) Prepend(middlewares ...interface{}) *MiddlewareStack {
+	result := make([]Middleware, 0, len(ms.middlewares)+len(middlewares))
+	result = append(result, MiddlewaresOf(middlewares...)...)
+	result = append(result, ms.middlewares...)
+	return &MiddlewareStack{result}
+}
+
+// Returns a copy of the middlewares in the stack.
+func (ms *MiddlewareStack) Middlewares() []Middleware {
+	result := make([]Middleware, len(ms.middlewares))
+	copy(result, ms.middlewares)
+	return result
+}
+
 /* }}} */
 
 /* Logger {{{ */
@@ -263,8 +726,38 @@ func (ll LogLevel) String() string {
 	}
 }
 
+// Returns a LogLevel that has the given name like "info". Names are case insensitive.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, s := range logLevelStrings {
+		if strings.EqualFold(name, s) {
+			return level, nil
+		}
+	}
+	return LogLevelUnknown, errors.New(fmt.Sprintf("Unknown log level: '%v'", name))
+}
+
 func DefaultLogger(level LogLevel, message string) {
-	fmt.Fprintln(os.Stdout, BuildString(256, time.Now().Format(time.RFC3339), "\t", level.String(), "\t", message))
+	writeLog(os.Stdout, level, message)
+}
+
+// Returns a Logger that writes messages in the same format as the DefaultLogger to
+// the given writer. Messages below the min level are discarded.
+//
+//     app.Logger = cidre.LeveledLogger(cidre.LogLevelWarn, os.Stderr)
+func LeveledLogger(min LogLevel, out io.Writer) Logger {
+	var mutex sync.Mutex
+	return func(level LogLevel, message string) {
+		if level < min {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		writeLog(out, level, message)
+	}
+}
+
+func writeLog(out io.Writer, level LogLevel, message string) {
+	fmt.Fprintln(out, BuildString(256, time.Now().Format(time.RFC3339), "\t", level.String(), "\t", message))
 }
 
 /* }}} */
@@ -283,6 +776,9 @@ type Route struct {
 	Meta            Dict
 }
 
+// A Route.Method that matches requests with any methods.
+const MethodAny = "*"
+
 var NopMiddleware = Middleware(MiddlewareOf(func(w http.ResponseWriter, r *http.Request) {}))
 
 func NewRoute(n, p, m string, s bool, handler http.Handler, middlewares ...Middleware) *Route {
@@ -308,6 +804,12 @@ func NewRoute(n, p, m string, s bool, handler http.Handler, middlewares ...Middl
 func (route *Route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := RequestContext(r)
 	ctx.MiddlewareChain = route.MiddlewareChain.Copy()
+	if ctx.App.Config.ProfileMiddlewares {
+		// the chain ends with a handler and the NopMiddleware.
+		timings := make([]time.Duration, len(ctx.MiddlewareChain.middlewares)-2)
+		ctx.MiddlewareChain.timings = timings
+		ctx.Set(middlewareTimingsKey, timings)
+	}
 	ctx.MiddlewareChain.DoNext(w, r)
 }
 
@@ -328,6 +830,13 @@ func (mt *MountPoint) Use(middlewares ...interface{}) {
 	mt.Middlewares = append(mt.Middlewares, MiddlewaresOf(middlewares...)...)
 }
 
+// Adds middlewares in the given MiddlewareStacks to the end of the middleware chain.
+func (mt *MountPoint) UseStack(stacks ...*MiddlewareStack) {
+	for _, stack := range stacks {
+		mt.Middlewares = append(mt.Middlewares, stack.middlewares...)
+	}
+}
+
 // Registers a http.HandlerFunc and middlewares with the given path pattern and method.
 func (mt *MountPoint) Route(n, p, m string, s bool, h http.HandlerFunc, middlewares ...interface{}) *Route {
 	mds := make([]Middleware, 0, 10)
@@ -360,30 +869,325 @@ func (mt *MountPoint) Delete(n, p string, h http.HandlerFunc, middlewares ...int
 
 // Registers a handler that serves static files.
 func (mt *MountPoint) Static(n, p, local string, middlewares ...interface{}) *Route {
-	path := strings.Trim(p, "/")
-	server := http.StripPrefix(mt.Path+path, http.FileServer(http.Dir(local)))
-	rt := mt.Route(n, path+"/(?P<path>.*)", "GET", true, server.ServeHTTP, middlewares...)
+	rt := mt.StaticFileSystem(n, p, http.Dir(local), middlewares...)
+	rt.Meta.Set("local", local)
+	return rt
+}
+
+// Registers a handler that serves static files with the given StaticConfig.
+func (mt *MountPoint) StaticWithConfig(n, p, local string, config *StaticConfig, middlewares ...interface{}) *Route {
+	rt := mt.staticRoute(n, p, http.Dir(local), config, middlewares...)
 	rt.Meta.Set("local", local)
 	return rt
 }
 
+// Registers a handler that serves static files in the given fs.FS(e.g. embed.FS).
+func (mt *MountPoint) StaticFS(n, p string, fsys fs.FS, middlewares ...interface{}) *Route {
+	return mt.StaticFileSystem(n, p, http.FS(fsys), middlewares...)
+}
+
+// Registers a handler that serves static files in the given http.FileSystem.
+func (mt *MountPoint) StaticFileSystem(n, p string, fileSystem http.FileSystem, middlewares ...interface{}) *Route {
+	return mt.staticRoute(n, p, fileSystem, DefaultStaticConfig(), middlewares...)
+}
+
+func (mt *MountPoint) staticRoute(n, p string, fileSystem http.FileSystem, config *StaticConfig, middlewares ...interface{}) *Route {
+	path := strings.Trim(p, "/")
+	if config.DisableDirectoryListing {
+		fileSystem = noDirectoryListingFileSystem{fileSystem}
+	}
+	server := http.StripPrefix(mt.Path+path, http.FileServer(fileSystem))
+	cacheControl := config.cacheControl()
+	etags := &staticEtags{}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, mt.Path+path)
+		if config.useFallback(fileSystem, r, name) {
+			serveFallback(w, r, fileSystem, config.SPAFallback)
+			return
+		}
+		if config.ETag {
+			if etag, ok := etags.get(fileSystem, name); ok {
+				w.Header().Set("ETag", etag)
+			}
+		}
+		if len(cacheControl) != 0 {
+			w.(ResponseWriter).Hooks().Add("before_write_header", func(w http.ResponseWriter, rnil *http.Request, status interface{}) {
+				if s := status.(int); s == http.StatusOK || s == http.StatusNotModified || s == http.StatusPartialContent {
+					w.Header().Set("Cache-Control", cacheControl)
+				}
+			})
+		}
+		server.ServeHTTP(w, r)
+	}
+	return mt.Route(n, path+"/(?P<path>.*)", "GET", true, handler, middlewares...)
+}
+
+/* }}} */
+
+/* Static files {{{ */
+
+// StaticConfig is a configuration object for static file routes.
+type StaticConfig struct {
+	// Emits "Cache-Control: public, max-age=N" if this value is greater than 0.
+	// default: 0
+	MaxAge time.Duration
+	// Adds "immutable" to the Cache-Control header. This is useful for fingerprinted assets.
+	// default: false
+	Immutable bool
+	// Returns 404 for directories without an index.html if true.
+	// default: false
+	DisableDirectoryListing bool
+	// A file(like "index.html") to be served with 200 instead of 404 for GET requests. This is useful for
+	// single page applications that use client-side routing.
+	// Requests for paths with file extensions(like '.js') are not affected.
+	// default: ""
+	SPAFallback string
+	// Emits an ETag header computed from the file contents if true.
+	// Requests with a matching If-None-Match header get 304 responses.
+	// ETags are cached until the size or the modification time of the file changes.
+	// default: false
+	ETag bool
+}
+
+// Returns a StaticConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the StaticConfig object.
+func DefaultStaticConfig(init ...func(*StaticConfig)) *StaticConfig {
+	self := &StaticConfig{
+		MaxAge:                  0,
+		Immutable:               false,
+		DisableDirectoryListing: false,
+		SPAFallback:             "",
+		ETag:                    false,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+func (sc *StaticConfig) cacheControl() string {
+	if sc.MaxAge <= 0 {
+		return ""
+	}
+	value := fmt.Sprintf("public, max-age=%d", int64(sc.MaxAge/time.Second))
+	if sc.Immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+func (sc *StaticConfig) useFallback(fs http.FileSystem, r *http.Request, name string) bool {
+	if len(sc.SPAFallback) == 0 || r.Method != "GET" || len(filepath.Ext(name)) != 0 {
+		return false
+	}
+	f, err := fs.Open("/" + strings.TrimLeft(name, "/"))
+	if err != nil {
+		return true
+	}
+	f.Close()
+	return false
+}
+
+type staticEtag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+type staticEtags struct {
+	cache sync.Map
+}
+
+func (se *staticEtags) get(fs http.FileSystem, name string) (string, bool) {
+	name = "/" + strings.TrimLeft(name, "/")
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return "", false
+	}
+	if v, ok := se.cache.Load(name); ok {
+		cached := v.(*staticEtag)
+		if cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+			return cached.etag, true
+		}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", false
+	}
+	etag := fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16])
+	se.cache.Store(name, &staticEtag{stat.Size(), stat.ModTime(), etag})
+	return etag, true
+}
+
+func serveFallback(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name string) {
+	f, err := fs.Open("/" + strings.TrimLeft(name, "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
+
+// Replies to the request with the contents of the named file.
+// ServeFile handles Range and conditional requests like http.ServeFile, and
+// works with hooks of the cidre.ResponseWriter.
+func ServeFile(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
+
+// A trailer name for SHA-256 checksums written by ServeFileWithChecksum.
+const ChecksumTrailer = "X-Checksum-SHA256"
+
+// Replies to the request with the contents of the named file using chunked transfer encoding,
+// and emits a hex encoded SHA-256 checksum of the contents as an `X-Checksum-SHA256` trailer.
+// Unlike ServeFile, ServeFileWithChecksum does not handle Range and conditional requests.
+func ServeFileWithChecksum(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Trailer", ChecksumTrailer)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), f); err != nil {
+		return
+	}
+	w.Header().Set(ChecksumTrailer, hex.EncodeToString(hash.Sum(nil)))
+}
+
+type noDirectoryListingFileSystem struct {
+	http.FileSystem
+}
+
+func (fs noDirectoryListingFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := f.Stat(); err == nil && stat.IsDir() {
+		index, err := fs.FileSystem.Open(strings.TrimRight(name, "/") + "/index.html")
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
 /* }}} */
 
 /* App {{{ */
 
 // AppConfig is a configuration object for the App struct.
 type AppConfig struct {
+	// Templates are reloaded on each render and Json responses are indented if Debug is true.
+	// These apply only to the default renderer that App.Setup creates when App.Renderer is nil.
 	// default : false
 	Debug bool
 	// Server address, default:"127.0.0.1:8080"
+	// A value that starts with "unix:" like "unix:/var/run/app.sock" is treated as a unix domain socket path.
 	Addr string
+	// Serves HTTP/2 over cleartext TCP connections(h2c) with prior knowledge if EnableH2C is true.
+	// This option should be used only behind trusted load balancers.
+	// default: false
+	EnableH2C bool
+	// CIDRs or IP addresses of trusted reverse proxies. Context.ClientIP takes a client IP address
+	// from forwarded headers only if the request comes from these proxies.
+	// default: nil
+	TrustedProxies []string
+	// A public base URL of the App like "https://www.example.com". Context.AbsoluteUrl uses
+	// this value instead of the scheme and the host of the request if this value is not empty.
+	// Set this value if absolute urls are used for security-sensitive links, because
+	// the host of the request is taken from the Host header sent by clients.
+	// default: ""
+	ExternalBaseUrl string
+	// Headers to be used for Context.ClientIP in order of preference.
+	// "X-Forwarded-For", "X-Real-IP" and "Forwarded" are supported.
+	// default: "X-Forwarded-For", "X-Real-IP", "Forwarded"
+	ForwardedHeaders []string
+	// Maximum size of request bodies for Context.Bind* methods.
+	// default: 10MB
+	MaxBindBodySize int64
+	// Maximum size of multipart request bodies. Files in request bodies larger
+	// than this value can not be read by Context.FormFile.
+	// default: 32MB
+	MaxUploadSize int64
+	// Maximum bytes of multipart request bodies stored in memory. Rest of the files are
+	// stored in temporary files.
+	// default: 32MB
+	MaxMultipartMemory int64
+	// Context.BindJSON rejects unknown fields if StrictBind is true.
+	// default: false
+	StrictBind bool
+	// Reuses Context and ResponseWriter objects to reduce allocations if ReuseContexts is true.
+	// Handlers that use Context objects after requests finished must call Context.Detach.
+	// default: false
+	ReuseContexts bool
+	// Timeout for the checks registered by App.HealthCheck.
+	// default: 5s
+	HealthCheckTimeout time.Duration
+	// File mode of the unix domain socket. If this value is 0, the file mode will not be changed.
+	// default: 0
+	SocketMode os.FileMode
 	// default: ""
 	TemplateDirectory string
 	// default: true, if this value is true, cidre will treat a "_method" parameter as a HTTP method name.
 	AllowHttpMethodOverwrite bool
+	// Sources of the overwriting HTTP method in order of precedence. "header" is an
+	// X-HTTP-Method-Override header, "query" is a "_method" query parameter and "form" is a "_method"
+	// parameter in urlencoded or multipart request bodies. Methods are overwritten only for POST requests.
+	// Urlencoded bodies are read up to MaxBindBodySize and multipart bodies up to MaxUploadSize.
+	// App.Setup panics if this value has unknown sources.
+	// default: "header", "form", "query"
+	MethodOverwriteSources []string
 	// cidre uses text/template to format access logs.
 	// default: "{{.c.Id}} {{.req.RemoteAddr}} {{.req.Method}} {{.req.RequestURI}} {{.req.Proto}} {{.res.Status}} {{.res.ContentLength}} {{.c.ResponseTime}}"
 	AccessLogFormat string
+	// Writes access logs as JSON objects instead of the AccessLogFormat if AccessLogJson is true.
+	// default: false
+	AccessLogJson bool
+	// Access logs are not written for requests whose paths match these values.
+	// A value that contains '*', '?' or '[' is a pattern of path.Match, otherwise a path prefix
+	// that matches at a segment boundary("/healthz" matches "/healthz/live", but not "/healthzcheck").
+	// default: nil
+	AccessLogSkip []string
+	// Access logs are not written for static routes if AccessLogSkipStatic is true.
+	// default: false
+	AccessLogSkipStatic bool
+	// If this value is greater than 0, access logs are written only for error responses(status >= 400)
+	// and requests that take longer than this value.
+	// default: 0
+	AccessLogSlowThreshold time.Duration
 	// default: 180s
 	ReadTimeout time.Duration
 	// default: 180s
@@ -395,6 +1199,80 @@ type AppConfig struct {
 	// calls runtime.GOMAXPROCS(runtime.NumCPU()) when server starts if AutoMaxProcs is true.
 	// default: true
 	AutoMaxProcs bool
+	// shutdowns the server gracefully when the server receives SIGINT or SIGTERM if GracefulShutdown is true.
+	// default: false
+	GracefulShutdown bool
+	// maximum duration for waiting in-flight requests when the server receives signals.
+	// default: 30s
+	GracefulTimeout time.Duration
+	// Run serves HTTPS if both CertFile and KeyFile are set.
+	// default: ""
+	CertFile string
+	// default: ""
+	KeyFile string
+	// minimum TLS version: "1.0", "1.1", "1.2" or "1.3"
+	// default: "1.2"
+	MinTLSVersion string
+	// A PEM file of CA certificates that verify client certificates for mutual TLS.
+	// See Context.ClientCertificate.
+	// default: ""
+	ClientCAFile string
+	// A policy for client certificates: "none", "request", "require", "verify_if_given" or
+	// "require_and_verify". If this value is empty, "require_and_verify" is used when
+	// ClientCAFile is set, otherwise "none".
+	// default: ""
+	ClientAuth string
+	// Messages below this level are not written to the App.Logger: "debug", "info", "warn",
+	// "error" or "crit". Access logs are not affected by this value.
+	// default: "debug"
+	LogLevel string
+	// Records time spent in each middleware of routes if ProfileMiddlewares is true.
+	// See Context.MiddlewareTimings.
+	// default: false
+	ProfileMiddlewares bool
+	// A function that generates ids of request contexts. If this value is nil, ids consist of
+	// a timestamp and a random part like "202401021504-8f3a6c1e9b2d4075e1c3".
+	// default: nil
+	RequestIdGenerator func() string
+	// A prefix of generated request ids(e.g. a host name).
+	// default: ""
+	RequestIdPrefix string
+	// A name of the response header that contains the request id. If this value is empty,
+	// the header is not sent.
+	// default: "X-Request-Id"
+	RequestIdHeader string
+	// Uses a request id in the RequestIdHeader of the request if TrustRequestIdHeader is true,
+	// so ids propagate across services. Enable this only if clients are trusted, for example,
+	// the App is behind a proxy that sets the header.
+	// default: false
+	TrustRequestIdHeader bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none": tls.NoClientCert, "request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert, "verify_if_given": tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// UnixSocketPrefix is a prefix of the AppConfig.Addr for unix domain sockets.
+const UnixSocketPrefix = "unix:"
+
+// Returns a path of the unix domain socket and true if Addr is a unix domain socket address.
+func (config *AppConfig) UnixSocketPath() (string, bool) {
+	if strings.HasPrefix(config.Addr, UnixSocketPrefix) {
+		return config.Addr[len(UnixSocketPrefix):], true
+	}
+	return "", false
+}
+
+// Returns true if both CertFile and KeyFile are set.
+func (config *AppConfig) IsTLS() bool {
+	return len(config.CertFile) != 0 && len(config.KeyFile) != 0
 }
 
 // Returns a new AppConfig object that has default values set.
@@ -406,12 +1284,41 @@ func DefaultAppConfig(init ...func(*AppConfig)) *AppConfig {
 		Addr:                     "127.0.0.1:8080",
 		TemplateDirectory:        "",
 		AllowHttpMethodOverwrite: true,
+		MethodOverwriteSources:   []string{"header", "form", "query"},
 		AccessLogFormat:          "{{.c.Id}} {{.req.RemoteAddr}} {{.req.Method}} {{.req.RequestURI}} {{.req.Proto}} {{.res.Status}} {{.res.ContentLength}} {{.c.ResponseTime}}",
+		AccessLogJson:            false,
+		AccessLogSkip:            nil,
+		AccessLogSkipStatic:      false,
+		AccessLogSlowThreshold:   0,
 		ReadTimeout:              time.Second * 180,
 		WriteTimeout:             time.Second * 180,
 		MaxHeaderBytes:           8192,
 		KeepAlive:                false,
 		AutoMaxProcs:             true,
+		GracefulShutdown:         false,
+		GracefulTimeout:          time.Second * 30,
+		CertFile:                 "",
+		KeyFile:                  "",
+		MinTLSVersion:            "1.2",
+		ClientCAFile:             "",
+		ClientAuth:               "",
+		SocketMode:               0,
+		EnableH2C:                false,
+		HealthCheckTimeout:       time.Second * 5,
+		ReuseContexts:            false,
+		MaxBindBodySize:          10 << 20,
+		MaxUploadSize:            32 << 20,
+		MaxMultipartMemory:       32 << 20,
+		TrustedProxies:           nil,
+		ExternalBaseUrl:          "",
+		ForwardedHeaders:         []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"},
+		StrictBind:               false,
+		LogLevel:                 "debug",
+		ProfileMiddlewares:       false,
+		RequestIdGenerator:       nil,
+		RequestIdPrefix:          "",
+		RequestIdHeader:          "X-Request-Id",
+		TrustRequestIdHeader:     false,
 	}
 	if len(init) > 0 {
 		init[0](self)
@@ -419,12 +1326,40 @@ func DefaultAppConfig(init ...func(*AppConfig)) *AppConfig {
 	return self
 }
 
+// PanicInfo represents an information about a panic occurred during a request.
+type PanicInfo struct {
+	// A value returned by recover()
+	Recovered interface{}
+	// A stack trace of the goroutine that caused the panic
+	Stack []byte
+	// A name of the matched route, or an empty string if no routes matched.
+	RouteName string
+	// An id of the request context
+	ContextId string
+	// Elapsed time since the request started
+	Elapsed time.Duration
+}
+
+func (pi *PanicInfo) String() string {
+	return fmt.Sprintf("%v: route=%v, id=%v, elapsed=%v\n\n%s", pi.Recovered, pi.RouteName, pi.ContextId, pi.Elapsed, pi.Stack)
+}
+
+// Converts a panic handler that receives a recovered value to the App.OnPanic form.
+func PanicHandlerOf(handler func(http.ResponseWriter, *http.Request, interface{})) func(http.ResponseWriter, *http.Request, *PanicInfo) {
+	return func(w http.ResponseWriter, r *http.Request, info *PanicInfo) {
+		handler(w, r, info.Recovered)
+	}
+}
+
 // App represents a web application.
 // Hooks:
 //   - setup(nil, nil, self)
 //   - start_server(nil, nil, self)
-//   - start_request(http.ResponseWriter, *http.Request, nil)
-//   - start_action(http.ResponseWriter, *http.Request, nil)
+//   - stop_server(nil, nil, self)
+//   - start_request(http.ResponseWriter, *http.Request, nil) : abortable
+//   - before_route(http.ResponseWriter, *http.Request, nil) : before a route is matched
+//   - after_route(http.ResponseWriter, *http.Request, *Route) : after a route is matched, not called if no routes found
+//   - start_action(http.ResponseWriter, *http.Request, nil) : abortable
 //   - end_action(http.ResponseWriter, *http.Request, nil)
 //   - end_request(http.ResponseWriter, *http.Request, nil)
 type App struct {
@@ -433,14 +1368,42 @@ type App struct {
 	Middlewares  []Middleware
 	Logger       Logger
 	AccessLogger Logger
+	// Messages below this level are not written to the Logger and the StructuredLogger.
+	// NewApp sets this value from the AppConfig.LogLevel.
+	LogLevel LogLevel
+	// A logger to be used instead of the Logger and the AccessLogger if this value is not nil.
+	// Messages are filtered by the LogLevel, access logs are not.
+	StructuredLogger StructuredLogger
 	// handlers to be called if errors was occurred during a request.
-	OnPanic func(http.ResponseWriter, *http.Request, interface{})
+	// Use PanicHandlerOf to convert a func(http.ResponseWriter, *http.Request, interface{}) handler.
+	OnPanic func(http.ResponseWriter, *http.Request, *PanicInfo)
 	// handlers to be called if no suitable routes found.
-	OnNotFound        func(http.ResponseWriter, *http.Request)
-	Renderer          Renderer
-	Hooks             Hooks
-	contextIdSeq      uint32
+	OnNotFound func(http.ResponseWriter, *http.Request)
+	// handlers to be called if Renderer.Auto can not find acceptable media types.
+	OnNotAcceptable func(http.ResponseWriter, *http.Request)
+	// handlers to be called if Context.BindOrReject fails with ValidationErrors.
+	OnValidationError func(http.ResponseWriter, *http.Request, ValidationErrors)
+	// handlers to be called if a session store fails to load or create a session.
+	OnSessionError func(http.ResponseWriter, *http.Request, error)
+	Renderer       Renderer
+	Hooks          Hooks
+	// id of the end_request hook that writes access logs, registered by App.Setup.
+	// Remove this hook from App.Hooks to disable or replace access logging, even while serving requests.
+	AccessLogHookId   HookId
 	accessLogTemplate *template.Template
+	serverMutex       sync.Mutex
+	server            *http.Server
+	shutdownDone      chan bool
+	draining          int32
+	cancelRequests    context.CancelFunc
+	healthChecks      healthChecks
+	trustedProxies    proxyNets
+	trustedProxyOnce  sync.Once
+	// an App that this App is mounted on by App.Mount, and the path prefix.
+	mountParent *App
+	mountPath   string
+	// Apps mounted on this App by App.Mount, keyed by their route names.
+	mounts map[string]*App
 }
 
 // Returns a new App object.
@@ -452,22 +1415,87 @@ func NewApp(config *AppConfig) *App {
 		Logger:       DefaultLogger,
 		AccessLogger: DefaultLogger,
 		Renderer:     nil,
-		contextIdSeq: 0,
 		Hooks:        make(Hooks),
 	}
+	self.Hooks.makeConcurrent()
 	self.OnPanic = self.DefaultOnPanic
 	self.OnNotFound = self.DefaultOnNotFound
+	self.OnValidationError = self.DefaultOnValidationError
+	self.OnNotAcceptable = self.DefaultOnNotAcceptable
+	self.OnSessionError = self.DefaultOnSessionError
+	if len(config.LogLevel) != 0 {
+		level, err := ParseLogLevel(config.LogLevel)
+		if err != nil {
+			panic(err)
+		}
+		self.LogLevel = level
+	}
 	return self
 }
 
-func (app *App) newContextId() string {
+// Writes the message to the Logger if the level is not below the LogLevel.
+func (app *App) log(level LogLevel, message string) {
+	if level < app.LogLevel {
+		return
+	}
+	if app.StructuredLogger != nil {
+		app.StructuredLogger.Log(level, message, map[string]interface{}{})
+		return
+	}
+	app.Logger(level, message)
+}
+
+// Maximum length of request ids taken from request headers.
+const maxRequestIdLength = 128
+
+func (app *App) newContextId(r *http.Request) string {
+	if app.Config.TrustRequestIdHeader && len(app.Config.RequestIdHeader) != 0 {
+		if id := r.Header.Get(app.Config.RequestIdHeader); isValidRequestId(id) {
+			return id
+		}
+	}
+	if app.Config.RequestIdGenerator != nil {
+		return app.Config.RequestIdPrefix + app.Config.RequestIdGenerator()
+	}
 	now := time.Now()
-	return fmt.Sprintf("%04d%02d%02d%02d%02d%010d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), atomic.AddUint32(&(app.contextIdSeq), 1))
+	return fmt.Sprintf("%v%04d%02d%02d%02d%02d-%v", app.Config.RequestIdPrefix,
+		now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), GenerateRandomId(10))
 }
 
-func (app *App) DefaultOnPanic(w http.ResponseWriter, r *http.Request, rcv interface{}) {
+// Returns true if the id consists of printable ASCII characters and is not too long,
+// so that ids sent by clients can not break logs and headers.
+func isValidRequestId(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (app *App) DefaultOnPanic(w http.ResponseWriter, r *http.Request, info *PanicInfo) {
+	if app.StructuredLogger == nil {
+		app.log(LogLevelError, info.String())
+	} else if LogLevelError >= app.LogLevel {
+		app.StructuredLogger.Log(LogLevelError, fmt.Sprint(info.Recovered), map[string]interface{}{
+			"id":      info.ContextId,
+			"method":  r.Method,
+			"uri":     r.RequestURI,
+			"route":   info.RouteName,
+			"elapsed": info.Elapsed,
+			"stack":   string(info.Stack),
+		})
+	}
 	if app.Config.Debug {
-		http.Error(w, fmt.Sprintf("%v:\n\n%s", rcv, debug.Stack()), http.StatusInternalServerError)
+		var tplErr *TemplateError
+		if err, ok := info.Recovered.(error); ok && errors.As(err, &tplErr) {
+			writeTemplateErrorPage(w, tplErr, info.Stack)
+			return
+		}
+		http.Error(w, fmt.Sprintf("%v:\n\n%s", info.Recovered, info.Stack), http.StatusInternalServerError)
 	} else {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
@@ -477,20 +1505,150 @@ func (app *App) DefaultOnNotFound(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+func (app *App) DefaultOnNotAcceptable(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+}
+
+func (app *App) DefaultOnSessionError(w http.ResponseWriter, r *http.Request, err error) {
+	app.log(LogLevelError, fmt.Sprintf("session error: %v", err))
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// Writes ValidationErrors as a JSON object like {"errors":{"name":["is required"]}}
+// with 422 Unprocessable Entity.
+func (app *App) DefaultOnValidationError(w http.ResponseWriter, r *http.Request, errs ValidationErrors) {
+	app.Renderer.JsonStatus(w, http.StatusUnprocessableEntity, map[string]interface{}{"errors": errs})
+}
+
+var methodOverwriteSources = map[string]bool{"header": true, "query": true, "form": true}
+
+// Returns a HTTP method from the AppConfig.MethodOverwriteSources, or an empty string.
+// Request bodies are parsed only if they are forms.
+func (app *App) overwrittenMethod(ctx *Context) string {
+	r := ctx.Request
+	for _, source := range app.Config.MethodOverwriteSources {
+		var method string
+		switch source {
+		case "header":
+			method = r.Header.Get("X-HTTP-Method-Override")
+		case "query":
+			method = r.URL.Query().Get("_method")
+		case "form":
+			if isMultipartRequest(r) {
+				ctx.parseMultipartForm()
+			} else if mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediatype != "application/x-www-form-urlencoded" {
+				continue
+			} else {
+				ctx.parseForm()
+			}
+			method = r.PostForm.Get("_method")
+		}
+		if len(method) != 0 {
+			return method
+		}
+	}
+	return ""
+}
+
 // Builds an url for the given named route with path parameters.
+// Routes of Apps mounted by App.Mount are named with the prefix like "admin.index".
 func (app *App) BuildUrl(n string, args ...string) string {
+	if sub, ok := app.mounts[n]; ok {
+		return sub.mountPrefix() + "/"
+	}
 	route, ok := app.Routes[n]
 	if !ok {
+		mountName := ""
+		for name := range app.mounts {
+			if strings.HasPrefix(n, name+".") && len(name) > len(mountName) {
+				mountName = name
+			}
+		}
+		if len(mountName) != 0 {
+			return app.mounts[mountName].BuildUrl(n[len(mountName)+1:], args...)
+		}
 		panic(fmt.Sprintf("Route '%v' not defined.", n))
 	}
 	reg := regexp.MustCompile(`\(\?P<([^<]+)>[^\)]+\)`)
 	counter := -1
-	return reg.ReplaceAllStringFunc(route.PatternString, func(m string) string {
+	return app.mountPrefix() + reg.ReplaceAllStringFunc(route.PatternString, func(m string) string {
 		counter += 1
 		return args[counter]
 	})
 }
 
+// Returns a path prefix of the App mounted by App.Mount.
+func (app *App) mountPrefix() string {
+	if app.mountParent == nil {
+		return ""
+	}
+	return app.mountParent.mountPrefix() + app.mountPath
+}
+
+// Mounts the sub App under the given path prefix, so that Apps built as modules can be
+// composed into one App. Requests under the prefix are passed to the sub App after middlewares
+// of this App, with the prefix removed from the URL path. The sub App handles them with its own
+// routes, middlewares, hooks, Renderer, OnNotFound, OnPanic and AppConfig, and shares the Context
+// with this App, so RequestContext(r).App is the sub App in its handlers.
+// Context ids and access logs are handled by this App.
+//
+// The mount is registered as a route named by the prefix like "admin", and routes of the sub App
+// can be built by this App with names like "admin.index". The sub App's BuildUrl builds
+// urls with the prefix. Mount panics if the prefix is "/" or the sub App is already mounted.
+//
+//     admin := cidre.NewApp(cidre.DefaultAppConfig())
+//     admin.MountPoint("/").Get("index", "", handler)
+//     app.Mount("/admin", admin)
+//     app.BuildUrl("admin.index")   // -> "/admin/"
+//     admin.BuildUrl("index")       // -> "/admin/"
+func (app *App) Mount(prefix string, sub *App) {
+	if sub.mountParent != nil {
+		panic(fmt.Sprintf("App is already mounted at '%v'.", sub.mountPrefix()))
+	}
+	mt := app.MountPoint(prefix)
+	path := strings.TrimRight(mt.Path, "/")
+	if len(path) == 0 {
+		panic("Apps can not be mounted at '/'.")
+	}
+	name := strings.Replace(strings.Trim(path, "/"), "/", ".", -1)
+	if _, ok := app.Routes[name]; ok {
+		panic(fmt.Sprintf("Route '%v' already defined.", name))
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		rw, ok := w.(ResponseWriter)
+		if !ok {
+			rw = NewResponseWriter(w)
+			rw.(*responseWriter).context = ctx
+		}
+		sr := new(http.Request)
+		*sr = *r
+		sr.URL = new(url.URL)
+		*sr.URL = *r.URL
+		sr.URL.Path = strings.TrimPrefix(r.URL.Path, path)
+		sr.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, path)
+		if len(sr.URL.Path) == 0 {
+			sr.URL.Path = "/"
+		}
+		parent, route, pathParams, chain, writer, request := ctx.App, ctx.Route, ctx.pathParams, ctx.MiddlewareChain, ctx.writer, ctx.Request
+		defer func() {
+			ctx.App, ctx.Route, ctx.pathParams, ctx.MiddlewareChain, ctx.writer, ctx.Request = parent, route, pathParams, chain, writer, request
+		}()
+		ctx.App, ctx.Route, ctx.pathParams, ctx.writer, ctx.Request = sub, nil, nil, rw, sr
+		sub.serve(rw, sr)
+	}
+	app.Routes[name] = NewRoute(name, path+"(?:/.*)?", MethodAny, false, http.HandlerFunc(handler), mt.Middlewares...)
+	if app.mounts == nil {
+		app.mounts = make(map[string]*App)
+	}
+	app.mounts[name] = sub
+	sub.mountParent = app
+	sub.mountPath = path
+	if sub.accessLogTemplate != nil {
+		sub.Hooks.Remove("end_request", sub.AccessLogHookId)
+	}
+}
+
 // Adds a middleware to the end of the middleware chain.
 func (app *App) Use(middlewares ...interface{}) {
 	app.Middlewares = append(app.Middlewares, MiddlewaresOf(middlewares...)...)
@@ -503,40 +1661,95 @@ func (app *App) MountPoint(path string) *MountPoint {
 	return mp
 }
 
+func (app *App) release(w *responseWriter, ctx *Context) {
+	w.reset()
+	responseWriterPool.Put(w)
+	if !ctx.detached {
+		ctx.reset()
+		contextPool.Put(ctx)
+	}
+}
+
 func (app *App) cleanup(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(r)
 	if rcv := recover(); rcv != nil {
-		app.OnPanic(w, r, rcv)
+		info := &PanicInfo{
+			Recovered: rcv,
+			Stack:     debug.Stack(),
+			ContextId: ctx.Id,
+			Elapsed:   time.Now().Sub(ctx.StartedAt),
+		}
+		if ctx.Route != nil {
+			info.RouteName = ctx.Route.Name
+		}
+		app.OnPanic(w, r, info)
 	}
-	ctx := RequestContext(r)
 	ctx.ResponseTime = time.Now().Sub(ctx.StartedAt)
 	app.Hooks.Run("end_request", HookDirectionReverse, w, r, nil)
+	// net/http removes temporary files only for multipart forms parsed on the original request.
+	if ctx.Request.MultipartForm != nil {
+		ctx.Request.MultipartForm.RemoveAll()
+	}
 }
 
 func (app *App) ServeHTTP(ww http.ResponseWriter, r *http.Request) {
-	w := NewResponseWriter(ww)
-	ctx := NewContext(app, app.newContextId(), r)
+	var w ResponseWriter
+	var ctx *Context
+	if app.Config.ReuseContexts {
+		rw := responseWriterPool.Get().(*responseWriter)
+		rw.ResponseWriter = ww
+		ctx = contextPool.Get().(*Context)
+		ctx.init(app, app.newContextId(r), r)
+		// Contexts of requests sent by TestClients are returned in TestResponses.
+		ctx.detached = r.Context().Value(testClientKey{}) != nil
+		rw.context = ctx
+		ctx.writer = rw
+		w = rw
+		defer app.release(rw, ctx)
+	} else {
+		w = NewResponseWriter(ww)
+		ctx = NewContext(app, app.newContextId(r), r)
+		w.(*responseWriter).context = ctx
+		ctx.writer = w
+	}
+	r = RequestWithContext(r, r.Context())
 	ctx.StartedAt = time.Now()
+	if len(app.Config.RequestIdHeader) != 0 {
+		w.Header().Set(app.Config.RequestIdHeader, ctx.Id)
+	}
+	app.serve(w, r)
+}
 
+// Runs hooks and the matched route for the request associated with a Context.
+func (app *App) serve(w ResponseWriter, r *http.Request) {
+	ctx := RequestContext(r)
 	defer app.cleanup(w, r)
 
-	app.Hooks.Run("start_request", HookDirectionNormal, w, r, nil)
+	if !app.Hooks.RunAbortable("start_request", HookDirectionNormal, w, r, nil) {
+		return
+	}
+
+	app.Hooks.Run("before_route", HookDirectionNormal, w, r, nil)
 
 	path := r.URL.Path
 	method := r.Method
-	if app.Config.AllowHttpMethodOverwrite {
-		if overwrittenMethod := r.PostFormValue("_method"); len(overwrittenMethod) > 0 {
+	if app.Config.AllowHttpMethodOverwrite && method == "POST" {
+		if overwrittenMethod := app.overwrittenMethod(ctx); len(overwrittenMethod) > 0 {
 			method = overwrittenMethod
 		}
 	}
 	for _, route := range app.Routes {
-		if strings.ToUpper(method) != strings.ToUpper(route.Method) {
+		if route.Method != MethodAny && strings.ToUpper(method) != strings.ToUpper(route.Method) {
 			continue
 		}
 
 		submatches := route.Pattern.FindStringSubmatch(path)
 		if len(submatches) > 0 {
+			if len(route.PathParamNames) != 0 && ctx.pathParams == nil {
+				ctx.pathParams = url.Values{}
+			}
 			for i, pathParamName := range route.PathParamNames {
-				ctx.PathParams.Add(pathParamName, submatches[i+1])
+				ctx.pathParams.Add(pathParamName, submatches[i+1])
 			}
 			ctx.Route = route
 		}
@@ -549,15 +1762,94 @@ func (app *App) ServeHTTP(ww http.ResponseWriter, r *http.Request) {
 		app.OnNotFound(w, r)
 		return
 	}
+	app.Hooks.Run("after_route", HookDirectionNormal, w, r, ctx.Route)
 
-	app.Hooks.Run("start_action", HookDirectionNormal, w, r, nil)
+	if !app.Hooks.RunAbortable("start_action", HookDirectionNormal, w, r, nil) {
+		return
+	}
 	ctx.Route.ServeHTTP(w, r)
 	app.Hooks.Run("end_action", HookDirectionReverse, w, r, nil)
 }
 
+// Route.Meta key to disable access logs for the route.
+//
+//     root.Get("ping", "ping", handler).Meta.Set(cidre.MetaSkipAccessLog, true)
+const MetaSkipAccessLog = "skip_access_log"
+
+func (app *App) skipsAccessLog(urlPath string) bool {
+	for _, skip := range app.Config.AccessLogSkip {
+		if strings.ContainsAny(skip, "*?[") {
+			if ok, _ := path.Match(skip, urlPath); ok {
+				return true
+			}
+		} else if urlPath == skip || strings.HasPrefix(urlPath, strings.TrimSuffix(skip, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// An access log written if AppConfig.AccessLogJson is true.
+type accessLogEntry struct {
+	Id             string  `json:"id"`
+	RemoteAddr     string  `json:"remote_addr"`
+	Method         string  `json:"method"`
+	Uri            string  `json:"uri"`
+	Proto          string  `json:"proto"`
+	Status         int     `json:"status"`
+	Length         int     `json:"length"`
+	ResponseTimeMs float64 `json:"response_time_ms"`
+}
+
 func (app *App) writeAccessLog(w http.ResponseWriter, r *http.Request, d interface{}) {
+	ctx := RequestContext(r)
+	if ctx.Route != nil && ctx.Route.Meta.GetBool(MetaSkipAccessLog) {
+		return
+	}
+	if ctx.Route != nil && ctx.Route.IsStatic && app.Config.AccessLogSkipStatic {
+		return
+	}
+	if app.skipsAccessLog(r.URL.Path) {
+		return
+	}
+	if threshold := app.Config.AccessLogSlowThreshold; threshold > 0 && ctx.ResponseTime <= threshold {
+		if status := w.(ResponseWriter).Status(); status < 400 {
+			return
+		}
+	}
+	if app.StructuredLogger != nil {
+		fields := map[string]interface{}{
+			"id":          ctx.Id,
+			"remote_addr": r.RemoteAddr,
+			"method":      r.Method,
+			"uri":         r.RequestURI,
+			"proto":       r.Proto,
+			"status":      w.(ResponseWriter).Status(),
+			"size":        w.(ResponseWriter).ContentLength(),
+			"duration":    ctx.ResponseTime,
+		}
+		if ctx.Route != nil {
+			fields["route"] = ctx.Route.Name
+		}
+		app.StructuredLogger.Log(LogLevelInfo, "access", fields)
+		return
+	}
+	if app.Config.AccessLogJson {
+		data, _ := json.Marshal(&accessLogEntry{
+			Id:             ctx.Id,
+			RemoteAddr:     r.RemoteAddr,
+			Method:         r.Method,
+			Uri:            r.RequestURI,
+			Proto:          r.Proto,
+			Status:         w.(ResponseWriter).Status(),
+			Length:         w.(ResponseWriter).ContentLength(),
+			ResponseTimeMs: float64(ctx.ResponseTime) / float64(time.Millisecond),
+		})
+		app.AccessLogger(LogLevelInfo, string(data))
+		return
+	}
 	data := map[string]interface{}{
-		"c":   RequestContext(r),
+		"c":   ctx,
 		"res": w,
 		"req": r,
 	}
@@ -569,12 +1861,28 @@ func (app *App) writeAccessLog(w http.ResponseWriter, r *http.Request, d interfa
 
 //
 func (app *App) Setup() {
+	// App.Hooks may have been replaced after NewApp.
+	app.Hooks.makeConcurrent()
+	for _, source := range app.Config.MethodOverwriteSources {
+		if !methodOverwriteSources[source] {
+			panic(fmt.Sprintf("Unknown method overwrite source: '%v'", source))
+		}
+	}
 	if app.Renderer == nil {
 		cfg := DefaultHtmlTemplateRendererConfig()
 		cfg.TemplateDirectory = app.Config.TemplateDirectory
-		app.Renderer = NewHtmlTemplateRenderer(cfg)
+		cfg.Reload = app.Config.Debug
+		renderer := NewHtmlTemplateRenderer(cfg)
+		if app.Config.Debug {
+			renderer.SetJsonIndent("  ")
+		}
+		app.Renderer = renderer
+	}
+	// access logs of mounted Apps are written by the parent App.
+	if app.mountParent == nil {
+		app.AccessLogHookId = app.Hooks.Add("end_request", app.writeAccessLog)
 	}
-	app.Hooks.Add("end_request", app.writeAccessLog)
+	app.parseTrustedProxies()
 	app.Hooks.Run("setup", HookDirectionNormal, nil, nil, app)
 	if app.Config.AutoMaxProcs {
 		runtime.GOMAXPROCS(runtime.NumCPU())
@@ -585,6 +1893,11 @@ func (app *App) Setup() {
 		panic(err)
 	}
 	app.accessLogTemplate = tmpl
+	for _, sub := range app.mounts {
+		if sub.accessLogTemplate == nil {
+			sub.Setup()
+		}
+	}
 }
 
 // Returns a new http.Server object.
@@ -597,23 +1910,200 @@ func (app *App) Server() *http.Server {
 		MaxHeaderBytes: app.Config.MaxHeaderBytes,
 	}
 	server.SetKeepAlivesEnabled(app.Config.KeepAlive)
+	if app.Config.IsTLS() {
+		version, ok := tlsVersions[app.Config.MinTLSVersion]
+		if !ok {
+			panic(fmt.Sprintf("Unknown TLS version: '%v'", app.Config.MinTLSVersion))
+		}
+		server.TLSConfig = &tls.Config{MinVersion: version}
+		clientAuth := app.Config.ClientAuth
+		if len(clientAuth) == 0 {
+			clientAuth = "none"
+			if len(app.Config.ClientCAFile) != 0 {
+				clientAuth = "require_and_verify"
+			}
+		}
+		authType, ok := clientAuthTypes[clientAuth]
+		if !ok {
+			panic(fmt.Sprintf("Unknown client auth type: '%v'", app.Config.ClientAuth))
+		}
+		server.TLSConfig.ClientAuth = authType
+		if len(app.Config.ClientCAFile) != 0 {
+			data, err := os.ReadFile(app.Config.ClientCAFile)
+			if err != nil {
+				panic(err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				panic(fmt.Sprintf("No certificates found in '%v'", app.Config.ClientCAFile))
+			}
+			server.TLSConfig.ClientCAs = pool
+		}
+	}
+	if app.Config.EnableH2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
 	return server
 }
 
 // Run the http.Server. If _server is not passed, App.Server() will be used as a http.Server object.
-func (app *App) Run(_server ...*http.Server) {
+// Run serves HTTPS if AppConfig.CertFile and AppConfig.KeyFile are set.
+// Run listens on a unix domain socket if AppConfig.Addr starts with "unix:". A stale socket file
+// will be removed before listening and the socket file will be removed after the server stopped.
+// Run returns nil if the server is stopped by App.Shutdown, otherwise returns an error that occurred while
+// listening or serving.
+func (app *App) Run(_server ...*http.Server) error {
+	server := app.serverOf(_server)
+	if path, ok := app.Config.UnixSocketPath(); ok {
+		return app.runUnixSocket(path, server)
+	}
+	addr := server.Addr
+	if len(addr) == 0 {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return app.RunListener(l, server)
+}
+
+func (app *App) runUnixSocket(path string, server *http.Server) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return errors.New(fmt.Sprintf("%v exists and is not a socket", path))
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if app.Config.SocketMode != 0 {
+		if err := os.Chmod(path, app.Config.SocketMode); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	return app.RunListener(l, server)
+}
+
+// Run the http.Server with the given net.Listener. If _server is not passed,
+// App.Server() will be used as a http.Server object.
+// RunListener returns nil if the server is stopped by App.Shutdown, or by Shutdown or Close
+// of the given http.Server, otherwise returns an error that occurred while serving.
+func (app *App) RunListener(l net.Listener, _server ...*http.Server) error {
+	server := app.serverOf(_server)
 	if app.accessLogTemplate == nil {
 		app.Setup()
 	}
-	var server *http.Server
-	if len(_server) > 0 {
-		server = _server[0]
-	} else {
-		server = app.Server()
+	baseContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if server.BaseContext == nil {
+		server.BaseContext = func(net.Listener) context.Context { return baseContext }
 	}
+	app.serverMutex.Lock()
+	app.server = server
+	done := make(chan bool)
+	app.shutdownDone = done
+	app.cancelRequests = cancel
+	app.serverMutex.Unlock()
+	atomic.StoreInt32(&app.draining, 0)
+	if app.Config.GracefulShutdown {
+		stop := app.handleSignals()
+		defer stop()
+	}
+
 	app.Hooks.Run("start_server", HookDirectionNormal, nil, nil, app)
-	app.Logger(LogLevelInfo, fmt.Sprintf("Server started: addr=%v", app.Config.Addr))
-	server.ListenAndServe()
+	app.log(LogLevelInfo, fmt.Sprintf("Server started: addr=%v", l.Addr()))
+	var err error
+	if app.Config.IsTLS() {
+		err = server.ServeTLS(l, app.Config.CertFile, app.Config.KeyFile)
+	} else {
+		err = server.Serve(l)
+	}
+	app.serverMutex.Lock()
+	// App.Shutdown clears app.server before it stops the server.
+	stoppedByApp := err == http.ErrServerClosed && app.server != server
+	if !stoppedByApp {
+		app.server = nil
+	}
+	app.serverMutex.Unlock()
+	if stoppedByApp {
+		// waits for App.Shutdown that runs `stop_server` hooks.
+		<-done
+		return nil
+	}
+	app.Hooks.Run("stop_server", HookDirectionReverse, nil, nil, app)
+	if err == http.ErrServerClosed {
+		// the server is stopped by http.Server.Shutdown or http.Server.Close.
+		return nil
+	}
+	return err
+}
+
+func (app *App) serverOf(servers []*http.Server) *http.Server {
+	if len(servers) > 0 {
+		return servers[0]
+	}
+	return app.Server()
+}
+
+// Shutdowns the running server gracefully. Shutdown waits for in-flight requests
+// until the given context is done, then runs `stop_server` hooks.
+// Contexts of requests that are still running are canceled when the given context is done.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.serverMutex.Lock()
+	server, done, cancel := app.server, app.shutdownDone, app.cancelRequests
+	app.server = nil
+	app.serverMutex.Unlock()
+	if server == nil {
+		return errors.New("Server is not running.")
+	}
+	atomic.StoreInt32(&app.draining, 1)
+	err := server.Shutdown(ctx)
+	if err != nil {
+		// cancels contexts of requests that are still running
+		cancel()
+	}
+	app.Hooks.Run("stop_server", HookDirectionReverse, nil, nil, app)
+	app.log(LogLevelInfo, "Server stopped")
+	close(done)
+	return err
+}
+
+// Returns true if the server is shutting down and waiting for in-flight requests.
+// Responses written while draining have a `Connection: close` header.
+func (app *App) IsDraining() bool {
+	return atomic.LoadInt32(&app.draining) == 1
+}
+
+func (app *App) handleSignals() func() {
+	ch := make(chan os.Signal, 1)
+	quit := make(chan bool)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			app.log(LogLevelInfo, fmt.Sprintf("Signal received: %v", sig))
+			ctx, cancel := context.WithTimeout(context.Background(), app.Config.GracefulTimeout)
+			defer cancel()
+			if err := app.Shutdown(ctx); err != nil {
+				app.log(LogLevelError, fmt.Sprintf("Failed to shutdown the server: %v", err))
+			}
+		case <-quit:
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(quit)
+	}
 }
 
 /* }}} */
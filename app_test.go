@@ -1,12 +1,32 @@
 package cidre
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestAppAction(t *testing.T) {
@@ -68,21 +88,48 @@ func TestAppPanic(t *testing.T) {
 	writer = httptest.NewRecorder()
 	app.Config.Debug = true
 	app.ServeHTTP(writer, req)
-	stackTopLine := strings.Split(writer.Body.String(), "\n")[2]
-	if m, _ := regexp.MatchString(`^.*\.go:(\d+) \([a-z0-9]+\)$`, stackTopLine); !m {
+	if m, _ := regexp.MatchString(`(?m)^.*\.go:(\d+) (\([a-z0-9]+\)|\+0x[0-9a-f]+)$`, writer.Body.String()); !m {
 		t.Error("DefaultOnPanic should print stack trace.")
 	}
 
-	app.OnPanic = func(w http.ResponseWriter, r *http.Request, recv interface{}) {
+	app.OnPanic = PanicHandlerOf(func(w http.ResponseWriter, r *http.Request, recv interface{}) {
 		w.WriteHeader(500)
 		fmt.Fprint(w, "Oops!")
-	}
+	})
 	req, _ = http.NewRequest("GET", "/page1", nil)
 	writer = httptest.NewRecorder()
 	app.ServeHTTP(writer, req)
 	errorIfNotEqual(t, "Oops!", writer.Body.String())
 }
 
+func TestAppPanicInfo(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		panic("panic!")
+	})
+	var info *PanicInfo
+	var id string
+	app.OnPanic = func(w http.ResponseWriter, r *http.Request, i *PanicInfo) {
+		info = i
+		id = RequestContext(r).Id
+		w.WriteHeader(500)
+	}
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 500, writer.Code)
+	errorIfNotEqual(t, "panic!", info.Recovered)
+	errorIfNotEqual(t, "page1", info.RouteName)
+	errorIfNotEqual(t, id, info.ContextId)
+	if len(info.Stack) == 0 {
+		t.Error("PanicInfo.Stack should not be empty")
+	}
+	if info.Elapsed <= 0 {
+		t.Error("PanicInfo.Elapsed should be greater than 0")
+	}
+}
+
 func TestAppHttpMethodOverwrite(t *testing.T){
 	app := NewApp(DefaultAppConfig())
 	root := app.MountPoint("/")
@@ -96,6 +143,66 @@ func TestAppHttpMethodOverwrite(t *testing.T){
     errorIfNotEqual(t, "ok", writer.Body.String())
 }
 
+func TestAppHttpMethodOverwriteSources(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	for _, method := range []string{"POST", "PUT", "DELETE", "PATCH"} {
+		method := method
+		root.Route(strings.ToLower(method), "p1", method, false, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, method)
+		})
+	}
+	root.Get("get", "p1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "GET")
+	})
+	serve := func(method, target, body, override string) string {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(override) != 0 {
+			req.Header.Set("X-HTTP-Method-Override", override)
+		}
+		writer := httptest.NewRecorder()
+		app.ServeHTTP(writer, req)
+		return writer.Body.String()
+	}
+
+	errorIfNotEqual(t, "PUT", serve("POST", "/p1", "", "PUT"))
+	errorIfNotEqual(t, "DELETE", serve("POST", "/p1?_method=DELETE", "", ""))
+	errorIfNotEqual(t, "PATCH", serve("POST", "/p1", "_method=PATCH", ""))
+	// default precedence: header, form, query
+	errorIfNotEqual(t, "PUT", serve("POST", "/p1?_method=DELETE", "_method=PATCH", "PUT"))
+	errorIfNotEqual(t, "PATCH", serve("POST", "/p1?_method=DELETE", "_method=PATCH", ""))
+	// only POST requests are overwritten
+	errorIfNotEqual(t, "GET", serve("GET", "/p1?_method=DELETE", "", "PUT"))
+
+	app.Config.MethodOverwriteSources = []string{"query", "header"}
+	errorIfNotEqual(t, "DELETE", serve("POST", "/p1?_method=DELETE", "", "PUT"))
+	errorIfNotEqual(t, "POST", serve("POST", "/p1", "_method=PATCH", ""))
+
+	app.Config.AllowHttpMethodOverwrite = false
+	errorIfNotEqual(t, "POST", serve("POST", "/p1?_method=DELETE", "", "PUT"))
+
+	// JSON bodies are not consumed by the form source
+	app.Config.AllowHttpMethodOverwrite = true
+	app.Config.MethodOverwriteSources = []string{"form"}
+	app.MountPoint("/").Post("json", "json", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	req := httptest.NewRequest("POST", "/json", strings.NewReader(`{"_method":"PUT"}`))
+	req.Header.Set("Content-Type", "application/json")
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, `{"_method":"PUT"}`, writer.Body.String())
+
+	app.Config.MethodOverwriteSources = []string{"form", "cookie"}
+	defer func() {
+		errorIfNotEqual(t, "Unknown method overwrite source: 'cookie'", recover())
+	}()
+	app.Setup()
+}
+
 func TestAppBuildUrl(t *testing.T) {
 	app := NewApp(DefaultAppConfig())
 	root := app.MountPoint("/")
@@ -107,6 +214,26 @@ func TestAppBuildUrl(t *testing.T) {
 	errorIfNotEqual(t, app.BuildUrl("p1", "aaa", "bbb"), "/p1/aaa/bbb")
 }
 
+func TestContextAbsoluteUrl(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.TrustedProxies = []string{"10.0.0.1"}
+	}))
+	app.MountPoint("/").Get("page", "pages/(?P<id>[^/]+)", func(w http.ResponseWriter, r *http.Request) {})
+	req := httptest.NewRequest("GET", "http://www.example.com:8080/", nil)
+	ctx := NewContext(app, "id", req)
+	errorIfNotEqual(t, "http://www.example.com:8080/pages/1", ctx.AbsoluteUrl(req, "page", "1"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	errorIfNotEqual(t, "https://www.example.com:8080/pages/1", ctx.AbsoluteUrl(req, "page", "1"))
+
+	// the scheme and the host are taken from the same request
+	other := httptest.NewRequest("GET", "http://other.example.com/", nil)
+	errorIfNotEqual(t, "http://other.example.com/pages/1", ctx.AbsoluteUrl(other, "page", "1"))
+
+	app.Config.ExternalBaseUrl = "https://public.example.com/app/"
+	errorIfNotEqual(t, "https://public.example.com/app/pages/1", ctx.AbsoluteUrl(req, "page", "1"))
+}
+
 func TestAppMiddleware(t *testing.T) {
 	testMd1 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("md1-1"))
@@ -177,3 +304,1418 @@ func TestResponseWriterHooks(t *testing.T) {
 	app.ServeHTTP(writer, req)
 	errorIfNotEqual(t, "1234", result)
 }
+
+func TestContextClientCertificate(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RequestContext(r).ClientCertCN())
+	})
+
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "", writer.Body.String())
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client1"}}
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "", writer.Body.String())
+
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "client1", writer.Body.String())
+}
+
+func TestAppStaticWithConfig(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	dir := filepath.Join(filepath.Dir(file), "_testdata")
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.StaticWithConfig("statics", "statics", dir, DefaultStaticConfig(func(c *StaticConfig) {
+		c.MaxAge = time.Hour
+		c.Immutable = true
+		c.DisableDirectoryListing = true
+	}))
+
+	req, _ := http.NewRequest("GET", "/statics/page2.tpl", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 200, writer.Code)
+	errorIfNotEqual(t, "public, max-age=3600, immutable", writer.Header().Get("Cache-Control"))
+	lastModified := writer.Header().Get("Last-Modified")
+	if len(lastModified) == 0 {
+		t.Error("Last-Modified header should be set")
+	}
+
+	req, _ = http.NewRequest("GET", "/statics/page2.tpl", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 304, writer.Code)
+	errorIfNotEqual(t, "public, max-age=3600, immutable", writer.Header().Get("Cache-Control"))
+
+	req, _ = http.NewRequest("GET", "/statics/", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 404, writer.Code)
+	errorIfNotEqual(t, "", writer.Header().Get("Cache-Control"))
+}
+
+func TestAppStaticETag(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.js")
+	os.WriteFile(file, []byte("app()"), 0644)
+	os.Chtimes(file, time.Unix(1000, 0), time.Unix(1000, 0))
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.StaticWithConfig("statics", "statics", dir, DefaultStaticConfig(func(c *StaticConfig) {
+		c.MaxAge = 24 * time.Hour
+		c.ETag = true
+	}))
+
+	req, _ := http.NewRequest("GET", "/statics/app.js", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 200, writer.Code)
+	errorIfNotEqual(t, "public, max-age=86400", writer.Header().Get("Cache-Control"))
+	etag := writer.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatal("ETag header should be set")
+	}
+
+	req, _ = http.NewRequest("GET", "/statics/app.js", nil)
+	req.Header.Set("If-None-Match", etag)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 304, writer.Code)
+	errorIfNotEqual(t, 0, writer.Body.Len())
+	errorIfNotEqual(t, "public, max-age=86400", writer.Header().Get("Cache-Control"))
+
+	os.WriteFile(file, []byte("app2()"), 0644)
+	os.Chtimes(file, time.Unix(2000, 0), time.Unix(2000, 0))
+	req, _ = http.NewRequest("GET", "/statics/app.js", nil)
+	req.Header.Set("If-None-Match", etag)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 200, writer.Code)
+	errorIfNotEqual(t, "app2()", writer.Body.String())
+	if writer.Header().Get("ETag") == etag {
+		t.Error("ETag should be changed")
+	}
+}
+
+func TestAppMiddlewareStack(t *testing.T) {
+	newMd := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+			RequestContext(r).MiddlewareChain.DoNext(w, r)
+		}
+	}
+	stack := NewMiddlewareStack(newMd("md1"), newMd("md2"))
+	app := NewApp(DefaultAppConfig())
+	p1 := app.MountPoint("/p1")
+	p1.UseStack(stack)
+	p1.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {})
+	p2 := app.MountPoint("/p2")
+	p2.UseStack(stack.Prepend(newMd("md0")).Append(newMd("md3")))
+	p2.Get("page2", "page2", func(w http.ResponseWriter, r *http.Request) {})
+
+	req, _ := http.NewRequest("GET", "/p1/page1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "md1md2", writer.Body.String())
+
+	req, _ = http.NewRequest("GET", "/p2/page2", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "md0md1md2md3", writer.Body.String())
+	errorIfNotEqual(t, 2, len(stack.Middlewares()))
+}
+
+func TestAppStaticFallback(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	dir := filepath.Join(filepath.Dir(file), "_testdata", "spa")
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.StaticWithConfig("app", "app", dir, DefaultStaticConfig(func(c *StaticConfig) {
+		c.SPAFallback = "index.html"
+	}))
+
+	for _, path := range []string{"/app/some/route", "/app/users/42"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		writer := httptest.NewRecorder()
+		app.ServeHTTP(writer, req)
+		errorIfNotEqual(t, 200, writer.Code)
+		errorIfNotEqual(t, "<html>SPA</html>\n", writer.Body.String())
+	}
+
+	req, _ := http.NewRequest("GET", "/app/users/42", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "text/html; charset=UTF-8", writer.Header().Get("Content-Type"))
+
+	req, _ = http.NewRequest("GET", "/app/missing.js", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 404, writer.Code)
+}
+
+func TestAppAccessLogSlowThreshold(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AccessLogSlowThreshold = 20 * time.Millisecond
+		c.AccessLogFormat = "{{.req.URL.Path}} {{.res.Status}}"
+	}))
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs = append(logs, message)
+	}
+	root := app.MountPoint("/")
+	root.Get("fast", "fast", func(w http.ResponseWriter, r *http.Request) {})
+	root.Get("slow", "slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	})
+	root.Get("error", "error", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	})
+	app.Setup()
+
+	for _, path := range []string{"/fast", "/slow", "/error", "/notfound"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		app.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	errorIfNotEqual(t, "/slow 0,/error 500,/notfound 404", strings.Join(logs, ","))
+}
+
+func TestAppAccessLogJson(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AccessLogJson = true
+	}))
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs = append(logs, message)
+	}
+	app.MountPoint("/").Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345"))
+	})
+	app.Setup()
+	req, _ := http.NewRequest("GET", "/page1?a=b", nil)
+	req.RequestURI = "/page1?a=b"
+	req.RemoteAddr = "127.0.0.1:12345"
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	errorIfNotEqual(t, 1, len(logs))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(logs[0]), &entry); err != nil {
+		t.Fatalf("access log should be a JSON object, but got '%v'", logs[0])
+	}
+	errorIfNotEqual(t, 8, len(entry))
+	errorIfNotEqual(t, true, len(entry["id"].(string)) != 0)
+	errorIfNotEqual(t, "127.0.0.1:12345", entry["remote_addr"])
+	errorIfNotEqual(t, "GET", entry["method"])
+	errorIfNotEqual(t, "/page1?a=b", entry["uri"])
+	errorIfNotEqual(t, "HTTP/1.1", entry["proto"])
+	errorIfNotEqual(t, float64(200), entry["status"])
+	errorIfNotEqual(t, float64(5), entry["length"])
+	_, ok := entry["response_time_ms"].(float64)
+	errorIfNotEqual(t, true, ok)
+}
+
+func TestAppAccessLogSkip(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AccessLogFormat = "{{.req.URL.Path}}"
+		c.AccessLogSkip = []string{"/healthz", "/api/*/ping"}
+		c.AccessLogSkipStatic = true
+	}))
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs = append(logs, message)
+	}
+	root := app.MountPoint("/")
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	root.Get("healthz", "healthz", handler)
+	root.Get("ping", "api/(?P<version>[^/]+)/ping", handler)
+	root.Get("page1", "page1", handler)
+	root.Get("healthzcheck", "healthzcheck", handler)
+	root.StaticFS("statics", "assets", fstest.MapFS{
+		"style.css": &fstest.MapFile{Data: []byte("body{}")},
+	})
+	app.Setup()
+
+	for _, path := range []string{"/healthz", "/api/v1/ping", "/assets/style.css", "/page1", "/api/v1/ping/more", "/healthz/live", "/healthzcheck"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		app.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	errorIfNotEqual(t, "/page1,/api/v1/ping/more,/healthzcheck", strings.Join(logs, ","))
+}
+
+func TestAppStaticFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"css/style.css": &fstest.MapFile{Data: []byte("body{}")},
+	}
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.StaticFS("statics", "statics", fsys)
+
+	req, _ := http.NewRequest("GET", "/statics/css/style.css", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 200, writer.Code)
+	errorIfNotEqual(t, "body{}", writer.Body.String())
+	errorIfNotEqual(t, "text/css; charset=utf-8", writer.Header().Get("Content-Type"))
+
+	req, _ = http.NewRequest("GET", "/statics/css/missing.css", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 404, writer.Code)
+}
+
+type testLowerFileSystem struct {
+	fs http.FileSystem
+}
+
+func (ufs testLowerFileSystem) Open(name string) (http.File, error) {
+	return ufs.fs.Open(strings.ToLower(name))
+}
+
+func TestAppStaticFileSystem(t *testing.T) {
+	fsys := fstest.MapFS{
+		"js/app.js": &fstest.MapFile{Data: []byte("app()")},
+	}
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/assets/")
+	root.StaticFileSystem("statics", "statics", testLowerFileSystem{http.FS(fsys)})
+
+	req, _ := http.NewRequest("GET", "/assets/statics/JS/APP.js", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 200, writer.Code)
+	errorIfNotEqual(t, "app()", writer.Body.String())
+
+	req, _ = http.NewRequest("GET", "/assets/statics/js/missing.js", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, 404, writer.Code)
+}
+
+func TestAppStaticRange(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	dir := filepath.Join(filepath.Dir(file), "_testdata", "statics")
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AccessLogFormat = "{{.res.Status}} {{.res.ContentLength}}"
+	}))
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs = append(logs, message)
+	}
+	app.Use(NewEtagMiddleware(DefaultEtagConfig()))
+	root := app.MountPoint("/")
+	root.Static("statics", "statics", dir)
+	contentLength := 0
+	root.Get("download", "download", func(w http.ResponseWriter, r *http.Request) {
+		ServeFile(w, r, filepath.Join(dir, "range.txt"))
+		contentLength = w.(ResponseWriter).ContentLength()
+	})
+	app.Setup()
+
+	for _, path := range []string{"/statics/range.txt", "/download"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Range", "bytes=0-99")
+		writer := httptest.NewRecorder()
+		app.ServeHTTP(writer, req)
+		errorIfNotEqual(t, 206, writer.Code)
+		errorIfNotEqual(t, 100, writer.Body.Len())
+		errorIfNotEqual(t, "bytes 0-99/1000", writer.Header().Get("Content-Range"))
+	}
+	errorIfNotEqual(t, 100, contentLength)
+	errorIfNotEqual(t, "206 100,206 100", strings.Join(logs, ","))
+}
+
+func freeTestAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitTestServer(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+}
+
+func TestAppShutdown(t *testing.T) {
+	addr := freeTestAddr(t)
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.Addr = addr
+		c.AutoMaxProcs = false
+	}))
+	app.Logger = func(LogLevel, string) {}
+	app.AccessLogger = func(LogLevel, string) {}
+	stopped := false
+	app.Hooks.Add("stop_server", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		stopped = true
+	})
+	root := app.MountPoint("/")
+	root.Get("slow", "slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	})
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.Run() }()
+	waitTestServer(t, addr)
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	errorIfNotEqual(t, nil, app.Shutdown(context.Background()))
+	errorIfNotEqual(t, "done", <-body)
+	errorIfNotEqual(t, nil, <-runErr)
+	errorIfNotEqual(t, true, stopped)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("listener should be closed")
+	}
+	if err := app.Shutdown(context.Background()); err == nil {
+		t.Error("Shutdown should return an error if the server is not running")
+	}
+}
+
+func TestAppRunListenerServerShutdown(t *testing.T) {
+	for _, closeServer := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+			c.AutoMaxProcs = false
+		}))
+		app.Logger = func(LogLevel, string) {}
+		app.AccessLogger = func(LogLevel, string) {}
+		stopped := false
+		app.Hooks.Add("stop_server", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+			stopped = true
+		})
+		server := app.Server()
+
+		runErr := make(chan error, 1)
+		go func() { runErr <- app.RunListener(l, server) }()
+		waitTestServer(t, l.Addr().String())
+
+		if closeServer {
+			errorIfNotEqual(t, nil, server.Close())
+		} else {
+			errorIfNotEqual(t, nil, server.Shutdown(context.Background()))
+		}
+		select {
+		case err := <-runErr:
+			errorIfNotEqual(t, nil, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("RunListener should return when the http.Server is stopped")
+		}
+		errorIfNotEqual(t, true, stopped)
+		if err := app.Shutdown(context.Background()); err == nil {
+			t.Error("Shutdown should return an error if the server is not running")
+		}
+	}
+}
+
+func TestServeFileWithChecksum(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	path := filepath.Join(filepath.Dir(file), "_testdata", "statics", "range.txt")
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Get("download", "download", func(w http.ResponseWriter, r *http.Request) {
+		ServeFileWithChecksum(w, r, path)
+	})
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	expected, _ := os.ReadFile(path)
+	errorIfNotEqual(t, string(expected), string(body))
+	errorIfNotEqual(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, fmt.Sprintf("%x", sha256.Sum256(expected)), res.Trailer.Get(ChecksumTrailer))
+}
+
+func TestAppRunListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+	}))
+	app.Logger = func(LogLevel, string) {}
+	app.AccessLogger = func(LogLevel, string) {}
+	started := false
+	app.Hooks.Add("start_server", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		started = true
+	})
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.RunListener(l) }()
+	addr := l.Addr().String()
+	waitTestServer(t, addr)
+
+	res, err := http.Get("http://" + addr + "/page1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	errorIfNotEqual(t, "ok", string(body))
+
+	// bind failure
+	app2 := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.Addr = addr
+		c.AutoMaxProcs = false
+	}))
+	app2.Logger = func(LogLevel, string) {}
+	if err := app2.Run(); err == nil {
+		t.Error("Run should return an error if the address is already in use")
+	}
+
+	errorIfNotEqual(t, nil, app.Shutdown(context.Background()))
+	errorIfNotEqual(t, nil, <-runErr)
+	errorIfNotEqual(t, true, started)
+}
+
+func TestAppDraining(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.KeepAlive = true
+	}))
+	app.Logger = func(LogLevel, string) {}
+	app.AccessLogger = func(LogLevel, string) {}
+	release := make(chan bool)
+	root := app.MountPoint("/")
+	root.Get("slow", "slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "done")
+	})
+	root.Get("fast", "fast", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "done")
+	})
+	app.Setup()
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.RunListener(l) }()
+	addr := l.Addr().String()
+	waitTestServer(t, addr)
+
+	req, _ := http.NewRequest("GET", "/fast", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "", writer.Header().Get("Connection"))
+
+	closed := make(chan bool, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			closed <- false
+			return
+		}
+		res.Body.Close()
+		closed <- res.Close
+	}()
+	time.Sleep(50 * time.Millisecond)
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- app.Shutdown(context.Background()) }()
+	for !app.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	req, _ = http.NewRequest("GET", "/fast", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "close", writer.Header().Get("Connection"))
+
+	close(release)
+	errorIfNotEqual(t, true, <-closed)
+	errorIfNotEqual(t, nil, <-shutdownErr)
+	errorIfNotEqual(t, nil, <-runErr)
+}
+
+func writeTestCertificate(t *testing.T) (string, string) {
+	return writeTestCertificateFor(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+}
+
+func writeTestCertificateFor(t *testing.T, cn string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestAppRunTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.CertFile = certFile
+		c.KeyFile = keyFile
+		c.MinTLSVersion = "1.3"
+	}))
+	app.Logger = func(LogLevel, string) {}
+	app.AccessLogger = func(LogLevel, string) {}
+	app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), nil))
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("tls", r.TLS != nil)
+		fmt.Fprint(w, r.TLS != nil)
+	})
+	errorIfNotEqual(t, uint16(tls.VersionTLS13), app.Server().TLSConfig.MinVersion)
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.RunListener(l) }()
+	addr := l.Addr().String()
+	waitTestServer(t, addr)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := client.Get("https://" + addr + "/page1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	errorIfNotEqual(t, "true", string(body))
+	errorIfNotEqual(t, uint16(tls.VersionTLS13), res.TLS.Version)
+	errorIfNotEqual(t, true, res.Cookies()[0].Secure)
+
+	errorIfNotEqual(t, nil, app.Shutdown(context.Background()))
+	errorIfNotEqual(t, nil, <-runErr)
+}
+
+func TestAppRunMutualTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	clientCertFile, clientKeyFile := writeTestCertificateFor(t, "client1", x509.ExtKeyUsageClientAuth)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.CertFile = certFile
+		c.KeyFile = keyFile
+		c.ClientCAFile = clientCertFile
+	}))
+	app.Logger = func(LogLevel, string) {}
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RequestContext(r).ClientCertCN())
+	})
+	errorIfNotEqual(t, tls.RequireAndVerifyClientCert, app.Server().TLSConfig.ClientAuth)
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.RunListener(l) }()
+	addr := l.Addr().String()
+	waitTestServer(t, addr)
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}},
+	}}
+	res, err := client.Get("https://" + addr + "/page1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	errorIfNotEqual(t, "client1", string(body))
+
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	if res, err := anonymous.Get("https://" + addr + "/page1"); err == nil {
+		res.Body.Close()
+		t.Error("requests without client certificates should be rejected")
+	}
+
+	errorIfNotEqual(t, nil, app.Shutdown(context.Background()))
+	errorIfNotEqual(t, nil, <-runErr)
+
+	func() {
+		defer func() {
+			errorIfNotEqual(t, "Unknown client auth type: 'optional'", recover())
+		}()
+		app.Config.ClientAuth = "optional"
+		app.Server()
+	}()
+}
+
+func TestAppUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	// stale socket file
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.Addr = "unix:" + path
+		c.SocketMode = 0600
+		c.AutoMaxProcs = false
+	}))
+	app.Logger = func(LogLevel, string) {}
+	var logs []string
+	var logsMutex sync.Mutex
+	app.AccessLogger = func(level LogLevel, message string) {
+		logsMutex.Lock()
+		defer logsMutex.Unlock()
+		logs = append(logs, message)
+	}
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.Run() }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		if res, err = client.Get("http://unix/page1"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	errorIfNotEqual(t, "ok", string(body))
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, os.FileMode(0600), fi.Mode().Perm())
+
+	errorIfNotEqual(t, nil, app.Shutdown(context.Background()))
+	errorIfNotEqual(t, nil, <-runErr)
+	logsMutex.Lock()
+	errorIfNotEqual(t, 1, len(logs))
+	logsMutex.Unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket file should be removed after the server stopped")
+	}
+}
+
+func TestAppUnixSocketNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	os.WriteFile(path, []byte("data"), 0644)
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.Addr = "unix:" + path
+		c.AutoMaxProcs = false
+	}))
+	app.Logger = func(LogLevel, string) {}
+	if err := app.Run(); err == nil {
+		t.Error("Run should return an error if the file is not a socket")
+	}
+}
+
+func TestAppH2C(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.EnableH2C = true
+		c.AutoMaxProcs = false
+		c.AccessLogFormat = "{{.req.Proto}} {{.res.Status}}"
+	}))
+	app.Logger = func(LogLevel, string) {}
+	logs := make(chan string, 1)
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs <- message
+	}
+	status := make(chan int, 1)
+	app.Hooks.Add("end_request", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		status <- w.(ResponseWriter).Status()
+	})
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, r.Proto)
+	})
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.RunListener(l) }()
+	addr := l.Addr().String()
+	waitTestServer(t, addr)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	res, err := (&http.Client{Transport: transport}).Get("http://" + addr + "/page1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	errorIfNotEqual(t, "HTTP/2.0", string(body))
+	errorIfNotEqual(t, http.StatusCreated, res.StatusCode)
+	errorIfNotEqual(t, http.StatusCreated, <-status)
+	errorIfNotEqual(t, "HTTP/2.0 201", <-logs)
+
+	errorIfNotEqual(t, nil, app.Shutdown(context.Background()))
+	errorIfNotEqual(t, nil, <-runErr)
+}
+
+func TestAppRequestStdContext(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.Get("slow", "slow", func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		errorIfNotEqual(t, ctx, r.Context().Value(contextKey{}))
+		errorIfNotEqual(t, r, ctx.Request)
+		if _, ok := ctx.StdContext().Deadline(); !ok {
+			t.Error("deadline should be set")
+		}
+		<-r.Context().Done()
+		http.Error(w, r.Context().Err().Error(), http.StatusGatewayTimeout)
+	}, NewTimeoutMiddleware(10*time.Millisecond))
+
+	req, _ := http.NewRequest("GET", "/slow", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, http.StatusGatewayTimeout, writer)
+	AssertBodyContains(t, context.DeadlineExceeded.Error(), writer)
+}
+
+type testContextKey struct{}
+
+func TestContextWithValue(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	var original *http.Request
+	root := app.MountPoint("/")
+	root.Use(func(w http.ResponseWriter, r *http.Request) {
+		original = r
+		ctx := RequestContext(r)
+		r = ctx.WithValue(testContextKey{}, "typed")
+		r = ctx.WithValue("user", "alice")
+		ctx.MiddlewareChain.DoNext(w, r)
+	})
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		errorIfNotEqual(t, ctx, RequestContext(original))
+		errorIfNotEqual(t, r, ctx.Request)
+		errorIfNotEqual(t, "typed", r.Context().Value(testContextKey{}))
+		errorIfNotEqual(t, "alice", r.Context().Value("user"))
+		errorIfNotEqual(t, "alice", ctx.Get("user"))
+		errorIfNotEqual(t, nil, original.Context().Value(testContextKey{}))
+		errorIfNotEqual(t, "typed", FromRequestContext(original, testContextKey{}))
+		errorIfNotEqual(t, "typed", FromRequestContext(r, testContextKey{}))
+		errorIfNotEqual(t, nil, FromRequestContext(r, "unknown"))
+		fmt.Fprint(w, "ok")
+	})
+	res := NewTestClient(app).Get("/page1")
+	errorIfNotEqual(t, "ok", res.String())
+}
+
+func TestAppRequestCanceled(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	stdctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	root := app.MountPoint("/")
+	root.Get("slow", "slow", func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		errorIfNotEqual(t, r.Context(), ctx.Context())
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("deadline should not be set")
+		}
+		errorIfNotEqual(t, nil, ctx.Err())
+		// the client disconnects
+		cancel()
+		select {
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+		case <-time.After(time.Second):
+			canceled <- nil
+		}
+	})
+	req, _ := http.NewRequestWithContext(stdctx, "GET", "/slow", nil)
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	errorIfNotEqual(t, context.Canceled, <-canceled)
+}
+
+func TestAppShutdownCancelsRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+	}))
+	app.Logger = func(LogLevel, string) {}
+	app.AccessLogger = func(LogLevel, string) {}
+	started := make(chan bool)
+	canceled := make(chan bool, 1)
+	root := app.MountPoint("/")
+	root.Get("slow", "slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		canceled <- true
+	})
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.RunListener(l) }()
+	addr := l.Addr().String()
+	waitTestServer(t, addr)
+	go http.Get("http://" + addr + "/slow")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errorIfNotEqual(t, context.DeadlineExceeded, app.Shutdown(ctx))
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("request context should be canceled")
+	}
+	errorIfNotEqual(t, nil, <-runErr)
+}
+
+func TestAppRequestContextReplacedBody(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	root := app.MountPoint("/")
+	root.Post("page", "page/(?P<id>\\d+)", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			t.Error("body should be limited")
+		}
+		fmt.Fprintf(w, "%v %v", RequestContext(r).PathParams.Get("id"), string(body))
+	}, func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 3)
+		RequestContext(r).MiddlewareChain.DoNext(w, r)
+	})
+	req, _ := http.NewRequest("POST", "/page/10", strings.NewReader("12345"))
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, http.StatusOK, writer)
+	errorIfNotEqual(t, "10 123", writer.Body.String())
+
+	func() {
+		defer func() {
+			if recv := recover(); recv == nil || !strings.Contains(fmt.Sprint(recv), "App.ServeHTTP") {
+				t.Errorf("should cause panic with a clear message, but got %v", recv)
+			}
+		}()
+		req, _ := http.NewRequest("GET", "/page/10", nil)
+		RequestContext(req)
+	}()
+}
+
+func TestAppReuseContexts(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.ReuseContexts = true
+	}))
+	var detached *Context
+	root := app.MountPoint("/")
+	root.Get("page", "page/(?P<id>\\d+)", func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		if ctx.Has("key") {
+			t.Error("values of previous requests should not be visible")
+		}
+		errorIfNotEqual(t, 1, len(*ctx.PathParams))
+		ctx.Set("key", ctx.PathParams.Get("id"))
+		if ctx.PathParams.Get("id") == "1" {
+			ctx.Detach()
+			detached = ctx
+		}
+		fmt.Fprint(w, ctx.GetString("key"))
+	})
+	for _, id := range []string{"1", "2", "3"} {
+		req, _ := http.NewRequest("GET", "/page/"+id, nil)
+		writer := httptest.NewRecorder()
+		app.ServeHTTP(writer, req)
+		AssertStatus(t, http.StatusOK, writer)
+		errorIfNotEqual(t, id, writer.Body.String())
+	}
+	errorIfNotEqual(t, "1", detached.GetString("key"))
+	errorIfNotEqual(t, "page", detached.Route.Name)
+}
+
+func benchmarkAppServeHTTP(b *testing.B, reuse bool) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.ReuseContexts = reuse
+		c.AutoMaxProcs = false
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Get("page", "page/(?P<id>\\d+)", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(RequestContext(r).PathParams.Get("id")))
+	})
+	app.Setup()
+	req, _ := http.NewRequest("GET", "/page/1", nil)
+	writer := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer.Body.Reset()
+		app.ServeHTTP(writer, req)
+	}
+}
+
+func BenchmarkAppServeHTTP(b *testing.B) {
+	benchmarkAppServeHTTP(b, true)
+}
+
+func BenchmarkAppServeHTTPWithoutReuse(b *testing.B) {
+	benchmarkAppServeHTTP(b, false)
+}
+
+func TestContextRedirect(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), nil))
+	root := app.MountPoint("/")
+	root.Get("show", "pages/(?P<id>\\d+)", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join(RequestContext(r).Session.Flash("info"), ","))
+	})
+	root.Post("save", "pages/(?P<id>\\d+)/save", func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		ctx.Session.AddFlash("info", "saved")
+		ctx.Redirect(0, "show", ctx.PathParams.Get("id"))
+	})
+	root.Get("moved", "moved", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).RedirectURL(0, "https://example.org/")
+	})
+	root.Delete("delete", "pages/(?P<id>\\d+)", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).NoContent(http.StatusNoContent)
+	})
+	root.Get("invalid", "invalid", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).RedirectURL(200, "/")
+	})
+	status := 0
+	app.Hooks.Add("end_request", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		status = w.(ResponseWriter).Status()
+	})
+	client := NewTestClient(app)
+
+	res := client.PostForm("/pages/1/save", url.Values{})
+	errorIfNotEqual(t, http.StatusSeeOther, res.Status)
+	errorIfNotEqual(t, "/pages/1", res.Header.Get("Location"))
+	errorIfNotEqual(t, http.StatusSeeOther, status)
+	res = client.Get("/pages/1")
+	errorIfNotEqual(t, "saved", res.String())
+
+	res = client.Get("/moved")
+	errorIfNotEqual(t, http.StatusFound, res.Status)
+	errorIfNotEqual(t, "https://example.org/", res.Header.Get("Location"))
+
+	res = client.Do(client.NewRequest("DELETE", "/pages/1", nil))
+	errorIfNotEqual(t, http.StatusNoContent, res.Status)
+	errorIfNotEqual(t, 0, len(res.Body))
+
+	app.Logger = func(LogLevel, string) {}
+	res = client.Get("/invalid")
+	errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+}
+
+func TestAppRouteHooks(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	events := []string{}
+	for _, name := range []string{"start_request", "before_route", "after_route", "start_action", "end_action", "end_request"} {
+		name := name
+		app.Hooks.Add(name, func(w http.ResponseWriter, r *http.Request, data interface{}) {
+			event := name
+			if route, ok := data.(*Route); ok {
+				event += ":" + route.Name
+			} else if data != nil {
+				event += ":unexpected"
+			}
+			if name == "before_route" && RequestContext(r).Route != nil {
+				event += ":matched"
+			}
+			events = append(events, event)
+		})
+	}
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, "handler")
+	})
+	client := NewTestClient(app)
+
+	client.Get("/page1")
+	errorIfNotEqual(t, "start_request,before_route,after_route:page1,start_action,handler,end_action,end_request", strings.Join(events, ","))
+
+	events = events[:0]
+	res := client.Get("/notfound")
+	errorIfNotEqual(t, http.StatusNotFound, res.Status)
+	errorIfNotEqual(t, "start_request,before_route,end_request", strings.Join(events, ","))
+}
+
+func TestAppAbortableHooks(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	events := []string{}
+	app.Hooks.AddAbortable("start_request", func(w http.ResponseWriter, r *http.Request, data interface{}) bool {
+		events = append(events, "auth")
+		if r.URL.Query().Get("token") != "ok" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		return true
+	})
+	app.Hooks.Add("start_request", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		events = append(events, "start_request")
+	})
+	app.Hooks.AddAbortable("start_action", func(w http.ResponseWriter, r *http.Request, data interface{}) bool {
+		events = append(events, "start_action")
+		return RequestContext(r).Route.Name != "admin"
+	})
+	app.Hooks.Add("end_request", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		events = append(events, "end_request")
+	})
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, "page1")
+	})
+	root.Get("admin", "admin", func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, "admin")
+	})
+	client := NewTestClient(app)
+
+	res := client.Get("/page1")
+	errorIfNotEqual(t, http.StatusForbidden, res.Status)
+	errorIfNotEqual(t, "auth,end_request", strings.Join(events, ","))
+	errorIfNotEqual(t, true, res.Context.IsAborted())
+
+	events = events[:0]
+	res = client.Get("/page1?token=ok")
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "auth,start_request,start_action,page1,end_request", strings.Join(events, ","))
+	errorIfNotEqual(t, false, res.Context.IsAborted())
+
+	events = events[:0]
+	client.Get("/admin?token=ok")
+	errorIfNotEqual(t, "auth,start_request,start_action,end_request", strings.Join(events, ","))
+}
+
+func TestAppProfileMiddlewares(t *testing.T) {
+	for _, profile := range []bool{true, false} {
+		app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+			c.ProfileMiddlewares = profile
+		}))
+		app.AccessLogger = func(LogLevel, string) {}
+		sleep := func(d time.Duration) Middleware {
+			return MiddlewareOf(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(d)
+				RequestContext(r).MiddlewareChain.DoNext(w, r)
+			})
+		}
+		root := app.MountPoint("/")
+		root.Use(sleep(10 * time.Millisecond))
+		root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(30 * time.Millisecond)
+		}, sleep(20*time.Millisecond))
+		res := NewTestClient(app).Get("/page1")
+		timings := res.Context.MiddlewareTimings()
+		if !profile {
+			errorIfNotEqual(t, 0, len(timings))
+			continue
+		}
+		errorIfNotEqual(t, 2, len(timings))
+		// timings are in chain order, so each one includes at least its own sleep.
+		for i, d := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+			if timings[i] < d {
+				t.Errorf("middleware %v should take at least %v, but got %v", i, d, timings[i])
+			}
+		}
+	}
+}
+
+func TestAppHooksRemove(t *testing.T) {
+	hooks := make(Hooks)
+	events := []string{}
+	id1 := hooks.Add("test", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		events = append(events, "hook1")
+	})
+	hooks.Add("test", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		events = append(events, "hook2")
+	})
+	hooks.Remove("test", id1)
+	hooks.Remove("test", id1)
+	hooks.Run("test", HookDirectionNormal, nil, nil, nil)
+	errorIfNotEqual(t, "hook2", strings.Join(events, ","))
+
+	// removing a hook while running hooks does not affect the current run
+	events = events[:0]
+	var id3 HookId
+	id3 = hooks.Add("test", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		events = append(events, "hook3")
+		hooks.Remove("test", id3)
+	})
+	hooks.Add("test", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		events = append(events, "hook4")
+	})
+	hooks.Run("test", HookDirectionNormal, nil, nil, nil)
+	hooks.Run("test", HookDirectionNormal, nil, nil, nil)
+	errorIfNotEqual(t, "hook2,hook3,hook4,hook2,hook4", strings.Join(events, ","))
+
+	events = events[:0]
+	hooks.Clear("test")
+	hooks.Run("test", HookDirectionNormal, nil, nil, nil)
+	errorIfNotEqual(t, 0, len(events))
+
+	app := NewApp(DefaultAppConfig())
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs = append(logs, message)
+	}
+	app.MountPoint("/").Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {})
+	app.Setup()
+	app.Hooks.Remove("end_request", app.AccessLogHookId)
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	errorIfNotEqual(t, 0, len(logs))
+}
+
+func TestAppHooksConcurrently(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	app.MountPoint("/").Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {})
+	app.Setup()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page1", nil))
+			}
+		}()
+	}
+	// toggles the access log while serving requests
+	for i := 0; i < 100; i++ {
+		app.Hooks.Remove("end_request", app.AccessLogHookId)
+		app.AccessLogHookId = app.Hooks.Add("end_request", app.writeAccessLog)
+	}
+	app.Hooks.Clear("before_route")
+	wg.Wait()
+	errorIfNotEqual(t, 1, len(app.Hooks["end_request"]))
+
+	// only App.Hooks are locked, hooks of responses are not shared between requests.
+	errorIfNotEqual(t, true, app.Hooks.mutex() != nil)
+	errorIfNotEqual(t, true, NewResponseWriter(httptest.NewRecorder()).Hooks().mutex() == nil)
+}
+
+func TestAppRequestId(t *testing.T) {
+	log := ""
+	newApp := func(init func(*AppConfig)) *App {
+		app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+			c.AutoMaxProcs = false
+			c.AccessLogFormat = "{{.c.Id}} {{.res.Status}}"
+			if init != nil {
+				init(c)
+			}
+		}))
+		app.AccessLogger = func(level LogLevel, message string) { log = message }
+		app.MountPoint("/").Get("page", "page", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(RequestContext(r).Id))
+		})
+		app.Setup()
+		return app
+	}
+	serve := func(app *App, requestId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/page", nil)
+		if len(requestId) != 0 {
+			req.Header.Set("X-Request-Id", requestId)
+		}
+		writer := httptest.NewRecorder()
+		app.ServeHTTP(writer, req)
+		return writer
+	}
+
+	app := newApp(nil)
+	writer := serve(app, "spoofed")
+	id := writer.Body.String()
+	if !regexp.MustCompile(`^\d{12}-[0-9a-f]{20}$`).MatchString(id) {
+		t.Errorf("id should have a timestamp and a random part, but got '%v'", id)
+	}
+	errorIfNotEqual(t, id, writer.Header().Get("X-Request-Id"))
+	errorIfNotEqual(t, id+" 200", log)
+	if serve(app, "").Body.String() == id {
+		t.Error("ids should be unique")
+	}
+
+	app = newApp(func(c *AppConfig) {
+		c.RequestIdPrefix = "web1-"
+		c.RequestIdGenerator = func() string { return "generated" }
+		c.RequestIdHeader = ""
+	})
+	writer = serve(app, "")
+	errorIfNotEqual(t, "web1-generated", writer.Body.String())
+	errorIfNotEqual(t, 0, len(writer.Header().Values("X-Request-Id")))
+
+	app = newApp(func(c *AppConfig) {
+		c.TrustRequestIdHeader = true
+	})
+	writer = serve(app, "upstream-id")
+	errorIfNotEqual(t, "upstream-id", writer.Body.String())
+	errorIfNotEqual(t, "upstream-id", writer.Header().Get("X-Request-Id"))
+	errorIfNotEqual(t, "upstream-id 200", log)
+	if id := serve(app, "invalid id\n").Body.String(); id == "invalid id\n" {
+		t.Error("invalid request ids should be ignored")
+	}
+}
+
+func TestAppMount(t *testing.T) {
+	order := []string{}
+	newMiddleware := func(name string) Middleware {
+		return MiddlewareOf(func(w http.ResponseWriter, r *http.Request) {
+			order = append(order, name)
+			RequestContext(r).MiddlewareChain.DoNext(w, r)
+		})
+	}
+	admin := NewApp(DefaultAppConfig())
+	admin.Use(newMiddleware("admin"))
+	admin.OnNotFound = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "admin not found", http.StatusNotFound)
+	}
+	root := admin.MountPoint("/")
+	root.Get("index", "", func(w http.ResponseWriter, r *http.Request) {
+		errorIfNotEqual(t, admin, RequestContext(r).App)
+		errorIfNotEqual(t, "app", RequestContext(r).GetString("by"))
+		w.Write([]byte(RequestContext(r).App.mountParent.BuildUrl("admin.user", "10")))
+	})
+	root.Get("user", "users/(?P<id>\\d+)", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(admin.BuildUrl("user", RequestContext(r).PathParams.Get("id"))))
+	}, newMiddleware("route"))
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "static.txt"), []byte("static"), 0644)
+	root.Static("statics", "statics", dir)
+
+	app := NewApp(DefaultAppConfig())
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) {
+		logs = append(logs, message)
+	}
+	admin.AccessLogger = func(LogLevel, string) {
+		t.Error("access logs should be written by the parent App")
+	}
+	app.Use(newMiddleware("app"), MiddlewareOf(func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Set("by", "app")
+		RequestContext(r).MiddlewareChain.DoNext(w, r)
+	}))
+	app.MountPoint("/").Get("index", "", func(w http.ResponseWriter, r *http.Request) {})
+	app.Mount("/admin", admin)
+	root.Get("later", "later", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("later"))
+	})
+	app.Setup()
+
+	client := NewTestClient(app)
+	res := client.Get("/admin/")
+	errorIfNotEqual(t, "/admin/users/10", res.String())
+	errorIfNotEqual(t, app, res.Context.App)
+	errorIfNotEqual(t, "admin", res.Context.Route.Name)
+	errorIfNotEqual(t, "app admin", strings.Join(order, " "))
+	errorIfNotEqual(t, 1, len(logs))
+	order = order[:0]
+	errorIfNotEqual(t, "/admin/users/20", client.Get("/admin/users/20").String())
+	errorIfNotEqual(t, "app admin route", strings.Join(order, " "))
+	errorIfNotEqual(t, "later", client.Get("/admin/later").String())
+	errorIfNotEqual(t, "admin not found\n", client.Get("/admin/missing").String())
+	errorIfNotEqual(t, http.StatusNotFound, client.Get("/administrator").Status)
+	errorIfNotEqual(t, "/admin/", app.BuildUrl("admin.index"))
+	errorIfNotEqual(t, "/admin/", app.BuildUrl("admin"))
+	errorIfNotEqual(t, "/admin/statics/static.txt", admin.BuildUrl("statics", "static.txt"))
+	errorIfNotEqual(t, "static", client.Get("/admin/statics/static.txt").String())
+
+	func() {
+		defer func() {
+			errorIfNotEqual(t, "App is already mounted at '/admin'.", recover())
+		}()
+		app.Mount("/admin2", admin)
+	}()
+	func() {
+		defer func() {
+			errorIfNotEqual(t, "Route 'admin' already defined.", recover())
+		}()
+		app.Mount("/admin", NewApp(DefaultAppConfig()))
+	}()
+}
@@ -0,0 +1,234 @@
+package cidre
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BindError is an error that occurs while binding request bodies to objects.
+type BindError struct {
+	// A name of the field that caused the error, or an empty string
+	// if the error is not related to a specific field.
+	Field string
+	// An underlying error
+	Err error
+}
+
+func (e *BindError) Error() string {
+	if len(e.Field) != 0 {
+		return fmt.Sprintf("bind: field '%v': %v", e.Field, e.Err)
+	}
+	return fmt.Sprintf("bind: %v", e.Err)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+func (ctx *Context) limitedBody() io.Reader {
+	return http.MaxBytesReader(nil, ctx.Request.Body, ctx.App.Config.MaxBindBodySize)
+}
+
+func newBodyBindError(err error) *BindError {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		return &BindError{Field: e.Field, Err: err}
+	case *http.MaxBytesError:
+		return &BindError{Err: errors.New("request body too large")}
+	case *json.SyntaxError:
+		return &BindError{Err: errors.New(fmt.Sprintf("malformed JSON at offset %d: %v", e.Offset, err))}
+	}
+	switch err {
+	case io.EOF:
+		return &BindError{Err: errors.New("empty request body")}
+	case io.ErrUnexpectedEOF:
+		return &BindError{Err: errors.New("malformed JSON: unexpected end of the request body")}
+	}
+	return &BindError{Err: err}
+}
+
+func isJsonMediaType(mediatype string) bool {
+	return mediatype == "application/json" || strings.HasSuffix(mediatype, "+json")
+}
+
+// Decodes a JSON request body into the given object.
+// Unknown fields are rejected if AppConfig.StrictBind is true.
+// If the object implements Validatable, Bind* methods return an error returned by Validate.
+// BindJSON returns a *BindError if the Content-Type is not JSON, or the body is malformed or
+// larger than AppConfig.MaxBindBodySize.
+func (ctx *Context) BindJSON(v interface{}) error {
+	mediatype, _, _ := mime.ParseMediaType(ctx.Request.Header.Get("Content-Type"))
+	if !isJsonMediaType(mediatype) {
+		return &BindError{Err: errors.New(fmt.Sprintf("unsupported content type '%v', JSON is expected", mediatype))}
+	}
+	decoder := json.NewDecoder(ctx.limitedBody())
+	if ctx.App.Config.StrictBind {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return newBodyBindError(err)
+	}
+	return validate(v)
+}
+
+// Decodes a XML request body into the given object.
+// BindXML returns a *BindError if the body is malformed or larger than AppConfig.MaxBindBodySize.
+func (ctx *Context) BindXML(v interface{}) error {
+	if err := xml.NewDecoder(ctx.limitedBody()).Decode(v); err != nil {
+		return newBodyBindError(err)
+	}
+	return validate(v)
+}
+
+// Parses the request body as a form limited by AppConfig.MaxBindBodySize.
+// The body is parsed only once, so the error is kept for later calls.
+func (ctx *Context) parseForm() error {
+	r := ctx.Request
+	if ctx.formErr != nil {
+		return ctx.formErr
+	}
+	if r.PostForm != nil {
+		return nil
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, ctx.App.Config.MaxBindBodySize)
+	ctx.formErr = r.ParseForm()
+	return ctx.formErr
+}
+
+// Maps form values(query parameters and request bodies) onto fields of the given struct pointer.
+// Values are mapped by a `form:"name"` tag or a field name. Fields tagged with `form:"-"` are ignored.
+// Supported field types are string, bool, ints, uints, floats, time.Duration and slices of them.
+// A "_method" parameter is not mapped if AppConfig.AllowHttpMethodOverwrite is true.
+// BindForm returns a *BindError if the body is larger than AppConfig.MaxBindBodySize.
+// Multipart bodies that have already been parsed(e.g. by Context.FormFile) are limited by
+// AppConfig.MaxUploadSize instead.
+func (ctx *Context) BindForm(v interface{}) error {
+	r := ctx.Request
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if r.MultipartForm == nil {
+			r.Body = http.MaxBytesReader(nil, r.Body, ctx.App.Config.MaxBindBodySize)
+		}
+		err = ctx.parseMultipartForm()
+	} else {
+		err = ctx.parseForm()
+	}
+	if err != nil {
+		return newBodyBindError(err)
+	}
+	values := r.Form
+	if ctx.App.Config.AllowHttpMethodOverwrite {
+		if _, ok := values["_method"]; ok {
+			values = make(map[string][]string, len(r.Form))
+			for key, value := range r.Form {
+				values[key] = value
+			}
+			delete(values, "_method")
+		}
+	}
+	if err := bindValues(values, v); err != nil {
+		return err
+	}
+	return validate(v)
+}
+
+// Binds a request body into the given object according to the Content-Type header.
+// Query parameters are bound by BindForm if the request does not have a body(e.g. GET requests).
+// Bind returns a *BindError if the Content-Type is not supported.
+func (ctx *Context) Bind(v interface{}) error {
+	mediatype, _, _ := mime.ParseMediaType(ctx.Request.Header.Get("Content-Type"))
+	switch {
+	case len(mediatype) == 0 && ctx.Request.ContentLength == 0:
+		return ctx.BindForm(v)
+	case isJsonMediaType(mediatype):
+		return ctx.BindJSON(v)
+	case mediatype == "application/xml" || mediatype == "text/xml" || strings.HasSuffix(mediatype, "+xml"):
+		return ctx.BindXML(v)
+	case mediatype == "application/x-www-form-urlencoded" || mediatype == "multipart/form-data":
+		return ctx.BindForm(v)
+	}
+	return &BindError{Err: errors.New(fmt.Sprintf("unsupported content type '%v'", mediatype))}
+}
+
+func bindValues(values map[string][]string, v interface{}) error {
+	vt := reflect.ValueOf(v).Elem()
+	tt := vt.Type()
+	for i := 0; i < tt.NumField(); i++ {
+		sf := tt.Field(i)
+		name := sf.Tag.Get("form")
+		if name == "-" || len(sf.PkgPath) != 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = sf.Name
+		}
+		vs, ok := values[name]
+		if !ok || len(vs) == 0 {
+			continue
+		}
+		field := vt.Field(i)
+		if field.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(field.Type(), len(vs), len(vs))
+			for j, s := range vs {
+				if err := setBindValue(slice.Index(j), s); err != nil {
+					return &BindError{Field: name, Err: err}
+				}
+			}
+			field.Set(slice)
+			continue
+		}
+		if err := setBindValue(field, vs[0]); err != nil {
+			return &BindError{Field: name, Err: err}
+		}
+	}
+	return nil
+}
+
+func setBindValue(field reflect.Value, s string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(s)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case isIntKind(field.Kind()):
+		i, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case isUintKind(field.Kind()):
+		u, err := strconv.ParseUint(s, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return errors.New(fmt.Sprintf("unsupported type %v", field.Type()))
+	}
+	return nil
+}
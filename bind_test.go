@@ -0,0 +1,208 @@
+package cidre
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testBindStruct struct {
+	Name    string        `json:"name" xml:"name" form:"name"`
+	Age     int           `json:"age" xml:"age" form:"age"`
+	Tags    []string      `json:"tags" xml:"tag" form:"tag"`
+	Admin   bool          `json:"admin" xml:"admin"`
+	Timeout time.Duration `json:"-" xml:"-"`
+	Ignored string        `json:"-" xml:"-" form:"-"`
+	Method  string        `json:"-" xml:"-" form:"_method"`
+}
+
+func newBindTestApp(init func(*AppConfig)) (*TestClient, *testBindStruct, *error) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		if init != nil {
+			init(c)
+		}
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	obj := &testBindStruct{}
+	var bindErr error
+	root := app.MountPoint("/")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		*obj = testBindStruct{}
+		bindErr = RequestContext(r).Bind(obj)
+		if bindErr != nil {
+			http.Error(w, bindErr.Error(), http.StatusBadRequest)
+		}
+	}
+	root.Get("bind", "bind", handler)
+	root.Post("post_bind", "bind", handler)
+	root.Put("put_bind", "bind", handler)
+	return NewTestClient(app), obj, &bindErr
+}
+
+func TestBindJSON(t *testing.T) {
+	client, obj, bindErr := newBindTestApp(nil)
+	res := client.Post("/bind", "application/json; charset=utf-8",
+		strings.NewReader(`{"name":"alice","age":20,"tags":["a","b"],"admin":true,"unknown":1}`))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "alice", obj.Name)
+	errorIfNotEqual(t, 20, obj.Age)
+	errorIfNotEqual(t, "[a b]", fmt.Sprint(obj.Tags))
+	errorIfNotEqual(t, true, obj.Admin)
+
+	res = client.Post("/bind", "application/json", strings.NewReader(`{"name":"alice","age":"20"}`))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	var be *BindError
+	if !errors.As(*bindErr, &be) {
+		t.Fatalf("error should be a *BindError, but got %v", *bindErr)
+	}
+	errorIfNotEqual(t, "age", be.Field)
+
+	res = client.Post("/bind", "application/json", strings.NewReader(`{"name":`))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	if !errors.As(*bindErr, &be) {
+		t.Errorf("error should be a *BindError, but got %v", *bindErr)
+	}
+
+	client, _, bindErr = newBindTestApp(func(c *AppConfig) {
+		c.StrictBind = true
+		c.MaxBindBodySize = 30
+	})
+	res = client.Post("/bind", "application/json", strings.NewReader(`{"name":"alice","unknown":1}`))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	if !strings.Contains((*bindErr).Error(), "unknown field") {
+		t.Errorf("unknown fields should be rejected in strict mode, but got %v", *bindErr)
+	}
+	res = client.Post("/bind", "application/json", strings.NewReader(`{"name":"`+strings.Repeat("a", 30)+`"}`))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	errorIfNotEqual(t, "bind: request body too large", (*bindErr).Error())
+}
+
+func TestContextBindJSON(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	app.MountPoint("/").Post("bind", "bind", func(w http.ResponseWriter, r *http.Request) {
+		var obj testBindStruct
+		if err := RequestContext(r).BindJSON(&obj); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%v:%v", obj.Name, obj.Age)
+	})
+	client := NewTestClient(app)
+
+	res := client.Post("/bind", "application/vnd.api+json", strings.NewReader(`{"name":"alice","age":20}`))
+	errorIfNotEqual(t, "alice:20", res.String())
+
+	for _, c := range []struct{ contentType, body, message string }{
+		{"application/json", `{"name":"alice",}`, "bind: malformed JSON at offset 17: invalid character '}' looking for beginning of object key string"},
+		{"application/json", `{"name":"alice"`, "bind: malformed JSON: unexpected end of the request body"},
+		{"application/json", ``, "bind: empty request body"},
+		{"text/plain", `{"name":"alice"}`, "bind: unsupported content type 'text/plain', JSON is expected"},
+		{"", `{"name":"alice"}`, "bind: unsupported content type '', JSON is expected"},
+	} {
+		res = client.Post("/bind", c.contentType, strings.NewReader(c.body))
+		errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+		errorIfNotEqual(t, c.message, strings.TrimSpace(res.String()))
+	}
+}
+
+func TestBindXML(t *testing.T) {
+	client, obj, _ := newBindTestApp(nil)
+	res := client.Post("/bind", "application/xml",
+		strings.NewReader(`<user><name>bob</name><age>30</age><tag>a</tag><tag>b</tag></user>`))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "bob", obj.Name)
+	errorIfNotEqual(t, 30, obj.Age)
+	errorIfNotEqual(t, "[a b]", fmt.Sprint(obj.Tags))
+
+	res = client.Post("/bind", "text/xml", strings.NewReader(`<user><name>bob</na`))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+}
+
+func TestBindForm(t *testing.T) {
+	client, obj, bindErr := newBindTestApp(nil)
+	res := client.PostForm("/bind", url.Values{
+		"name": {"carol"}, "age": {"40"}, "tag": {"a", "b"}, "Admin": {"true"},
+		"Timeout": {"3s"}, "Ignored": {"x"}, "-": {"x"}})
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "carol", obj.Name)
+	errorIfNotEqual(t, 40, obj.Age)
+	errorIfNotEqual(t, "[a b]", fmt.Sprint(obj.Tags))
+	errorIfNotEqual(t, true, obj.Admin)
+	errorIfNotEqual(t, 3*time.Second, obj.Timeout)
+	errorIfNotEqual(t, "", obj.Ignored)
+
+	res = client.PostForm("/bind", url.Values{"age": {"forty"}})
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	var be *BindError
+	if !errors.As(*bindErr, &be) {
+		t.Fatalf("error should be a *BindError, but got %v", *bindErr)
+	}
+	errorIfNotEqual(t, "age", be.Field)
+
+	res = client.Post("/bind", "text/plain", strings.NewReader("name=carol"))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	if !strings.Contains((*bindErr).Error(), "unsupported content type") {
+		t.Errorf("unsupported content types should be rejected, but got %v", *bindErr)
+	}
+}
+
+func TestBindFormTooLarge(t *testing.T) {
+	client, obj, bindErr := newBindTestApp(func(c *AppConfig) {
+		c.MaxBindBodySize = 1024
+		c.AllowHttpMethodOverwrite = false
+	})
+	req := newTestMultipartRequest(map[string]string{"name": "carol"}, "", "", nil)
+	req.URL.Path = "/bind"
+	res := client.Do(req)
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "carol", obj.Name)
+
+	req = newTestMultipartRequest(map[string]string{"name": "carol"}, "file", "large.txt", bytes.Repeat([]byte("a"), 1<<20))
+	req.URL.Path = "/bind"
+	res = client.Do(req)
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	errorIfNotEqual(t, "bind: request body too large", (*bindErr).Error())
+
+	// the limit applies even if the body has been read for the method overwriting.
+	client, obj, bindErr = newBindTestApp(func(c *AppConfig) {
+		c.MaxBindBodySize = 1024
+	})
+	res = client.PostForm("/bind", url.Values{"name": {strings.Repeat("a", 1<<20)}, "_method": {"PUT"}})
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	errorIfNotEqual(t, "bind: request body too large", (*bindErr).Error())
+	res = client.PostForm("/bind", url.Values{"name": {"carol"}, "_method": {"PUT"}})
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "carol", obj.Name)
+}
+
+func TestBindFormQuery(t *testing.T) {
+	client, obj, bindErr := newBindTestApp(nil)
+	res := client.Get("/bind?name=carol&age=40&tag=a&tag=b&Timeout=1m")
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "carol", obj.Name)
+	errorIfNotEqual(t, 40, obj.Age)
+	errorIfNotEqual(t, "[a b]", fmt.Sprint(obj.Tags))
+	errorIfNotEqual(t, time.Minute, obj.Timeout)
+
+	res = client.Get("/bind?Admin=maybe")
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	var be *BindError
+	if !errors.As(*bindErr, &be) {
+		t.Fatalf("error should be a *BindError, but got %v", *bindErr)
+	}
+	errorIfNotEqual(t, "Admin", be.Field)
+
+	// query parameters are merged with the request body
+	res = client.PostForm("/bind?age=20", url.Values{"name": {"carol"}, "_method": {"PUT"}})
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "carol", obj.Name)
+	errorIfNotEqual(t, 20, obj.Age)
+	errorIfNotEqual(t, "", obj.Method)
+}
@@ -1,8 +1,12 @@
 package cidre
 
 import (
+	"encoding/json"
+	"net/http/httptest"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -12,3 +16,58 @@ func errorIfNotEqual(t *testing.T, v1, v2 interface{}) {
 		t.Errorf("%v line %v: '%v' expected, but got '%v'", filepath.Base(file), line, v1, v2)
 	}
 }
+
+func errorWithCaller(t *testing.T, format string, args ...interface{}) {
+	_, file, line, _ := runtime.Caller(2)
+	t.Errorf("%v line %v: "+format, append([]interface{}{filepath.Base(file), line}, args...)...)
+}
+
+// Reports an error if the status code of the response is not the given code.
+func AssertStatus(t *testing.T, status int, w *httptest.ResponseRecorder) {
+	if w.Code != status {
+		errorWithCaller(t, "status %v expected, but got %v", status, w.Code)
+	}
+}
+
+// Reports an error if the response body does not contain the given string.
+func AssertBodyContains(t *testing.T, s string, w *httptest.ResponseRecorder) {
+	if body := w.Body.String(); !strings.Contains(body, s) {
+		errorWithCaller(t, "body should contain '%v', but got '%v'", s, body)
+	}
+}
+
+// Reports an error if the response header does not have the given value.
+func AssertHeader(t *testing.T, name, value string, w *httptest.ResponseRecorder) {
+	if v := w.Header().Get(name); v != value {
+		errorWithCaller(t, "header %v: '%v' expected, but got '%v'", name, value, v)
+	}
+}
+
+// Reports an error if the response body is not a JSON value equal to the given JSON.
+func AssertJSONEquals(t *testing.T, expected string, w *httptest.ResponseRecorder) {
+	var v1, v2 interface{}
+	if err := json.Unmarshal([]byte(expected), &v1); err != nil {
+		errorWithCaller(t, "invalid expected json '%v': %v", expected, err)
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v2); err != nil {
+		errorWithCaller(t, "invalid json body '%v': %v", w.Body.String(), err)
+		return
+	}
+	if !reflect.DeepEqual(v1, v2) {
+		errorWithCaller(t, "json '%v' expected, but got '%v'", expected, strings.TrimSpace(w.Body.String()))
+	}
+}
+
+// Reports an error if the response does not set the cookie to the given value.
+func AssertCookie(t *testing.T, name, value string, w *httptest.ResponseRecorder) {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			if cookie.Value != value {
+				errorWithCaller(t, "cookie %v: '%v' expected, but got '%v'", name, value, cookie.Value)
+			}
+			return
+		}
+	}
+	errorWithCaller(t, "cookie %v not found", name)
+}
@@ -0,0 +1,170 @@
+package cidre
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A list of trusted proxies.
+type proxyNets []*net.IPNet
+
+// Parses IP addresses and CIDRs of proxies. parseProxies panics if the list has invalid values.
+func parseProxies(proxies []string) proxyNets {
+	result := make(proxyNets, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid trusted proxy: '%v'", proxy))
+		}
+		result = append(result, ipnet)
+	}
+	return result
+}
+
+func (nets proxyNets) contains(ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) parseTrustedProxies() proxyNets {
+	app.trustedProxyOnce.Do(func() {
+		app.trustedProxies = parseProxies(app.Config.TrustedProxies)
+	})
+	return app.trustedProxies
+}
+
+func (app *App) isTrustedProxy(ip net.IP) bool {
+	return app.parseTrustedProxies().contains(ip)
+}
+
+// Returns an IP address of the client. If the request comes from trusted proxies
+// (AppConfig.TrustedProxies), ClientIP takes the address from forwarded headers
+// (AppConfig.ForwardedHeaders). Addresses in X-Forwarded-For and Forwarded headers are
+// walked from right to left past trusted proxies, so spoofed values are ignored.
+// ClientIP can be used in access logs as `{{.c.ClientIP}}`.
+func (ctx *Context) ClientIP() string {
+	return ctx.clientIP(ctx.App.parseTrustedProxies())
+}
+
+// Same as ClientIP, but trusts the given proxies instead of AppConfig.TrustedProxies.
+// If trustedProxies is nil, RemoteIP is the same as ClientIP. RemoteIP panics if
+// trustedProxies has invalid values.
+//
+//     ip := ctx.RemoteIP([]string{"10.0.0.0/8"})
+func (ctx *Context) RemoteIP(trustedProxies []string) string {
+	if trustedProxies == nil {
+		return ctx.ClientIP()
+	}
+	return ctx.clientIP(parseProxies(trustedProxies))
+}
+
+// Returns the address of the peer.
+func (ctx *Context) remoteAddr() (string, net.IP) {
+	return remoteAddrOf(ctx.Request)
+}
+
+func remoteAddrOf(r *http.Request) (string, net.IP) {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return remote, net.ParseIP(remote)
+}
+
+func (ctx *Context) clientIP(trusted proxyNets) string {
+	remote, remoteIP := ctx.remoteAddr()
+	if remoteIP == nil || !trusted.contains(remoteIP) {
+		return remote
+	}
+	for _, name := range ctx.App.Config.ForwardedHeaders {
+		var candidates []string
+		switch strings.ToLower(name) {
+		case "x-forwarded-for":
+			for _, value := range ctx.Request.Header.Values(name) {
+				candidates = append(candidates, strings.Split(value, ",")...)
+			}
+		case "x-real-ip":
+			candidates = ctx.Request.Header.Values(name)
+		case "forwarded":
+			for _, value := range ctx.Request.Header.Values(name) {
+				candidates = append(candidates, parseForwardedFor(value)...)
+			}
+		}
+		if ip := walkForwardedAddresses(trusted, candidates); len(ip) != 0 {
+			return ip
+		}
+	}
+	return remote
+}
+
+// Returns the rightmost address that is not a trusted proxy.
+func walkForwardedAddresses(trusted proxyNets, candidates []string) string {
+	result := ""
+	for i := len(candidates) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(candidates[i]))
+		if ip == nil {
+			break
+		}
+		result = ip.String()
+		if !trusted.contains(ip) {
+			break
+		}
+	}
+	return result
+}
+
+// Returns `for` parameters in the Forwarded header(RFC 7239).
+func parseForwardedFor(value string) []string {
+	var result []string
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "for" {
+				continue
+			}
+			addr := strings.Trim(kv[1], `"`)
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			result = append(result, strings.Trim(addr, "[]"))
+		}
+	}
+	return result
+}
+
+// Returns a scheme of the request, "https" or "http". Scheme returns the value of
+// the X-Forwarded-Proto header if the request comes from trusted proxies(AppConfig.TrustedProxies).
+func (ctx *Context) Scheme() string {
+	return ctx.App.schemeOf(ctx.Request)
+}
+
+func (app *App) schemeOf(r *http.Request) string {
+	if _, remoteIP := remoteAddrOf(r); remoteIP != nil && app.isTrustedProxy(remoteIP) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Returns true if the request has been sent by XMLHttpRequest(X-Requested-With header).
+func (ctx *Context) IsAjax() bool {
+	return strings.EqualFold(ctx.Request.Header.Get("X-Requested-With"), "XMLHttpRequest")
+}
@@ -0,0 +1,100 @@
+package cidre
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContextClientIP(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	}))
+	cases := []struct {
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		// no proxies
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		// spoofed XFF from an untrusted peer
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "192.0.2.1"},
+		// a trusted proxy
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "203.0.113.1"},
+		// multiple hops: the client spoofs the first address
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.1, 10.0.0.2"}, "203.0.113.1"},
+		// all hops are trusted
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		// X-Real-IP
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.2"}, "203.0.113.2"},
+		// IPv6 proxy and Forwarded header
+		{"[2001:db8::1]:1234", map[string]string{"Forwarded": `for=198.51.100.1, for="[2001:db8::2]:4711";proto=https`}, "2001:db8::2"},
+		// invalid header values
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "unknown"}, "10.0.0.1"},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		ctx := NewContext(app, "id", req)
+		if ip := ctx.ClientIP(); ip != c.expected {
+			t.Errorf("case %v: '%v' expected, but got '%v'", i, c.expected, ip)
+		}
+	}
+}
+
+func TestContextClientIPAccessLog(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.TrustedProxies = []string{"192.0.2.1"}
+		c.AccessLogFormat = "{{.c.ClientIP}}"
+	}))
+	log := ""
+	app.AccessLogger = func(level LogLevel, message string) { log = message }
+	app.MountPoint("/").Get("page", "page", func(w http.ResponseWriter, r *http.Request) {})
+	app.Setup()
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	errorIfNotEqual(t, "203.0.113.1", log)
+}
+
+func TestContextRemoteIP(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	ctx := NewContext(app, "id", req)
+	errorIfNotEqual(t, "203.0.113.1", ctx.RemoteIP([]string{"10.0.0.0/8"}))
+	errorIfNotEqual(t, "10.0.0.1", ctx.RemoteIP([]string{"192.0.2.1"}))
+	errorIfNotEqual(t, "10.0.0.1", ctx.RemoteIP(nil))
+
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("X-Real-IP", "203.0.113.2")
+	errorIfNotEqual(t, "203.0.113.2", ctx.RemoteIP([]string{"10.0.0.1"}))
+}
+
+func TestContextScheme(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.TrustedProxies = []string{"10.0.0.0/8"}
+	}))
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	ctx := NewContext(app, "id", req)
+	errorIfNotEqual(t, "http", ctx.Scheme())
+	req.Header.Set("X-Forwarded-Proto", "HTTPS")
+	errorIfNotEqual(t, "https", ctx.Scheme())
+
+	// untrusted peers can not spoof the scheme
+	req.RemoteAddr = "192.0.2.1:1234"
+	errorIfNotEqual(t, "http", ctx.Scheme())
+	req.TLS = &tls.ConnectionState{}
+	errorIfNotEqual(t, "https", ctx.Scheme())
+
+	errorIfNotEqual(t, false, ctx.IsAjax())
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	errorIfNotEqual(t, true, ctx.IsAjax())
+}
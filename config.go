@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +22,50 @@ type ConfigMapping struct {
 	Struct  interface{}
 }
 
+// IniParseConfig is a configuration object for the ParseIniFileWithConfig
+type IniParseConfig struct {
+	// Expands ${VAR} and ${VAR:-default} in string values with environment variables if true.
+	// '$$' is treated as a literal '$'.
+	// default: false
+	ExpandEnv bool
+	// Returns an error if the mapped sections have keys that do not correspond to any struct fields.
+	// default: false
+	Strict bool
+	// Skips files that do not exist in ParseIniFiles.
+	// default: false
+	SkipMissingFiles bool
+}
+
+// Returns an IniParseConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the IniParseConfig object.
+func DefaultIniParseConfig(init ...func(*IniParseConfig)) *IniParseConfig {
+	self := &IniParseConfig{
+		ExpandEnv:        false,
+		Strict:           false,
+		SkipMissingFiles: false,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+var envReferencePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+func expandEnv(value string) string {
+	return envReferencePattern.ReplaceAllStringFunc(value, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		matched := envReferencePattern.FindStringSubmatch(m)
+		if v, ok := os.LookupEnv(matched[1]); ok && (len(v) != 0 || len(matched[2]) == 0) {
+			return v
+		}
+		return matched[3]
+	})
+}
+
 // Attempts to read and parse the given filepath, Mapping sections to the given object.
 // Configuration file format is simplified ini format.
 //
@@ -28,16 +75,108 @@ type ConfigMapping struct {
 //    Key1 = String value
 //    ; bool value
 //    Key2 = true
-//    ; int value
+//    ; int value: 0x(hexadecimal), 0o(octal) and 0b(binary) prefixes are supported
 //    Key3 = 9999
 //    ; float value
 //    Key3 = 99.99
 //    ; time.Duration value
 //    Key3 = 180s
+//    ; list value: comma-separated values can be mapped to slice fields
+//    Key4 = a, b, c
 //
 //    [section2]
 //    ; blah-blah-blah
 func ParseIniFile(filepath string, mappings ...ConfigMapping) (ConfigContainer, error) {
+	return ParseIniFileWithConfig(filepath, DefaultIniParseConfig(), mappings...)
+}
+
+// Same as ParseIniFile, but accepts an IniParseConfig object.
+func ParseIniFileWithConfig(filepath string, config *IniParseConfig, mappings ...ConfigMapping) (ConfigContainer, error) {
+	result, err := parseIniFile(filepath, config)
+	if err != nil {
+		return nil, err
+	}
+	return result.applyMappings(config, mappings)
+}
+
+// Same as ParseIniFile, but parses the given files in order and merges them.
+// Values in later files override values in earlier files.
+// Mappings are applied once after all files are merged.
+//
+//     ParseIniFiles([]string{"app.ini", "app.production.ini"}, ConfigMapping{"cidre", appConfig})
+func ParseIniFiles(filepaths []string, mappings ...ConfigMapping) (ConfigContainer, error) {
+	return ParseIniFilesWithConfig(filepaths, DefaultIniParseConfig(), mappings...)
+}
+
+// Same as ParseIniFiles, but accepts an IniParseConfig object.
+func ParseIniFilesWithConfig(filepaths []string, config *IniParseConfig, mappings ...ConfigMapping) (ConfigContainer, error) {
+	result := ConfigContainer(make(map[string]map[string]interface{}))
+	for _, filepath := range filepaths {
+		if config.SkipMissingFiles {
+			if _, err := os.Stat(filepath); os.IsNotExist(err) {
+				continue
+			}
+		}
+		cc, err := parseIniFile(filepath, config)
+		if err != nil {
+			return nil, err
+		}
+		result.Merge(cc)
+	}
+	return result.applyMappings(config, mappings)
+}
+
+// Merges sections and keys of the other ConfigContainer into this ConfigContainer.
+// Values in the other ConfigContainer override existing values.
+func (cc ConfigContainer) Merge(other ConfigContainer) {
+	for section, values := range other {
+		if _, ok := cc[section]; !ok {
+			cc[section] = make(map[string]interface{})
+		}
+		for key, value := range values {
+			cc[section][key] = value
+		}
+	}
+}
+
+func (cc ConfigContainer) applyMappings(config *IniParseConfig, mappings []ConfigMapping) (ConfigContainer, error) {
+	for _, mapping := range mappings {
+		cc.Mapping(mapping.Section, mapping.Struct)
+		if config.Strict {
+			if err := cc.CheckUnknownKeys(mapping.Section, mapping.Struct); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cc, nil
+}
+
+// Same as ParseIniFileWithConfig, but returns an error instead of causing panic
+// when values can not be mapped to struct fields.
+// If config is nil, DefaultIniParseConfig() will be used.
+func ParseIniFileE(filepath string, config *IniParseConfig, mappings ...ConfigMapping) (ConfigContainer, error) {
+	if config == nil {
+		config = DefaultIniParseConfig()
+	}
+	result, err := parseIniFile(filepath, config)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, mapping := range mappings {
+		if err := result.MappingE(mapping.Section, mapping.Struct); err != nil {
+			errs = append(errs, err)
+		}
+		if config.Strict {
+			if err := result.CheckUnknownKeys(mapping.Section, mapping.Struct); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+func parseIniFile(filepath string, config *IniParseConfig) (ConfigContainer, error) {
 	cbytes, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, err
@@ -49,7 +188,7 @@ func ParseIniFile(filepath string, mappings ...ConfigMapping) (ConfigContainer,
 		/* 0:spaces,comments */ regexp.MustCompile(`^(\s*|\s*[#;].*)$`),
 		/* 1:secsions */ regexp.MustCompile(`^\s*\[([^\]]+)\]\s*$`),
 		/* 2:bool */ regexp.MustCompile(`^\s*([^=]+)=\s*(true|false)\s*$`),
-		/* 3:int */ regexp.MustCompile(`^\s*([^=]+)=\s*(\-?\d+)\s*$`),
+		/* 3:int */ regexp.MustCompile(`^\s*([^=]+)=\s*(\-?(0[xX][0-9a-fA-F_]+|0[oO][0-7_]+|0[bB][01_]+|\d+))\s*$`),
 		/* 4:float */ regexp.MustCompile(`^\s*([^=]+)=\s*(\-?\d+(\.\d+)?)\s*$`),
 		/* 5:time.Duration */ regexp.MustCompile(`^\s*([^=]+)=\s*(\-?\d+(\.\d+)?(ns|us|ms|s|m|h))\s*$`),
 		/* 6:string */ regexp.MustCompile(`^\s*([^=]+)=\s*(.*)\s*$`),
@@ -69,7 +208,10 @@ func ParseIniFile(filepath string, mappings ...ConfigMapping) (ConfigContainer,
 					value, _ := strconv.ParseBool(matched[2])
 					current[v1] = value
 				case 3:
-					value, _ := strconv.ParseInt(matched[2], 10, 64)
+					value, err := parseConfigInteger(matched[2])
+					if err != nil {
+						return nil, errors.New(fmt.Sprintf("%v: file %v, line %v", err, filepath, i+1))
+					}
 					current[v1] = value
 				case 4:
 					value, _ := strconv.ParseFloat(matched[2], 64)
@@ -78,7 +220,11 @@ func ParseIniFile(filepath string, mappings ...ConfigMapping) (ConfigContainer,
 					value, _ := time.ParseDuration(matched[2])
 					current[v1] = value
 				case 6:
-					current[v1] = sr.Replace(matched[2])
+					value := sr.Replace(matched[2])
+					if config.ExpandEnv {
+						value = expandEnv(value)
+					}
+					current[v1] = value
 				}
 				break
 			}
@@ -87,26 +233,213 @@ func ParseIniFile(filepath string, mappings ...ConfigMapping) (ConfigContainer,
 			return nil, errors.New(fmt.Sprintf("syntax error: file %v, line %v", filepath, i+1))
 		}
 	}
-	for _, mapping := range mappings {
-		result.Mapping(mapping.Section, mapping.Struct)
+	return result, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Parses a decimal, hexadecimal(0x), octal(0o) or binary(0b) integer.
+// Returns an uint64 value if the value is too large for an int64 value, otherwise returns an int64 value.
+func parseConfigInteger(s string) (interface{}, error) {
+	base := 10
+	if digits := strings.TrimPrefix(s, "-"); len(digits) > 2 && strings.ContainsRune("xXoObB", rune(digits[1])) {
+		base = 0
+	}
+	i, err := strconv.ParseInt(s, base, 64)
+	if err == nil {
+		return i, nil
+	}
+	if u, uerr := strconv.ParseUint(s, base, 64); uerr == nil {
+		return u, nil
+	}
+	return nil, err
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUintKind(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uint64
+}
+
+// Sets an int64 or uint64 value to the given int or uint field.
+func setConfigInteger(field reflect.Value, value interface{}) error {
+	overflows := errors.New("value overflows")
+	switch v := value.(type) {
+	case int64:
+		if isIntKind(field.Kind()) {
+			if field.OverflowInt(v) {
+				return overflows
+			}
+			field.SetInt(v)
+			return nil
+		}
+		if v < 0 {
+			return errors.New("negative value for an unsigned field")
+		}
+		if field.OverflowUint(uint64(v)) {
+			return overflows
+		}
+		field.SetUint(uint64(v))
+	case uint64:
+		if isUintKind(field.Kind()) {
+			if field.OverflowUint(v) {
+				return overflows
+			}
+			field.SetUint(v)
+			return nil
+		}
+		if v > math.MaxInt64 || field.OverflowInt(int64(v)) {
+			return overflows
+		}
+		field.SetInt(int64(v))
+	}
+	return nil
+}
+
+// Converts a comma-separated value to a slice of the given type.
+// Whitespace around elements is trimmed and empty elements are dropped.
+func parseConfigList(value interface{}, typ reflect.Type) (reflect.Value, error) {
+	result := reflect.MakeSlice(typ, 0, 5)
+	for _, elm := range strings.Split(fmt.Sprint(value), ",") {
+		elm = strings.TrimSpace(elm)
+		if len(elm) == 0 {
+			continue
+		}
+		v := reflect.New(typ.Elem()).Elem()
+		switch {
+		case typ.Elem() == durationType:
+			d, err := time.ParseDuration(elm)
+			if err != nil {
+				return result, err
+			}
+			v.SetInt(int64(d))
+		case v.Kind() == reflect.String:
+			v.SetString(elm)
+		case isIntKind(v.Kind()) || isUintKind(v.Kind()):
+			i, err := parseConfigInteger(elm)
+			if err == nil {
+				err = setConfigInteger(v, i)
+			}
+			if err != nil {
+				return result, err
+			}
+		case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+			f, err := strconv.ParseFloat(elm, 64)
+			if err != nil {
+				return result, err
+			}
+			v.SetFloat(f)
+		case v.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(elm)
+			if err != nil {
+				return result, err
+			}
+			v.SetBool(b)
+		default:
+			return result, errors.New(fmt.Sprintf("unsupported list type: %v", typ))
+		}
+		result = reflect.Append(result, v)
 	}
 	return result, nil
 }
 
+// ConfigMappingError is an error that occurs when a value can not be mapped to a struct field.
+type ConfigMappingError struct {
+	Section string
+	Key     string
+	// A type of the struct field
+	Expected reflect.Type
+	// A type of the value in the configuration file
+	Actual reflect.Type
+	// An underlying error, if any
+	Err error
+}
+
+func (e *ConfigMappingError) Error() string {
+	msg := fmt.Sprintf("config: can not map %v.%v: expected %v, but got %v", e.Section, e.Key, e.Expected, e.Actual)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ConfigMappingError) Unwrap() error {
+	return e.Err
+}
+
+// Maps values in the given section to fields of the given struct pointer.
+// Comma-separated values are mapped to slice fields([]string, []int, []time.Duration, etc).
+// Mapping causes panic when values can not be mapped to struct fields.
 func (cc ConfigContainer) Mapping(section string, sdata interface{}) {
+	if err := cc.MappingE(section, sdata); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Same as Mapping, but returns an error instead of causing panic.
+// All mismatches in the section are reported as ConfigMappingError objects joined by errors.Join.
+// Values for unexported fields are ignored.
+func (cc ConfigContainer) MappingE(section string, sdata interface{}) error {
 	mdata := cc[section]
 	vt := reflect.ValueOf(sdata).Elem()
 	tt := reflect.TypeOf(sdata).Elem()
+	var errs []error
 	for i := 0; i < vt.NumField(); i += 1 {
-		if value, ok := mdata[tt.Field(i).Name]; ok {
-			switch value.(type) {
-			case int64:
-				vt.Field(i).SetInt(value.(int64))
-			case float64:
-				vt.Field(i).SetFloat(value.(float64))
-			default:
-				vt.Field(i).Set(reflect.ValueOf(value))
+		value, ok := mdata[tt.Field(i).Name]
+		if !ok || !tt.Field(i).IsExported() {
+			// unexported fields can not be set, CheckUnknownKeys reports such keys.
+			continue
+		}
+		field := vt.Field(i)
+		mappingError := &ConfigMappingError{section, tt.Field(i).Name, field.Type(), reflect.TypeOf(value), nil}
+		switch {
+		case field.Kind() == reflect.Slice:
+			list, err := parseConfigList(value, field.Type())
+			if err != nil {
+				mappingError.Err = err
+				errs = append(errs, mappingError)
+				continue
 			}
+			field.Set(list)
+		case (mappingError.Actual == reflect.TypeOf(int64(0)) || mappingError.Actual == reflect.TypeOf(uint64(0))) &&
+			(isIntKind(field.Kind()) || isUintKind(field.Kind())):
+			if err := setConfigInteger(field, value); err != nil {
+				mappingError.Err = err
+				errs = append(errs, mappingError)
+			}
+		case mappingError.Actual == reflect.TypeOf(float64(0)) && (field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64):
+			field.SetFloat(value.(float64))
+		case mappingError.Actual.AssignableTo(field.Type()):
+			field.Set(reflect.ValueOf(value))
+		default:
+			errs = append(errs, mappingError)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns an error listing keys in the given section that do not correspond to
+// any exported fields of the given struct pointer, so keys that MappingE can not set
+// are reported.
+func (cc ConfigContainer) CheckUnknownKeys(section string, sdata interface{}) error {
+	tt := reflect.TypeOf(sdata).Elem()
+	fields := make(map[string]bool, tt.NumField())
+	for i := 0; i < tt.NumField(); i += 1 {
+		if tt.Field(i).IsExported() {
+			fields[tt.Field(i).Name] = true
 		}
 	}
+	var unknowns []string
+	for key := range cc[section] {
+		if !fields[key] {
+			unknowns = append(unknowns, key)
+		}
+	}
+	if len(unknowns) == 0 {
+		return nil
+	}
+	sort.Strings(unknowns)
+	return errors.New(fmt.Sprintf("config: unknown keys in section %v: %v", section, strings.Join(unknowns, ", ")))
 }
@@ -1,8 +1,12 @@
 package cidre
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -48,3 +52,180 @@ func TestConfig(t *testing.T) {
 		ParseIniFile(confFile, ConfigMapping{"yourconfig1", conf1})
 	}()
 }
+
+func TestConfigExpandEnv(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	confFile := filepath.Join(filepath.Dir(file), "_testdata", "env.ini")
+	os.Setenv("CIDRE_TEST_SECRET", "very secret")
+	defer os.Unsetenv("CIDRE_TEST_SECRET")
+	os.Unsetenv("CIDRE_TEST_MISSING")
+
+	container, err := ParseIniFileWithConfig(confFile, DefaultIniParseConfig(func(c *IniParseConfig) {
+		c.ExpandEnv = true
+	}))
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, "very secret", container["env"]["Secret"])
+	errorIfNotEqual(t, "default value", container["env"]["Missing"])
+	errorIfNotEqual(t, "${CIDRE_TEST_SECRET} costs $10", container["env"]["Escaped"])
+
+	container, _ = ParseIniFile(confFile)
+	errorIfNotEqual(t, "${CIDRE_TEST_SECRET}", container["env"]["Secret"])
+}
+
+type configListStruct struct {
+	Hosts    []string
+	Ports    []int
+	Timeouts []time.Duration
+	Single   []int
+}
+
+func TestConfigList(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	confFile := filepath.Join(filepath.Dir(file), "_testdata", "list.ini")
+	conf := &configListStruct{}
+	_, err := ParseIniFile(confFile, ConfigMapping{"list", conf})
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, "[a b c]", fmt.Sprint(conf.Hosts))
+	errorIfNotEqual(t, "[80 443]", fmt.Sprint(conf.Ports))
+	errorIfNotEqual(t, "[1s 2m0s]", fmt.Sprint(conf.Timeouts))
+	errorIfNotEqual(t, "[8080]", fmt.Sprint(conf.Single))
+}
+
+type configMismatchStruct struct {
+	ConfInt      int
+	ConfFloat    float64
+	ConfDuration time.Duration
+	ConfString   string
+	ConfInt8     int8
+	ConfList     []int
+}
+
+func TestConfigMappingE(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	directory := filepath.Dir(file)
+
+	conf1 := &configTest1Struct{}
+	_, err := ParseIniFileE(filepath.Join(directory, "_testdata", "test1.ini"), nil, ConfigMapping{"yourconfig1", conf1})
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, 1, conf1.ConfInt)
+	errorIfNotEqual(t, "foobar", conf1.ConfString)
+
+	conf2 := &configMismatchStruct{}
+	_, err = ParseIniFileE(filepath.Join(directory, "_testdata", "mismatch.ini"), nil, ConfigMapping{"mismatch", conf2})
+	if err == nil {
+		t.Fatal("should return an error when type missmatch")
+	}
+	for _, expected := range []string{
+		"mismatch.ConfInt: expected int, but got string",
+		"mismatch.ConfFloat: expected float64, but got bool",
+		"mismatch.ConfDuration: expected time.Duration, but got float64",
+		"mismatch.ConfString: expected string, but got time.Duration",
+		"mismatch.ConfInt8: expected int8, but got int64: value overflows",
+		"mismatch.ConfList: expected []int, but got string: strconv.ParseInt",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error message should contain '%v', but got '%v'", expected, err.Error())
+		}
+	}
+	var mappingError *ConfigMappingError
+	if !errors.As(err, &mappingError) {
+		t.Error("error should be a ConfigMappingError")
+	}
+}
+
+func TestConfigStrict(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	confFile := filepath.Join(filepath.Dir(file), "_testdata", "test1.ini")
+
+	conf1 := &configTest1Struct{}
+	_, err := ParseIniFile(confFile, ConfigMapping{"yourconfig3", conf1})
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, 3, conf1.ConfInt)
+
+	strict := DefaultIniParseConfig(func(c *IniParseConfig) {
+		c.Strict = true
+	})
+	_, err = ParseIniFileWithConfig(confFile, strict, ConfigMapping{"yourconfig1", conf1})
+	errorIfNotEqual(t, nil, err)
+	_, err = ParseIniFileWithConfig(confFile, strict, ConfigMapping{"yourconfig3", conf1})
+	if err == nil || !strings.Contains(err.Error(), "Typ0Key") {
+		t.Errorf("strict mode should report unknown keys, but got %v", err)
+	}
+	_, err = ParseIniFileE(confFile, strict, ConfigMapping{"yourconfig3", conf1})
+	if err == nil || !strings.Contains(err.Error(), "yourconfig3: Typ0Key") {
+		t.Errorf("strict mode should report unknown keys, but got %v", err)
+	}
+
+	unexported := &struct {
+		Name   string
+		secret string
+	}{}
+	cc := ConfigContainer{"section1": {"Name": "name", "secret": "s"}}
+	errorIfNotEqual(t, nil, cc.MappingE("section1", unexported))
+	errorIfNotEqual(t, "name", unexported.Name)
+	errorIfNotEqual(t, "", unexported.secret)
+	err = cc.CheckUnknownKeys("section1", unexported)
+	if err == nil || !strings.Contains(err.Error(), "secret") {
+		t.Errorf("unexported fields should be reported as unknown keys, but got %v", err)
+	}
+}
+
+func TestConfigParseIniFiles(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	directory := filepath.Join(filepath.Dir(file), "_testdata")
+	files := []string{
+		filepath.Join(directory, "base.ini"),
+		filepath.Join(directory, "missing.ini"),
+		filepath.Join(directory, "override.ini"),
+	}
+
+	conf1 := &configTest1Struct{}
+	if _, err := ParseIniFiles(files, ConfigMapping{"yourconfig1", conf1}); err == nil {
+		t.Error("should return an error if files are missing")
+	}
+
+	cc, err := ParseIniFilesWithConfig(files, DefaultIniParseConfig(func(c *IniParseConfig) {
+		c.SkipMissingFiles = true
+	}), ConfigMapping{"yourconfig1", conf1})
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, 1, conf1.ConfInt)
+	errorIfNotEqual(t, 1.5, conf1.ConfFloat)
+	errorIfNotEqual(t, "override", conf1.ConfString)
+	errorIfNotEqual(t, 3, len(cc["yourconfig1"]))
+}
+
+type configIntegerStruct struct {
+	ConfHex         int
+	ConfNegativeHex int
+	ConfOctal       int
+	ConfBinary      int
+	ConfDecimal     int
+	ConfUint        uint
+	ConfUint64      uint64
+	ConfUints       []uint8
+}
+
+func TestConfigIntegers(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	confFile := filepath.Join(filepath.Dir(file), "_testdata", "integer.ini")
+	conf := &configIntegerStruct{}
+	_, err := ParseIniFileE(confFile, nil, ConfigMapping{"integer", conf})
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, 255, conf.ConfHex)
+	errorIfNotEqual(t, -16, conf.ConfNegativeHex)
+	errorIfNotEqual(t, 15, conf.ConfOctal)
+	errorIfNotEqual(t, 5, conf.ConfBinary)
+	errorIfNotEqual(t, 10, conf.ConfDecimal)
+	errorIfNotEqual(t, uint(42), conf.ConfUint)
+	errorIfNotEqual(t, uint64(0xffffffffffffffff), conf.ConfUint64)
+	errorIfNotEqual(t, "[1 2 3]", fmt.Sprint(conf.ConfUints))
+
+	_, err = ParseIniFileE(confFile, nil, ConfigMapping{"negative", conf})
+	if err == nil || !strings.Contains(err.Error(), "negative.ConfUint: expected uint, but got int64: negative value") {
+		t.Errorf("should return an error for a negative value into an unsigned field, but got %v", err)
+	}
+	_, err = ParseIniFileE(confFile, nil, ConfigMapping{"integer", &struct{ ConfUint64 int64 }{}})
+	if err == nil || !strings.Contains(err.Error(), "value overflows") {
+		t.Errorf("should return an error for an overflowed value, but got %v", err)
+	}
+}
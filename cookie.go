@@ -0,0 +1,56 @@
+package cidre
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Sets a cookie that has the value signed with the given secret.
+// Attributes of the cookie(Path, Domain, Expires, MaxAge, Secure, HttpOnly and SameSite) are
+// copied from the opts. If the opts is nil, the cookie has the Path "/" and the HttpOnly attribute.
+// Values are encoded with base64, so they can contain any characters. Signatures cover the name
+// of the cookie, so values can not be moved to other cookies signed with the same secret.
+//
+//     ctx.SetSignedCookie(w, "remember_token", token, secret, &http.Cookie{
+//         Path:     "/",
+//         MaxAge:   30 * 24 * 60 * 60,
+//         Secure:   true,
+//         HttpOnly: true,
+//         SameSite: http.SameSiteLaxMode,
+//     })
+func (ctx *Context) SetSignedCookie(w http.ResponseWriter, name, value, secret string, opts *http.Cookie) {
+	cookie := &http.Cookie{Path: "/", HttpOnly: true}
+	if opts != nil {
+		c := *opts
+		cookie = &c
+	}
+	cookie.Name = name
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	signed := SignString(name+signatureSeparator+encoded, secret)
+	cookie.Value = signed[:strings.Index(signed, signatureSeparator)] + signatureSeparator + encoded
+	http.SetCookie(w, cookie)
+}
+
+// Returns a value of the cookie set by SetSignedCookie.
+// SignedCookie returns http.ErrNoCookie if the cookie does not exist, and
+// an error if the cookie has an invalid signature.
+func (ctx *Context) SignedCookie(r *http.Request, name, secret string) (string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(cookie.Value, signatureSeparator, 2)
+	if len(parts) != 2 {
+		return "", errors.New("data is malformed")
+	}
+	if _, err := ValidateSignedString(parts[0]+signatureSeparator+name+signatureSeparator+parts[1], secret); err != nil {
+		return "", err
+	}
+	value, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("data is malformed")
+	}
+	return string(value), nil
+}
@@ -0,0 +1,70 @@
+package cidre
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContextSignedCookie(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Get("set", "set", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).SetSignedCookie(w, "token", "a value; with=symbols", "secret", &http.Cookie{
+			Path:     "/app",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.Write([]byte("ok"))
+	})
+	root.Get("get", "get", func(w http.ResponseWriter, r *http.Request) {
+		value, err := RequestContext(r).SignedCookie(r, "token", "secret")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(value))
+	})
+
+	writer := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/set", nil)
+	app.ServeHTTP(writer, req)
+	header := writer.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Path=/app", "Secure", "HttpOnly", "SameSite=Strict"} {
+		if !strings.Contains(header, "; "+attr) {
+			t.Errorf("Set-Cookie should contain '%v', but got '%v'", attr, header)
+		}
+	}
+	cookie := writer.Result().Cookies()[0]
+
+	writer = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/get", nil)
+	req.AddCookie(cookie)
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "a value; with=symbols", writer.Body.String())
+
+	tampered := *cookie
+	tampered.Value = SignString("dGFtcGVyZWQ", "other secret")
+	writer = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/get", nil)
+	req.AddCookie(&tampered)
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, http.StatusBadRequest, writer.Code)
+	errorIfNotEqual(t, "data is tampered\n", writer.Body.String())
+
+	// values signed for other cookies are rejected.
+	renamed := *cookie
+	renamed.Name = "other"
+	req, _ = http.NewRequest("GET", "/get", nil)
+	req.AddCookie(&renamed)
+	_, err := NewContext(app, "id", req).SignedCookie(req, "other", "secret")
+	errorIfNotEqual(t, "data is tampered", err.Error())
+
+	writer = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/get", nil)
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, http.ErrNoCookie.Error()+"\n", writer.Body.String())
+}
@@ -0,0 +1,153 @@
+package cidre
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Maximum size of a cookie(name, value and attributes) that browsers must accept.
+const MaxCookieSize = 4096
+
+// SessionCookieEncoder is an optional interface for SessionStores that store whole sessions in
+// cookies. If a SessionStore implements this interface, the SessionMiddleware writes a value
+// returned by EncodeSession to the cookie instead of the session id, and passes the cookie value
+// to the Load method. The GC goroutine is not started for such stores.
+// If EncodeSession fails or the cookie exceeds MaxCookieSize, the SessionMiddleware
+// calls App.OnSessionError, and the rest of the response written by the handler is dropped.
+type SessionCookieEncoder interface {
+	EncodeSession(*Session) (string, error)
+}
+
+// CookieSessionStoreConfig is a configuration object for the CookieSessionStore
+type CookieSessionStoreConfig struct {
+	// A key used to encrypt sessions with AES-GCM. Sessions are only signed if this value is empty.
+	// default: ""
+	EncryptionKey string
+}
+
+// Returns a CookieSessionStoreConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the CookieSessionStoreConfig object.
+func DefaultCookieSessionStoreConfig(init ...func(*CookieSessionStoreConfig)) *CookieSessionStoreConfig {
+	self := &CookieSessionStoreConfig{
+		EncryptionKey: "",
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+// CookieSessionStore is a SessionStore that stores whole sessions in signed(and optionally encrypted)
+// cookies instead of server-side storage. Sessions are serialized with encoding/gob, so types of
+// values stored in sessions other than basic types must be registered by gob.Register.
+// Sessions must fit in a cookie(MaxCookieSize).
+//
+//     app.Use(cidre.NewSessionMiddleware(app, cidre.DefaultSessionConfig(func(c *cidre.SessionConfig) {
+//         c.Secret = "secret"
+//         c.SessionStore = "cidre.CookieSessionStore"
+//     }), cidre.DefaultCookieSessionStoreConfig(func(c *cidre.CookieSessionStoreConfig) {
+//         c.EncryptionKey = "encryption key"
+//     })))
+type CookieSessionStore struct {
+	sync.Mutex
+	middleware *SessionMiddleware
+	config     *CookieSessionStoreConfig
+	aead       cipher.AEAD
+}
+
+func (cs *CookieSessionStore) Init(middleware *SessionMiddleware, cfg interface{}) {
+	cs.middleware = middleware
+	config, ok := cfg.(*CookieSessionStoreConfig)
+	if !ok || config == nil {
+		config = DefaultCookieSessionStoreConfig()
+	}
+	cs.config = config
+	if len(config.EncryptionKey) != 0 {
+		key := sha256.Sum256([]byte(config.EncryptionKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			panic(err)
+		}
+		cs.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (cs *CookieSessionStore) Exists(sessionId string) bool {
+	return false
+}
+
+func (cs *CookieSessionStore) NewSession() *Session {
+	return NewSession(GenerateRandomId(sessionIdBytes))
+}
+
+func (cs *CookieSessionStore) Save(*Session) { /* Nothing to do */ }
+
+// Decodes the given cookie value. Load returns nil if the value is malformed or
+// the session has been expired.
+func (cs *CookieSessionStore) Load(value string) *Session {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	if cs.aead != nil {
+		size := cs.aead.NonceSize()
+		if len(data) < size {
+			return nil
+		}
+		data, err = cs.aead.Open(nil, data[:size], data[size:], nil)
+		if err != nil {
+			return nil
+		}
+	}
+	session, err := decodeSession(data)
+	if err != nil {
+		return nil
+	}
+	if time.Now().Sub(session.LastAccessTime) > cs.middleware.Config.sessionLifeTime(session) {
+		return nil
+	}
+	return session
+}
+
+// Encodes the session into a cookie value. EncodeSession returns an error if
+// the session can not be serialized or the cookie exceeds MaxCookieSize.
+func (cs *CookieSessionStore) EncodeSession(session *Session) (string, error) {
+	data, err := encodeSession(session)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("CookieSessionStore: failed to encode the session: %v", err))
+	}
+	if cs.aead != nil {
+		nonce := make([]byte, cs.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		data = cs.aead.Seal(nonce, nonce, data, nil)
+	}
+	value := base64.RawURLEncoding.EncodeToString(data)
+	config := cs.middleware.Config
+	if size := len(config.FullCookieName()) + len(SignString(value, config.signingSecret())); size > MaxCookieSize {
+		return "", errors.New(fmt.Sprintf("CookieSessionStore: the session cookie is too large(%v bytes, max %v bytes).", size, MaxCookieSize))
+	}
+	return value, nil
+}
+
+func (cs *CookieSessionStore) Delete(sessionId string) { /* Nothing to do */ }
+
+// Always returns 0, sessions are not stored on the server side.
+func (cs *CookieSessionStore) Count() int {
+	return 0
+}
+
+func (cs *CookieSessionStore) Gc() { /* Nothing to do */ }
@@ -0,0 +1,120 @@
+package cidre
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newCookieSessionTestApp(storeConfig *CookieSessionStoreConfig) (*App, *SessionMiddleware, *[]string) {
+	app := NewApp(DefaultAppConfig())
+	logs := &[]string{}
+	app.Logger = func(level LogLevel, message string) {
+		*logs = append(*logs, message)
+	}
+	app.AccessLogger = func(LogLevel, string) {}
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.SessionStore = "cidre.CookieSessionStore"
+	}), storeConfig)
+	app.Use(sm)
+	root := app.MountPoint("/")
+	root.Get("set", "set", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		session.Set("name", r.URL.Query().Get("name"))
+		session.Set("count", 10)
+		session.AddFlash("info", "saved")
+		fmt.Fprint(w, "ok")
+	})
+	root.Get("get", "get", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		fmt.Fprintf(w, "%v:%v:%v", session.GetString("name"), session.GetOr("count", 0), session.Flash("info"))
+	})
+	return app, sm, logs
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	for _, storeConfig := range []*CookieSessionStoreConfig{nil, DefaultCookieSessionStoreConfig(func(c *CookieSessionStoreConfig) {
+		c.EncryptionKey = "key"
+	})} {
+		app, sm, _ := newCookieSessionTestApp(storeConfig)
+		_, ok := sm.Store.(*CookieSessionStore)
+		errorIfNotEqual(t, true, ok)
+		client := NewTestClient(app)
+
+		res := client.Get("/set?name=alice")
+		errorIfNotEqual(t, http.StatusOK, res.Status)
+		res = client.Get("/get")
+		errorIfNotEqual(t, "alice:10:[saved]", res.String())
+		res = client.Get("/get")
+		errorIfNotEqual(t, "alice:10:[]", res.String())
+		errorIfNotEqual(t, 0, sm.Store.Count())
+
+		cookies := client.Jar.Cookies(&url.URL{Scheme: "http", Host: "example.com"})
+		errorIfNotEqual(t, 1, len(cookies))
+		value, _ := ValidateSignedString(cookies[0].Value, "secret")
+		data, _ := base64.RawURLEncoding.DecodeString(value)
+		errorIfNotEqual(t, storeConfig == nil, bytes.Contains(data, []byte("alice")))
+		errorIfNotEqual(t, true, sm.Store.Load(value) != nil)
+		errorIfNotEqual(t, true, sm.Store.Load("!invalid") == nil)
+		errorIfNotEqual(t, true, sm.Store.Load(value[:len(value)/2]) == nil)
+	}
+}
+
+func TestCookieSessionStoreTampered(t *testing.T) {
+	app, _, _ := newCookieSessionTestApp(nil)
+	client := NewTestClient(app)
+	client.Get("/set?name=alice")
+
+	cookies := client.Jar.Cookies(&url.URL{Scheme: "http", Host: "example.com"})
+	req := client.NewRequest("GET", "/get", nil)
+	tampered := "0"
+	if cookies[0].Value[0] == '0' {
+		tampered = "1"
+	}
+	req.AddCookie(&http.Cookie{Name: cookies[0].Name, Value: tampered + cookies[0].Value[1:]})
+	res := NewTestClient(app).Do(req)
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, ":0:[]", res.String())
+	errorIfNotEqual(t, 1, len(res.Header.Values("Set-Cookie")))
+}
+
+func TestCookieSessionStoreTooLarge(t *testing.T) {
+	app, _, logs := newCookieSessionTestApp(nil)
+	client := NewTestClient(app)
+	res := client.Get("/set?name=" + strings.Repeat("a", MaxCookieSize))
+	errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+	errorIfNotEqual(t, "Internal Server Error\n", res.String())
+	errorIfNotEqual(t, 0, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, 1, len(*logs))
+	errorIfNotEqual(t, true, strings.HasPrefix((*logs)[0], "session error: CookieSessionStore: the session cookie is too large"))
+
+	// attributes are counted in the cookie size.
+	statuses := map[int]bool{}
+	for n := 2500; n < 2600; n += 2 {
+		res = client.Get(fmt.Sprintf("/set?name=%v", strings.Repeat("a", n)))
+		statuses[res.Status] = true
+		if cookies := res.Header.Values("Set-Cookie"); len(cookies) != 0 && len(cookies[0]) > MaxCookieSize {
+			t.Errorf("the session cookie is too large(%v bytes)", len(cookies[0]))
+		}
+	}
+	errorIfNotEqual(t, true, statuses[http.StatusOK] && statuses[http.StatusInternalServerError])
+}
+
+func TestCookieSessionStoreEncodeError(t *testing.T) {
+	app, _, logs := newCookieSessionTestApp(nil)
+	app.MountPoint("/").Get("unencodable", "unencodable", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("func", func() {})
+		fmt.Fprint(w, "ok")
+	})
+	res := NewTestClient(app).Get("/unencodable")
+	errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+	errorIfNotEqual(t, "Internal Server Error\n", res.String())
+	errorIfNotEqual(t, 0, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, 1, len(*logs))
+	errorIfNotEqual(t, true, strings.HasPrefix((*logs)[0], "session error: CookieSessionStore: failed to encode the session"))
+}
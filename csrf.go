@@ -0,0 +1,188 @@
+package cidre
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// CsrfConfig is a configuration object for the CsrfMiddleware
+type CsrfConfig struct {
+	// A name of the form field that contains the token.
+	// default: "_csrf"
+	FormField string
+	// A name of the request header that contains the token.
+	// default: "X-CSRF-Token"
+	HeaderName string
+	// A session key to store the token.
+	// default: "_csrf_token"
+	SessionKey string
+	// A function to be called if the token is missing or invalid.
+	// default: responds with 403 Forbidden
+	OnFailure func(http.ResponseWriter, *http.Request)
+}
+
+// Returns a CsrfConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the CsrfConfig object.
+func DefaultCsrfConfig(init ...func(*CsrfConfig)) *CsrfConfig {
+	self := &CsrfConfig{
+		FormField:  "_csrf",
+		HeaderName: "X-CSRF-Token",
+		SessionKey: "_csrf_token",
+		OnFailure:  nil,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+// Route.Meta key to disable CSRF protection for the route(e.g. webhook endpoints).
+//
+//     root.Post("webhook", "webhook", handler).Meta.Set(cidre.MetaCsrfExempt, true)
+const MetaCsrfExempt = "csrf_exempt"
+
+const csrfContextKey = "cidre.csrf"
+
+var csrfMethods = map[string]bool{"POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+
+// Middleware for CSRF protection. CsrfMiddleware stores a random token in the session and
+// rejects POST, PUT, PATCH and DELETE requests that do not have the token in the form field or
+// the request header. The CsrfMiddleware must be used after the SessionMiddleware.
+//
+// Templates rendered by the HtmlTemplateRenderer can embed the token with `csrf_token` and
+// `csrf_field` functions:
+//
+//     <form method="post">
+//       {{csrf_field}}
+//     </form>
+//
+// The token is bound to the session, so a new token is issued when the session is killed and
+// a new session is created. Call Rotate(or RotateCsrfToken) after logins to issue a new token
+// for the same session. Tokens can not be checked without sessions, so POST, PUT, PATCH and DELETE
+// requests to routes that have the MetaSessionExempt are rejected unless the routes also have
+// the MetaCsrfExempt.
+type CsrfMiddleware struct {
+	app    *App
+	Config *CsrfConfig
+}
+
+// Returns a new CsrfMiddleware object.
+func NewCsrfMiddleware(app *App, config *CsrfConfig) *CsrfMiddleware {
+	cm := &CsrfMiddleware{app: app, Config: config}
+	if cm.Config.OnFailure == nil {
+		cm.Config.OnFailure = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	}
+	return cm
+}
+
+func (cm *CsrfMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(r)
+	if !ctx.IsDynamicRoute() {
+		ctx.MiddlewareChain.DoNext(w, r)
+		return
+	}
+	if ctx.Route.Meta.GetBool(MetaSessionExempt) {
+		// tokens can not be checked without sessions.
+		if csrfMethods[r.Method] && !ctx.Route.Meta.GetBool(MetaCsrfExempt) {
+			cm.Config.OnFailure(w, r)
+			return
+		}
+		ctx.MiddlewareChain.DoNext(w, r)
+		return
+	}
+	if ctx.Session == nil {
+		panic("CsrfMiddleware requires the SessionMiddleware.")
+	}
+	ctx.Set(csrfContextKey, cm)
+	if csrfMethods[r.Method] && !ctx.Route.Meta.GetBool(MetaCsrfExempt) && !cm.validate(ctx) {
+		cm.Config.OnFailure(w, r)
+		return
+	}
+	ctx.MiddlewareChain.DoNext(w, r)
+}
+
+func (cm *CsrfMiddleware) validate(ctx *Context) bool {
+	expected := ctx.Session.GetString(cm.Config.SessionKey)
+	if len(expected) == 0 {
+		return false
+	}
+	r := ctx.Request
+	token := r.Header.Get(cm.Config.HeaderName)
+	if len(token) == 0 {
+		if isMultipartRequest(r) {
+			if err := ctx.parseMultipartForm(); err != nil {
+				return false
+			}
+		}
+		token = r.PostFormValue(cm.Config.FormField)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Returns the CSRF token of the session. Token creates a new token if the session does not have one.
+func (cm *CsrfMiddleware) Token(ctx *Context) string {
+	if token := ctx.Session.GetString(cm.Config.SessionKey); len(token) != 0 {
+		return token
+	}
+	token := GenerateRandomId(sessionIdBytes)
+	ctx.Session.Set(cm.Config.SessionKey, token)
+	return token
+}
+
+// Replaces the CSRF token of the session with a new one and returns the new token.
+// Call Rotate when the privilege of the session changes, e.g. after users log in,
+// so that tokens issued before are no longer accepted.
+func (cm *CsrfMiddleware) Rotate(ctx *Context) string {
+	ctx.Session.Del(cm.Config.SessionKey)
+	return cm.Token(ctx)
+}
+
+// Returns a hidden input element that contains the CSRF token.
+func (cm *CsrfMiddleware) Field(ctx *Context) template.HTML {
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		template.HTMLEscapeString(cm.Config.FormField), template.HTMLEscapeString(cm.Token(ctx))))
+}
+
+// Returns the CSRF token of the request. CsrfToken returns an empty string if
+// the request has not been passed through a CsrfMiddleware.
+func CsrfToken(r *http.Request) string {
+	ctx := RequestContext(r)
+	if cm, ok := ctx.Get(csrfContextKey).(*CsrfMiddleware); ok {
+		return cm.Token(ctx)
+	}
+	return ""
+}
+
+// Replaces the CSRF token of the request with a new one and returns the new token.
+// RotateCsrfToken returns an empty string if the request has not been passed through a CsrfMiddleware.
+//
+//     ctx.Session.Set("user_id", user.Id)
+//     cidre.RotateCsrfToken(r)
+func RotateCsrfToken(r *http.Request) string {
+	ctx := RequestContext(r)
+	if cm, ok := ctx.Get(csrfContextKey).(*CsrfMiddleware); ok {
+		return cm.Rotate(ctx)
+	}
+	return ""
+}
+
+// Returns template functions that embed the CSRF token of the request, or nil
+// if the request has not been passed through a CsrfMiddleware.
+func csrfTemplateFuncs(ctx *Context) template.FuncMap {
+	if ctx == nil {
+		return nil
+	}
+	cm, ok := ctx.Get(csrfContextKey).(*CsrfMiddleware)
+	if !ok {
+		return nil
+	}
+	return template.FuncMap{
+		"csrf_token": func() string { return cm.Token(ctx) },
+		"csrf_field": func() template.HTML { return cm.Field(ctx) },
+	}
+}
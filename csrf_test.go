@@ -0,0 +1,108 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newCsrfTestApp() *App {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	app.Renderer = NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(func(c *HtmlTemplateRendererConfig) {
+		c.TemplateFS = fstest.MapFS{
+			"form.tpl": &fstest.MapFile{Data: []byte(`<form>{{ csrf_field }}</form><p>{{ csrf_token }}</p>`)},
+		}
+	}))
+	app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), nil))
+	app.Use(NewCsrfMiddleware(app, DefaultCsrfConfig()))
+	root := app.MountPoint("/")
+	root.Get("form", "form", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).App.Renderer.Html(w, "form", nil)
+	})
+	root.Get("token", "token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, CsrfToken(r))
+	})
+	root.Post("login", "login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RotateCsrfToken(r))
+	})
+	root.Post("save", "save", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "saved")
+	})
+	root.Post("webhook", "webhook", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "received")
+	}).Meta.Set(MetaCsrfExempt, true)
+	api := root.Post("api", "api", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "api")
+	})
+	api.Meta.Set(MetaSessionExempt, true)
+	api.Meta.Set(MetaCsrfExempt, true)
+	root.Post("api_unsafe", "api_unsafe", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "api")
+	}).Meta.Set(MetaSessionExempt, true)
+	root.Get("metrics", "metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metrics")
+	}).Meta.Set(MetaSessionExempt, true)
+	app.Setup()
+	return app
+}
+
+func TestCsrfMiddleware(t *testing.T) {
+	app := newCsrfTestApp()
+	client := NewTestClient(app)
+
+	res := client.PostForm("/save", url.Values{})
+	errorIfNotEqual(t, http.StatusForbidden, res.Status)
+
+	res = client.Get("/form")
+	matches := regexp.MustCompile(`<input type="hidden" name="_csrf" value="([^"]+)"></form><p>([^<]+)</p>`).FindStringSubmatch(res.String())
+	if matches == nil {
+		t.Fatalf("form should contain a CSRF token, but got '%v'", res.String())
+	}
+	token := matches[1]
+	errorIfNotEqual(t, token, matches[2])
+	errorIfNotEqual(t, token, client.Get("/token").String())
+
+	res = client.PostForm("/save", url.Values{"_csrf": {"invalid"}})
+	errorIfNotEqual(t, http.StatusForbidden, res.Status)
+	res = client.PostForm("/save", url.Values{"_csrf": {token}})
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "saved", res.String())
+
+	req := client.NewRequest("POST", "/save", strings.NewReader(""))
+	req.Header.Set("X-CSRF-Token", token)
+	res = client.Do(req)
+	errorIfNotEqual(t, "saved", res.String())
+
+	// tokens are rotated without changing sessions
+	res = client.PostForm("/login", url.Values{"_csrf": {token}})
+	rotated := res.String()
+	if len(rotated) == 0 || rotated == token {
+		t.Errorf("a new token should be issued, but got '%v'", rotated)
+	}
+	errorIfNotEqual(t, http.StatusForbidden, client.PostForm("/save", url.Values{"_csrf": {token}}).Status)
+	errorIfNotEqual(t, http.StatusOK, client.PostForm("/save", url.Values{"_csrf": {rotated}}).Status)
+	token = rotated
+
+	// tokens are bound to sessions
+	res = NewTestClient(app).PostForm("/save", url.Values{"_csrf": {token}})
+	errorIfNotEqual(t, http.StatusForbidden, res.Status)
+
+	res = NewTestClient(app).PostForm("/webhook", url.Values{})
+	errorIfNotEqual(t, "received", res.String())
+
+	// routes without sessions must disable CSRF protection explicitly
+	res = NewTestClient(app).PostForm("/api", url.Values{})
+	errorIfNotEqual(t, "api", res.String())
+	res = NewTestClient(app).PostForm("/api_unsafe", url.Values{})
+	errorIfNotEqual(t, http.StatusForbidden, res.Status)
+	res = NewTestClient(app).Get("/metrics")
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "metrics", res.String())
+}
@@ -0,0 +1,164 @@
+package cidre
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// EtagConfig is a configuration object for the EtagMiddleware
+type EtagConfig struct {
+	// Maximum size of a response body to be buffered. Responses larger than this value are
+	// written through without an ETag.
+	// default: 1MB
+	MaxBodySize int
+	// Generates weak ETags if true.
+	// default: false
+	Weak bool
+}
+
+// Returns an EtagConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the EtagConfig object.
+func DefaultEtagConfig(init ...func(*EtagConfig)) *EtagConfig {
+	self := &EtagConfig{
+		MaxBodySize: 1024 * 1024,
+		Weak:        false,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+// Middleware that adds ETag headers to dynamic responses and responds with
+// 304 Not Modified if the request's If-None-Match header matches.
+//
+// EtagMiddleware buffers 200 responses for GET and HEAD requests and computes a SHA1
+// hash of the body. Responses that already have an ETag header, a Content-Range header or a
+// "Cache-Control: no-store" header are written through.
+//
+// ETags are computed on the body written by inner middlewares, so
+// EtagMiddleware should be placed after(inside) middlewares that encode
+// the body such as compression middlewares. Otherwise you should use weak ETags.
+type EtagMiddleware struct {
+	Config *EtagConfig
+}
+
+// Returns a new EtagMiddleware object.
+func NewEtagMiddleware(config *EtagConfig) *EtagMiddleware {
+	return &EtagMiddleware{Config: config}
+}
+
+func (em *EtagMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		ctx.MiddlewareChain.DoNext(w, r)
+		return
+	}
+	ew := &etagResponseWriter{ResponseWriter: w.(ResponseWriter), config: em.Config}
+	ctx.MiddlewareChain.DoNext(ew, r)
+	ew.finish(r)
+}
+
+type etagResponseWriter struct {
+	ResponseWriter
+	config      *EtagConfig
+	buf         bytes.Buffer
+	status      int
+	passThrough bool
+}
+
+func (w *etagResponseWriter) skip() bool {
+	header := w.Header()
+	return len(header.Get("ETag")) != 0 || len(header.Get("Content-Range")) != 0 ||
+		strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-store")
+}
+
+func (w *etagResponseWriter) startPassThrough() {
+	w.passThrough = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+func (w *etagResponseWriter) WriteHeader(status int) {
+	if w.passThrough {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status != http.StatusOK || w.skip() {
+		w.startPassThrough()
+	}
+}
+
+func (w *etagResponseWriter) Write(b []byte) (int, error) {
+	if !w.passThrough && w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.passThrough && w.buf.Len()+len(b) > w.config.MaxBodySize {
+		w.startPassThrough()
+	}
+	if w.passThrough {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+func (w *etagResponseWriter) Status() int {
+	if w.passThrough {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *etagResponseWriter) finish(r *http.Request) {
+	if w.passThrough {
+		return
+	}
+	if w.skip() {
+		w.startPassThrough()
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(w.buf.Bytes()))
+	if w.config.Weak {
+		etag = "W/" + etag
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+	}
+}
+
+// Returns true if the given If-None-Match header value matches the etag
+// using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newEtagTestApp(config *EtagConfig) *App {
+	app := NewApp(DefaultAppConfig())
+	app.Use(NewEtagMiddleware(config))
+	root := app.MountPoint("/")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "content")
+	}
+	root.Get("page1", "page1", handler)
+	root.Post("page1_post", "page1", handler)
+	root.Get("nostore", "nostore", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, "content")
+	})
+	root.Get("large", "large", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("a", 100))
+	})
+	return app
+}
+
+func TestEtagMiddleware(t *testing.T) {
+	app := newEtagTestApp(DefaultEtagConfig())
+
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	etag := writer.Header().Get("ETag")
+	errorIfNotEqual(t, `"040f06fd774092478d450774f5ba30c5da78acc8"`, etag)
+	AssertStatus(t, 200, writer)
+	errorIfNotEqual(t, "content", writer.Body.String())
+
+	// match
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.Header.Set("If-None-Match", etag)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, 304, writer)
+	errorIfNotEqual(t, "", writer.Body.String())
+	AssertHeader(t, "ETag", etag, writer)
+
+	// mismatch
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.Header.Set("If-None-Match", `"other", "another"`)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, 200, writer)
+	errorIfNotEqual(t, "content", writer.Body.String())
+
+	// non-GET
+	req, _ = http.NewRequest("POST", "/page1", nil)
+	req.Header.Set("If-None-Match", etag)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, 200, writer)
+	AssertHeader(t, "ETag", "", writer)
+	errorIfNotEqual(t, "content", writer.Body.String())
+
+	// Cache-Control: no-store
+	req, _ = http.NewRequest("GET", "/nostore", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertHeader(t, "ETag", "", writer)
+	errorIfNotEqual(t, "content", writer.Body.String())
+}
+
+func TestEtagMiddlewareMaxBodySize(t *testing.T) {
+	app := newEtagTestApp(DefaultEtagConfig(func(c *EtagConfig) {
+		c.MaxBodySize = 10
+		c.Weak = true
+	}))
+	req, _ := http.NewRequest("GET", "/large", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertHeader(t, "ETag", "", writer)
+	errorIfNotEqual(t, 100, writer.Body.Len())
+
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertHeader(t, "ETag", `W/"040f06fd774092478d450774f5ba30c5da78acc8"`, writer)
+}
@@ -0,0 +1,210 @@
+package cidre
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSessionStoreConfig is a configuration object for the FileSessionStore
+type FileSessionStoreConfig struct {
+	// A directory where session files are stored. The directory is created if it does not exist.
+	// default: filepath.Join(os.TempDir(), "cidre-sessions")
+	Directory string
+	// File mode of session files.
+	// default: 0600
+	FileMode os.FileMode
+}
+
+// Returns a FileSessionStoreConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the FileSessionStoreConfig object.
+func DefaultFileSessionStoreConfig(init ...func(*FileSessionStoreConfig)) *FileSessionStoreConfig {
+	self := &FileSessionStoreConfig{
+		Directory: filepath.Join(os.TempDir(), "cidre-sessions"),
+		FileMode:  0600,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+const fileSessionPrefix = "sess_"
+
+// FileSessionStore is a SessionStore that stores sessions in files, so that processes on the
+// same machine can share sessions. Sessions are serialized with encoding/gob, so types of
+// values stored in sessions other than basic types must be registered by gob.Register.
+// Files are written atomically by renaming temporary files, and modification times
+// of files are used to expire sessions.
+//
+// The storeConfig argument of NewSessionMiddleware can be a *FileSessionStoreConfig or
+// a directory name.
+//
+//     app.Use(cidre.NewSessionMiddleware(app, cidre.DefaultSessionConfig(func(c *cidre.SessionConfig) {
+//         c.Secret = "secret"
+//         c.SessionStore = "cidre.FileSessionStore"
+//     }), "/var/lib/myapp/sessions"))
+type FileSessionStore struct {
+	sync.Mutex
+	middleware *SessionMiddleware
+	config     *FileSessionStoreConfig
+}
+
+func (fs *FileSessionStore) Init(middleware *SessionMiddleware, cfg interface{}) {
+	fs.middleware = middleware
+	switch v := cfg.(type) {
+	case *FileSessionStoreConfig:
+		fs.config = v
+	case string:
+		fs.config = DefaultFileSessionStoreConfig(func(c *FileSessionStoreConfig) { c.Directory = v })
+	default:
+		fs.config = DefaultFileSessionStoreConfig()
+	}
+	if err := os.MkdirAll(fs.config.Directory, 0700); err != nil {
+		panic(err)
+	}
+}
+
+func (fs *FileSessionStore) path(sessionId string) (string, error) {
+	if len(sessionId) == 0 || strings.Trim(sessionId, "0123456789abcdef") != "" {
+		return "", errors.New(fmt.Sprintf("Invalid session id: '%v'", sessionId))
+	}
+	return filepath.Join(fs.config.Directory, fileSessionPrefix+sessionId), nil
+}
+
+func (fs *FileSessionStore) NewSessionId() string {
+	return GenerateRandomId(sessionIdBytes)
+}
+
+func (fs *FileSessionStore) Exists(sessionId string) bool {
+	path, err := fs.path(sessionId)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (fs *FileSessionStore) NewSession() *Session {
+	return NewSession(fs.NewSessionId())
+}
+
+// Writes the session to a temporary file and renames it to the session file.
+// Errors are written to the App.Logger.
+func (fs *FileSessionStore) Save(session *Session) {
+	if err := fs.save(session); err != nil {
+		fs.middleware.app.log(LogLevelError, fmt.Sprintf("FileSessionStore: failed to save the session: %v", err))
+	}
+}
+
+func (fs *FileSessionStore) save(session *Session) error {
+	path, err := fs.path(session.Id)
+	if err != nil {
+		return err
+	}
+	data, err := encodeSession(session)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fs.config.Directory, ".tmp-"+fileSessionPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(fs.config.FileMode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Returns a session associated with the given id, or nil if the session
+// does not exist or has been expired.
+func (fs *FileSessionStore) Load(sessionId string) *Session {
+	path, err := fs.path(sessionId)
+	if err != nil {
+		return nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	session, err := decodeSession(data)
+	if err != nil {
+		return nil
+	}
+	if time.Now().Sub(stat.ModTime()) > fs.middleware.Config.sessionLifeTime(session) {
+		fs.Delete(sessionId)
+		return nil
+	}
+	return session
+}
+
+func (fs *FileSessionStore) Delete(sessionId string) {
+	if path, err := fs.path(sessionId); err == nil {
+		os.Remove(path)
+	}
+}
+
+func (fs *FileSessionStore) sessionFiles() []os.DirEntry {
+	entries, err := os.ReadDir(fs.config.Directory)
+	if err != nil {
+		return nil
+	}
+	result := make([]os.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), fileSessionPrefix) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (fs *FileSessionStore) Count() int {
+	return len(fs.sessionFiles())
+}
+
+// Removes session files that have not been modified for SessionConfig.LifeTime(or Session.MaxAge).
+func (fs *FileSessionStore) Gc() {
+	fs.GcSessions()
+}
+
+// Removes session files like Gc, and returns the removed sessions. Sessions that can not
+// be decoded are returned with only their ids.
+func (fs *FileSessionStore) GcSessions() []*Session {
+	removed := []*Session{}
+	for _, entry := range fs.sessionFiles() {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(fs.config.Directory, entry.Name())
+		session := NewSession(strings.TrimPrefix(entry.Name(), fileSessionPrefix))
+		if data, err := os.ReadFile(path); err == nil {
+			if decoded, err := decodeSession(data); err == nil {
+				session = decoded
+			}
+		}
+		if time.Now().Sub(info.ModTime()) > fs.middleware.Config.sessionLifeTime(session) {
+			if os.Remove(path) == nil {
+				removed = append(removed, session)
+			}
+		}
+	}
+	return removed
+}
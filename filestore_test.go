@@ -0,0 +1,127 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileSessionStore(t *testing.T) (*FileSessionStore, string) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	sm := NewSessionMiddleware(NewApp(DefaultAppConfig()), DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.SessionStore = "cidre.FileSessionStore"
+		c.LifeTime = time.Minute
+	}), dir)
+	return sm.Store.(*FileSessionStore), dir
+}
+
+func TestFileSessionStore(t *testing.T) {
+	store, _ := newTestFileSessionStore(t)
+	var wg sync.WaitGroup
+	ids := make([]string, 20)
+	for i := 0; i < len(ids); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := store.NewSession()
+			ids[i] = session.Id
+			for j := 0; j < 10; j++ {
+				session.Set("value", j)
+				session.AddFlash("info", fmt.Sprint(j))
+				store.Save(session)
+				loaded := store.Load(session.Id)
+				if loaded == nil {
+					t.Errorf("session %v should be loaded", session.Id)
+					return
+				}
+				errorIfNotEqual(t, j, loaded.GetInt("value"))
+			}
+		}(i)
+	}
+	wg.Wait()
+	errorIfNotEqual(t, len(ids), store.Count())
+
+	shared := store.Load(ids[1])
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			session := NewSession(shared.Id)
+			session.Set("value", i)
+			store.Save(session)
+		}()
+		go func() {
+			defer wg.Done()
+			if store.Load(shared.Id) == nil {
+				t.Error("a session file should not be torn")
+			}
+		}()
+	}
+	wg.Wait()
+
+	session := store.Load(ids[0])
+	errorIfNotEqual(t, 9, session.GetInt("value"))
+	errorIfNotEqual(t, 10, len(session.Flash("info")))
+	errorIfNotEqual(t, true, store.Exists(ids[0]))
+
+	store.Delete(ids[0])
+	errorIfNotEqual(t, false, store.Exists(ids[0]))
+	errorIfNotEqual(t, true, store.Load(ids[0]) == nil)
+	errorIfNotEqual(t, true, store.Load("../../etc/passwd") == nil)
+}
+
+func TestFileSessionStoreGc(t *testing.T) {
+	store, dir := newTestFileSessionStore(t)
+	active := store.NewSession()
+	store.Save(active)
+	expired := store.NewSession()
+	store.Save(expired)
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(filepath.Join(dir, fileSessionPrefix+expired.Id), old, old)
+	remembered := store.NewSession()
+	remembered.SetMaxAge(time.Hour)
+	store.Save(remembered)
+	os.Chtimes(filepath.Join(dir, fileSessionPrefix+remembered.Id), old, old)
+	os.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0600)
+	os.Chtimes(filepath.Join(dir, "other"), old, old)
+
+	store.Gc()
+	errorIfNotEqual(t, 2, store.Count())
+	errorIfNotEqual(t, true, store.Exists(active.Id))
+	errorIfNotEqual(t, true, store.Load(remembered.Id) != nil)
+	errorIfNotEqual(t, false, store.Exists(expired.Id))
+	_, err := os.Stat(filepath.Join(dir, "other"))
+	errorIfNotEqual(t, nil, err)
+}
+
+func TestFileSessionStoreMiddleware(t *testing.T) {
+	dir := t.TempDir()
+	newApp := func() *App {
+		app := NewApp(DefaultAppConfig())
+		app.AccessLogger = func(LogLevel, string) {}
+		app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+			c.Secret = "secret"
+			c.SessionStore = "cidre.FileSessionStore"
+		}), DefaultFileSessionStoreConfig(func(c *FileSessionStoreConfig) {
+			c.Directory = dir
+		})))
+		root := app.MountPoint("/")
+		root.Get("count", "count", func(w http.ResponseWriter, r *http.Request) {
+			session := RequestContext(r).Session
+			count := session.GetOr("count", 0).(int) + 1
+			session.Set("count", count)
+			fmt.Fprint(w, count)
+		})
+		return app
+	}
+	client := NewTestClient(newApp())
+	errorIfNotEqual(t, "1", client.Get("/count").String())
+	errorIfNotEqual(t, "2", client.Get("/count").String())
+	client.App = newApp()
+	errorIfNotEqual(t, "3", client.Get("/count").String())
+}
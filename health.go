@@ -0,0 +1,117 @@
+package cidre
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type healthCheck struct {
+	name string
+	fn   func(context.Context) error
+}
+
+type healthChecks struct {
+	sync.Mutex
+	checks []healthCheck
+}
+
+// HealthStatus is a JSON object written by the readiness endpoint.
+type HealthStatus struct {
+	// "ok" or "unavailable"
+	Status string `json:"status"`
+	// Results of the checks: "ok" or an error message
+	Checks map[string]string `json:"checks"`
+	// Names of the failing checks
+	Failures []string `json:"failures,omitempty"`
+}
+
+// Registers a check that is run by the readiness endpoint. A check should return
+// nil if the resource(database, session store, etc) is available.
+func (app *App) HealthCheck(name string, fn func(context.Context) error) {
+	app.healthChecks.Lock()
+	defer app.healthChecks.Unlock()
+	app.healthChecks.checks = append(app.healthChecks.checks, healthCheck{name, fn})
+}
+
+// Runs all registered checks in parallel and returns the results.
+// Checks are canceled when AppConfig.HealthCheckTimeout elapses.
+func (app *App) CheckHealth(ctx context.Context) *HealthStatus {
+	app.healthChecks.Lock()
+	checks := append([]healthCheck{}, app.healthChecks.checks...)
+	app.healthChecks.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, app.Config.HealthCheckTimeout)
+	defer cancel()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			result := make(chan error, 1)
+			go func() { result <- check.fn(ctx) }()
+			select {
+			case results[i] = <-result:
+			case <-ctx.Done():
+				results[i] = ctx.Err()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	status := &HealthStatus{Status: "ok", Checks: make(map[string]string)}
+	for i, check := range checks {
+		if results[i] != nil {
+			status.Checks[check.name] = results[i].Error()
+			status.Failures = append(status.Failures, check.name)
+		} else {
+			status.Checks[check.name] = "ok"
+		}
+	}
+	if len(status.Failures) > 0 {
+		status.Status = "unavailable"
+		sort.Strings(status.Failures)
+	}
+	return status
+}
+
+// Mounts a liveness endpoint(path + "healthz") and a readiness endpoint(path + "readyz").
+// The liveness endpoint returns 200 while the server is accepting requests.
+// The readiness endpoint runs all registered checks and returns 200 with a HealthStatus
+// object, or 503 if some checks failed.
+// These routes have no middlewares and are not written to access logs.
+//
+//     app.HealthCheck("db", func(ctx context.Context) error {
+//         return db.PingContext(ctx)
+//     })
+//     app.MountHealthRoutes("/")
+func (app *App) MountHealthRoutes(path string) {
+	path = strings.TrimRight(path, "/") + "/"
+	liveness := NewRoute("cidre.healthz", path+"healthz", "GET", false, http.HandlerFunc(app.serveLiveness))
+	liveness.Meta.Set(MetaSkipAccessLog, true)
+	app.Routes[liveness.Name] = liveness
+	readiness := NewRoute("cidre.readyz", path+"readyz", "GET", false, http.HandlerFunc(app.serveReadiness))
+	readiness.Meta.Set(MetaSkipAccessLog, true)
+	app.Routes[readiness.Name] = readiness
+}
+
+func (app *App) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	if app.IsDraining() {
+		app.Renderer.JsonStatus(w, http.StatusServiceUnavailable, &HealthStatus{Status: "unavailable", Checks: map[string]string{}})
+		return
+	}
+	app.Renderer.Json(w, &HealthStatus{Status: "ok", Checks: map[string]string{}})
+}
+
+func (app *App) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	status := app.CheckHealth(r.Context())
+	w.Header().Set("Cache-Control", "no-store")
+	code := http.StatusOK
+	if len(status.Failures) > 0 {
+		code = http.StatusServiceUnavailable
+	}
+	app.Renderer.JsonStatus(w, code, status)
+}
@@ -0,0 +1,60 @@
+package cidre
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthRoutes(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+	}))
+	logs := 0
+	app.AccessLogger = func(LogLevel, string) { logs++ }
+	app.Use(MiddlewareOf(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("health routes should bypass middlewares")
+	}))
+	app.HealthCheck("db", func(ctx context.Context) error { return nil })
+	app.MountHealthRoutes("/")
+	app.Setup()
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, http.StatusOK, writer)
+	AssertJSONEquals(t, `{"status":"ok","checks":{}}`, writer)
+
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, http.StatusOK, writer)
+	AssertJSONEquals(t, `{"status":"ok","checks":{"db":"ok"}}`, writer)
+
+	app.HealthCheck("cache", func(ctx context.Context) error { return errors.New("connection refused") })
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, http.StatusServiceUnavailable, writer)
+	AssertHeader(t, "Content-Type", "application/json; charset=UTF-8", writer)
+	AssertJSONEquals(t, `{"status":"unavailable","checks":{"db":"ok","cache":"connection refused"},"failures":["cache"]}`, writer)
+
+	errorIfNotEqual(t, 0, logs)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.HealthCheckTimeout = 1
+	}))
+	block := make(chan bool)
+	defer close(block)
+	app.HealthCheck("slow", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	status := app.CheckHealth(context.Background())
+	errorIfNotEqual(t, "unavailable", status.Status)
+	errorIfNotEqual(t, context.DeadlineExceeded.Error(), status.Checks["slow"])
+}
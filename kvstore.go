@@ -0,0 +1,135 @@
+package cidre
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrKeyNotFound is returned by KeyValueStore.Get if the key does not exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyValueStore is a minimal interface for key-value stores like Redis and Memcached.
+// A KeyValueStore must be safe for concurrent use.
+//
+// For example, a KeyValueStore using go-redis is written as follows:
+//
+//     type redisStore struct{ client *redis.Client }
+//
+//     func (s *redisStore) Get(ctx context.Context, key string) ([]byte, error) {
+//         v, err := s.client.Get(ctx, key).Bytes()
+//         if err == redis.Nil {
+//             return nil, cidre.ErrKeyNotFound
+//         }
+//         return v, err
+//     }
+//     func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+//         return s.client.Set(ctx, key, value, ttl).Err()
+//     }
+//     func (s *redisStore) Del(ctx context.Context, key string) error {
+//         return s.client.Del(ctx, key).Err()
+//     }
+type KeyValueStore interface {
+	// Returns ErrKeyNotFound if the key does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Sets the value that expires after the ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+}
+
+// KeyValueSessionStore is a SessionStoreV2 backed by a KeyValueStore.
+// Sessions are serialized with encoding/gob, so types of values stored in sessions
+// other than basic types must be registered by gob.Register.
+// Sessions expire after SessionConfig.LifeTime(or Session.MaxAge) since the last access by TTLs of
+// the KeyValueStore, so Gc does nothing. TTLs are refreshed when sessions are saved, that is, when
+// sessions are modified or the last access time is updated at SessionConfig.LastAccessTimeResolution.
+// Sessions are locked in the process, LockSession does not lock sessions across processes.
+//
+//     store := cidre.NewKeyValueSessionStore(&redisStore{client})
+//     app.Use(cidre.NewSessionMiddlewareWithStoreV2(app, sessionConfig, store, nil))
+type KeyValueSessionStore struct {
+	// A prefix of keys.
+	// default: "cidre:session:"
+	Prefix     string
+	kvs        KeyValueStore
+	middleware *SessionMiddleware
+	mutex      sync.Mutex
+	locks      map[string]*sessionLock
+}
+
+type sessionLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Returns a new KeyValueSessionStore object.
+func NewKeyValueSessionStore(kvs KeyValueStore) *KeyValueSessionStore {
+	return &KeyValueSessionStore{
+		Prefix: "cidre:session:",
+		kvs:    kvs,
+		locks:  make(map[string]*sessionLock),
+	}
+}
+
+func (ks *KeyValueSessionStore) Init(middleware *SessionMiddleware, cfg interface{}) {
+	ks.middleware = middleware
+}
+
+func (ks *KeyValueSessionStore) LockSession(ctx context.Context, sessionId string) (func(), error) {
+	ks.mutex.Lock()
+	lock, ok := ks.locks[sessionId]
+	if !ok {
+		lock = &sessionLock{}
+		ks.locks[sessionId] = lock
+	}
+	lock.refs++
+	ks.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		ks.mutex.Lock()
+		defer ks.mutex.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(ks.locks, sessionId)
+		}
+	}, nil
+}
+
+func (ks *KeyValueSessionStore) NewSession(ctx context.Context) (*Session, error) {
+	return NewSession(GenerateRandomId(sessionIdBytes)), nil
+}
+
+func (ks *KeyValueSessionStore) Load(ctx context.Context, sessionId string) (*Session, error) {
+	data, err := ks.kvs.Get(ctx, ks.Prefix+sessionId)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session, err := decodeSession(data)
+	if err != nil {
+		// broken data is treated as an unknown session.
+		return nil, nil
+	}
+	return session, nil
+}
+
+func (ks *KeyValueSessionStore) Save(ctx context.Context, session *Session) error {
+	data, err := encodeSession(session)
+	if err != nil {
+		return err
+	}
+	return ks.kvs.Set(ctx, ks.Prefix+session.Id, data, ks.middleware.Config.sessionLifeTime(session))
+}
+
+func (ks *KeyValueSessionStore) Delete(ctx context.Context, sessionId string) error {
+	return ks.kvs.Del(ctx, ks.Prefix+sessionId)
+}
+
+func (ks *KeyValueSessionStore) Gc(context.Context) error {
+	return nil
+}
@@ -0,0 +1,161 @@
+package cidre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testKeyValueStore struct {
+	mutex   sync.Mutex
+	values  map[string][]byte
+	ttls    map[string]time.Duration
+	sets    int
+	failure error
+}
+
+func newTestKeyValueStore() *testKeyValueStore {
+	return &testKeyValueStore{values: map[string][]byte{}, ttls: map[string]time.Duration{}}
+}
+
+func (s *testKeyValueStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failure != nil {
+		return nil, s.failure
+	}
+	v, ok := s.values[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (s *testKeyValueStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failure != nil {
+		return s.failure
+	}
+	s.values[key] = value
+	s.ttls[key] = ttl
+	s.sets += 1
+	return nil
+}
+
+func (s *testKeyValueStore) Del(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failure != nil {
+		return s.failure
+	}
+	delete(s.values, key)
+	delete(s.ttls, key)
+	return nil
+}
+
+func (s *testKeyValueStore) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failure = err
+}
+
+func newKeyValueSessionTestApp(kvs KeyValueStore) (*App, *SessionMiddleware, *[]string) {
+	app := NewApp(DefaultAppConfig())
+	logs := &[]string{}
+	app.Logger = func(level LogLevel, message string) {
+		*logs = append(*logs, message)
+	}
+	app.AccessLogger = func(LogLevel, string) {}
+	sm := NewSessionMiddlewareWithStoreV2(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.LifeTime = time.Hour
+	}), NewKeyValueSessionStore(kvs), nil)
+	app.Use(sm)
+	root := app.MountPoint("/")
+	root.Get("count", "count", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		count := session.GetOr("count", 0).(int) + 1
+		session.Set("count", count)
+		fmt.Fprint(w, count)
+	})
+	root.Get("peek", "peek", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RequestContext(r).Session.GetOr("count", 0))
+	})
+	root.Get("logout", "logout", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Kill()
+		fmt.Fprint(w, "bye")
+	})
+	return app, sm, logs
+}
+
+func TestKeyValueSessionStore(t *testing.T) {
+	kvs := newTestKeyValueStore()
+	app, sm, _ := newKeyValueSessionTestApp(kvs)
+	errorIfNotEqual(t, true, sm.Store == nil)
+	client := NewTestClient(app)
+	errorIfNotEqual(t, "1", client.Get("/count").String())
+	errorIfNotEqual(t, "2", client.Get("/count").String())
+	errorIfNotEqual(t, 1, len(kvs.values))
+	for key, ttl := range kvs.ttls {
+		errorIfNotEqual(t, true, strings.HasPrefix(key, "cidre:session:"))
+		errorIfNotEqual(t, time.Hour, ttl)
+	}
+	// read-only requests do not write sessions.
+	sets := kvs.sets
+	errorIfNotEqual(t, "2", client.Get("/peek").String())
+	errorIfNotEqual(t, sets, kvs.sets)
+
+	client.Get("/logout")
+	errorIfNotEqual(t, 0, len(kvs.values))
+	errorIfNotEqual(t, "1", client.Get("/count").String())
+}
+
+func TestKeyValueSessionStoreError(t *testing.T) {
+	kvs := newTestKeyValueStore()
+	app, _, logs := newKeyValueSessionTestApp(kvs)
+	client := NewTestClient(app)
+	errorIfNotEqual(t, "1", client.Get("/count").String())
+
+	kvs.fail(errors.New("connection refused"))
+	res := client.Get("/count")
+	errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+	errorIfNotEqual(t, "session error: connection refused", strings.Join(*logs, ","))
+
+	var handled error
+	app.OnSessionError = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+	res = client.Get("/count")
+	errorIfNotEqual(t, http.StatusServiceUnavailable, res.Status)
+	errorIfNotEqual(t, "connection refused", handled.Error())
+}
+
+func TestKeyValueSessionStoreLock(t *testing.T) {
+	store := NewKeyValueSessionStore(newTestKeyValueStore())
+	unlock1, _ := store.LockSession(context.Background(), "session1")
+	unlock2, _ := store.LockSession(context.Background(), "session2")
+	locked := make(chan bool)
+	go func() {
+		unlock, _ := store.LockSession(context.Background(), "session1")
+		defer unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Error("session1 should be locked")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock2()
+	unlock1()
+	<-locked
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	errorIfNotEqual(t, 0, len(store.locks))
+}
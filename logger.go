@@ -0,0 +1,58 @@
+package cidre
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// StructuredLogger is a logger that receives key-value pairs in addition to a message.
+// If App.StructuredLogger is set, the App uses it instead of App.Logger and App.AccessLogger
+// so that log aggregators can handle fields like request ids and statuses without parsing messages.
+// Messages other than access logs are filtered by App.LogLevel, and have no fields unless
+// they are panic logs.
+type StructuredLogger interface {
+	Log(level LogLevel, message string, fields map[string]interface{})
+}
+
+// StructuredLoggerFunc is an adapter to use ordinary functions as StructuredLoggers.
+type StructuredLoggerFunc func(LogLevel, string, map[string]interface{})
+
+func (f StructuredLoggerFunc) Log(level LogLevel, message string, fields map[string]interface{}) {
+	f(level, message, fields)
+}
+
+// Log levels of the slog package that correspond to cidre's LogLevels.
+var slogLevels = map[LogLevel]slog.Level{
+	LogLevelUnknown: slog.LevelInfo,
+	LogLevelDebug:   slog.LevelDebug,
+	LogLevelInfo:    slog.LevelInfo,
+	LogLevelWarn:    slog.LevelWarn,
+	LogLevelError:   slog.LevelError,
+	LogLevelCrit:    slog.LevelError + 4,
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// Returns a StructuredLogger that writes logs to the given slog.Logger.
+// Fields are passed as attributes sorted by their keys.
+//
+//     app.StructuredLogger = cidre.NewSlogLogger(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+func NewSlogLogger(logger *slog.Logger) StructuredLogger {
+	return &slogLogger{logger}
+}
+
+func (sl *slogLogger) Log(level LogLevel, message string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.Any(key, fields[key]))
+	}
+	sl.logger.LogAttrs(context.Background(), slogLevels[level], message, attrs...)
+}
@@ -0,0 +1,120 @@
+package cidre
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testLogEntry struct {
+	level   LogLevel
+	message string
+	fields  map[string]interface{}
+}
+
+func TestStructuredLogger(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	entries := []testLogEntry{}
+	app.StructuredLogger = StructuredLoggerFunc(func(level LogLevel, message string, fields map[string]interface{}) {
+		entries = append(entries, testLogEntry{level, message, fields})
+	})
+	app.Logger = func(level LogLevel, message string) {
+		t.Errorf("Logger should not be called, but got '%v'", message)
+	}
+	app.AccessLogger = app.Logger
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345"))
+	})
+	root.Get("error", "error", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	client := NewTestClient(app)
+
+	res := client.Get("/page1")
+	errorIfNotEqual(t, 1, len(entries))
+	entry := entries[0]
+	errorIfNotEqual(t, LogLevelInfo, entry.level)
+	errorIfNotEqual(t, "access", entry.message)
+	errorIfNotEqual(t, res.Context.Id, entry.fields["id"])
+	errorIfNotEqual(t, "GET", entry.fields["method"])
+	errorIfNotEqual(t, "http://example.com/page1", entry.fields["uri"])
+	errorIfNotEqual(t, "page1", entry.fields["route"])
+	errorIfNotEqual(t, http.StatusOK, entry.fields["status"])
+	errorIfNotEqual(t, 5, entry.fields["size"])
+	errorIfNotEqual(t, res.Context.ResponseTime, entry.fields["duration"])
+
+	entries = entries[:0]
+	res = client.Get("/error")
+	errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+	errorIfNotEqual(t, 2, len(entries))
+	entry = entries[0]
+	errorIfNotEqual(t, LogLevelError, entry.level)
+	errorIfNotEqual(t, "boom", entry.message)
+	errorIfNotEqual(t, res.Context.Id, entry.fields["id"])
+	errorIfNotEqual(t, "GET", entry.fields["method"])
+	errorIfNotEqual(t, "error", entry.fields["route"])
+	errorIfNotEqual(t, true, len(entry.fields["stack"].(string)) != 0)
+	errorIfNotEqual(t, http.StatusInternalServerError, entries[1].fields["status"])
+
+	entries = entries[:0]
+	app.LogLevel = LogLevelWarn
+	app.log(LogLevelInfo, "info message")
+	app.log(LogLevelWarn, "warn message")
+	errorIfNotEqual(t, 1, len(entries))
+	errorIfNotEqual(t, LogLevelWarn, entries[0].level)
+	errorIfNotEqual(t, "warn message", entries[0].message)
+}
+
+func TestSlogLogger(t *testing.T) {
+	var b bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logger.Log(LogLevelWarn, "message", map[string]interface{}{"id": "1", "status": 404})
+	var record map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotEqual(t, "WARN", record["level"])
+	errorIfNotEqual(t, "message", record["msg"])
+	errorIfNotEqual(t, "1", record["id"])
+	errorIfNotEqual(t, float64(404), record["status"])
+}
+
+func TestLeveledLogger(t *testing.T) {
+	var b bytes.Buffer
+	logger := LeveledLogger(LogLevelInfo, &b)
+	logger(LogLevelDebug, "debug message")
+	logger(LogLevelWarn, "warn message")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	errorIfNotEqual(t, 1, len(lines))
+	errorIfNotEqual(t, true, strings.HasSuffix(lines[0], "\tWARN\twarn message"))
+}
+
+func TestAppLogLevel(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.LogLevel = "Info"
+	}))
+	errorIfNotEqual(t, LogLevelInfo, app.LogLevel)
+	messages := []string{}
+	app.Logger = func(level LogLevel, message string) {
+		messages = append(messages, message)
+	}
+	app.log(LogLevelDebug, "debug message")
+	app.log(LogLevelWarn, "warn message")
+	errorIfNotEqual(t, "warn message", strings.Join(messages, ","))
+
+	errorIfNotEqual(t, LogLevelUnknown, NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.LogLevel = ""
+	})).LogLevel)
+	defer func() {
+		if recover() == nil {
+			t.Error("NewApp should cause panic with an unknown log level")
+		}
+	}()
+	NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.LogLevel = "verbose"
+	}))
+}
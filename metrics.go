@@ -0,0 +1,220 @@
+package cidre
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsConfig is a configuration object for the MetricsMiddleware
+type MetricsConfig struct {
+	// A prefix of metric names, default: "cidre"
+	Namespace string
+	// Upper bounds of the latency histogram buckets in seconds,
+	// default: 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10
+	DurationBuckets []float64
+}
+
+// Returns a MetricsConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the MetricsConfig object.
+func DefaultMetricsConfig(init ...func(*MetricsConfig)) *MetricsConfig {
+	self := &MetricsConfig{
+		Namespace:       "cidre",
+		DurationBuckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+const metricsContextKey = "cidre.metrics"
+
+// Label value used for requests that did not match any routes.
+const MetricsNotFoundLabel = "not_found"
+
+type metricsKey struct {
+	route string
+	code  string
+}
+
+type metricsSeries struct {
+	count        uint64
+	sizeSum      uint64
+	durationSum  float64
+	bucketCounts []uint64
+}
+
+// Middleware for collecting request metrics. Metrics are labeled by a route name and
+// a status class(2xx, 3xx, ...), so cardinality stays bounded.
+// Requests that did not match any routes are labeled as "not_found".
+//
+//     metrics := cidre.NewMetricsMiddleware(app, cidre.DefaultMetricsConfig())
+//     app.Use(metrics)
+//     root := app.MountPoint("/")
+//     root.Get("metrics", "metrics", metrics.MetricsHandler())
+type MetricsMiddleware struct {
+	sync.Mutex
+	app    *App
+	Config *MetricsConfig
+	// A function that returns statistics of the session store. Session metrics are
+	// written if this value is not nil.
+	//
+	//     metrics.SessionStats = sm.Store.(*cidre.MemorySessionStore).Stats
+	SessionStats func() SessionStoreStats
+	inFlight     int64
+	series       map[metricsKey]*metricsSeries
+}
+
+// Returns a new MetricsMiddleware object.
+func NewMetricsMiddleware(app *App, config *MetricsConfig) *MetricsMiddleware {
+	mm := &MetricsMiddleware{
+		app:    app,
+		Config: config,
+		series: make(map[metricsKey]*metricsSeries),
+	}
+	sort.Float64s(mm.Config.DurationBuckets)
+	app.Hooks.Add("end_request", mm.observe)
+	return mm
+}
+
+func (mm *MetricsMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(r)
+	mm.Lock()
+	mm.inFlight += 1
+	mm.Unlock()
+	ctx.Set(metricsContextKey, true)
+	ctx.MiddlewareChain.DoNext(w, r)
+}
+
+func (mm *MetricsMiddleware) observe(w http.ResponseWriter, r *http.Request, data interface{}) {
+	ctx := RequestContext(r)
+	route := MetricsNotFoundLabel
+	if ctx.Route != nil {
+		if !ctx.Has(metricsContextKey) {
+			return
+		}
+		route = ctx.Route.Name
+	}
+	status, size := 200, 0
+	if rw, ok := w.(ResponseWriter); ok {
+		if rw.Status() != 0 {
+			status = rw.Status()
+		}
+		size = rw.ContentLength()
+	}
+	key := metricsKey{route, fmt.Sprintf("%dxx", status/100)}
+	duration := ctx.ResponseTime.Seconds()
+
+	mm.Lock()
+	defer mm.Unlock()
+	if ctx.Route != nil {
+		mm.inFlight -= 1
+	}
+	s, ok := mm.series[key]
+	if !ok {
+		s = &metricsSeries{bucketCounts: make([]uint64, len(mm.Config.DurationBuckets))}
+		mm.series[key] = s
+	}
+	s.count += 1
+	s.sizeSum += uint64(size)
+	s.durationSum += duration
+	for i, le := range mm.Config.DurationBuckets {
+		if duration <= le {
+			s.bucketCounts[i] += 1
+		}
+	}
+}
+
+// Writes the collected metrics in the Prometheus text exposition format.
+func (mm *MetricsMiddleware) WriteMetrics(buf io.Writer) {
+	mm.Lock()
+	defer mm.Unlock()
+	ns := mm.Config.Namespace
+	keys := make([]metricsKey, 0, len(mm.series))
+	for key := range mm.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].code < keys[j].code
+	})
+	labels := func(key metricsKey) string {
+		return fmt.Sprintf(`route="%s",code="%s"`, escapeMetricsLabel(key.route), key.code)
+	}
+
+	fmt.Fprintf(buf, "# HELP %s_http_requests_in_flight Number of requests currently being served.\n", ns)
+	fmt.Fprintf(buf, "# TYPE %s_http_requests_in_flight gauge\n", ns)
+	fmt.Fprintf(buf, "%s_http_requests_in_flight %d\n", ns, mm.inFlight)
+
+	fmt.Fprintf(buf, "# HELP %s_http_requests_total Total number of requests.\n", ns)
+	fmt.Fprintf(buf, "# TYPE %s_http_requests_total counter\n", ns)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s_http_requests_total{%s} %d\n", ns, labels(key), mm.series[key].count)
+	}
+
+	fmt.Fprintf(buf, "# HELP %s_http_response_size_bytes Size of responses in bytes.\n", ns)
+	fmt.Fprintf(buf, "# TYPE %s_http_response_size_bytes summary\n", ns)
+	for _, key := range keys {
+		s := mm.series[key]
+		fmt.Fprintf(buf, "%s_http_response_size_bytes_sum{%s} %d\n", ns, labels(key), s.sizeSum)
+		fmt.Fprintf(buf, "%s_http_response_size_bytes_count{%s} %d\n", ns, labels(key), s.count)
+	}
+
+	fmt.Fprintf(buf, "# HELP %s_http_request_duration_seconds Latency of requests in seconds.\n", ns)
+	fmt.Fprintf(buf, "# TYPE %s_http_request_duration_seconds histogram\n", ns)
+	for _, key := range keys {
+		s := mm.series[key]
+		for i, le := range mm.Config.DurationBuckets {
+			fmt.Fprintf(buf, "%s_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", ns, labels(key),
+				strconv.FormatFloat(le, 'g', -1, 64), s.bucketCounts[i])
+		}
+		fmt.Fprintf(buf, "%s_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", ns, labels(key), s.count)
+		fmt.Fprintf(buf, "%s_http_request_duration_seconds_sum{%s} %s\n", ns, labels(key),
+			strconv.FormatFloat(s.durationSum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_http_request_duration_seconds_count{%s} %d\n", ns, labels(key), s.count)
+	}
+
+	if mm.SessionStats != nil {
+		stats := mm.SessionStats()
+		fmt.Fprintf(buf, "# HELP %s_sessions Number of sessions currently stored.\n", ns)
+		fmt.Fprintf(buf, "# TYPE %s_sessions gauge\n", ns)
+		fmt.Fprintf(buf, "%s_sessions %d\n", ns, stats.Count)
+		for _, c := range []struct {
+			name, help string
+			value      uint64
+		}{
+			{"created", "created", stats.Created},
+			{"evicted", "evicted because the session store is full", stats.Evicted},
+			{"expired", "expired", stats.Expired},
+		} {
+			fmt.Fprintf(buf, "# HELP %s_sessions_%s_total Total number of sessions %s.\n", ns, c.name, c.help)
+			fmt.Fprintf(buf, "# TYPE %s_sessions_%s_total counter\n", ns, c.name)
+			fmt.Fprintf(buf, "%s_sessions_%s_total %d\n", ns, c.name, c.value)
+		}
+	}
+}
+
+// Returns a http.HandlerFunc that renders the collected metrics in the Prometheus text exposition format.
+func (mm *MetricsMiddleware) MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		mm.WriteMetrics(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+}
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricsLabel(s string) string {
+	return metricsLabelReplacer.Replace(s)
+}
@@ -0,0 +1,46 @@
+package cidre
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	metrics := NewMetricsMiddleware(app, DefaultMetricsConfig())
+	app.Use(metrics)
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345"))
+	})
+	root.Get("error", "error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "error", http.StatusInternalServerError)
+	})
+	root.Get("metrics", "metrics", metrics.MetricsHandler())
+
+	for _, path := range []string{"/page1", "/page1", "/error", "/notfound"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		app.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	body := writer.Body.String()
+	AssertHeader(t, "Content-Type", "text/plain; version=0.0.4; charset=utf-8", writer)
+	for _, line := range []string{
+		`cidre_http_requests_in_flight 1`,
+		`cidre_http_requests_total{route="page1",code="2xx"} 2`,
+		`cidre_http_requests_total{route="error",code="5xx"} 1`,
+		`cidre_http_requests_total{route="not_found",code="4xx"} 1`,
+		`cidre_http_response_size_bytes_sum{route="page1",code="2xx"} 10`,
+		`cidre_http_request_duration_seconds_bucket{route="page1",code="2xx",le="+Inf"} 2`,
+		`cidre_http_request_duration_seconds_count{route="page1",code="2xx"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain '%v', but got:\n%v", line, body)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type acceptRange struct {
+	mediatype string
+	q         float64
+}
+
+func parseAccept(header string) []acceptRange {
+	var result []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediatype := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(mediatype) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		result = append(result, acceptRange{mediatype, q})
+	}
+	return result
+}
+
+// Returns a quality value of the offer. The most specific range is used.
+func acceptQuality(ranges []acceptRange, offer string) float64 {
+	offer = strings.ToLower(offer)
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediatype == offer:
+			s = 2
+		case strings.HasSuffix(r.mediatype, "/*") && strings.HasPrefix(offer, r.mediatype[:len(r.mediatype)-1]):
+			s = 1
+		case r.mediatype == "*/*" || r.mediatype == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// Returns the best media type in the given offers for the Accept header.
+// If the request has no Accept header, Negotiate returns the first offer.
+// Negotiate returns an empty string if no offers are acceptable.
+//
+//     switch ctx.Negotiate("application/json", "application/xml") {
+//     case "application/json":
+//         ...
+//     }
+func (ctx *Context) Negotiate(offers ...string) string {
+	return negotiate(ctx.Request.Header.Get("Accept"), offers)
+}
+
+func negotiate(accept string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if len(strings.TrimSpace(accept)) == 0 {
+		return offers[0]
+	}
+	ranges := parseAccept(accept)
+	best, bestq := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, offer); q > bestq {
+			best, bestq = offer, q
+		}
+	}
+	return best
+}
+
+// A route meta key for a template name used by Renderer.Auto when HTML is acceptable.
+//
+//     root.Get("items", "items", handler).Meta.Set(cidre.MetaTemplateName, "items")
+const MetaTemplateName = "template_name"
+
+// Auto(w http.ResponseWriter, r *http.Request, object interface{})
+// Auto renders the object as JSON, XML, plain text or HTML according to the Accept header.
+// HTML is offered only if the route has a template name(MetaTemplateName).
+// App.OnNotAcceptable is called if no media types are acceptable.
+func (rndr *BaseRenderer) Auto(w http.ResponseWriter, r *http.Request, v interface{}) {
+	ctx := RequestContext(r)
+	offers := []string{"application/json", "application/xml", "text/plain"}
+	template, hasTemplate := "", false
+	if ctx.Route != nil {
+		template, hasTemplate = ctx.Route.Meta.TryString(MetaTemplateName)
+	}
+	if hasTemplate {
+		offers = append([]string{"text/html"}, offers...)
+	}
+	w.Header().Add("Vary", "Accept")
+	renderer := ctx.App.Renderer
+	switch ctx.Negotiate(offers...) {
+	case "text/html":
+		renderer.Html(w, template, v)
+	case "application/json":
+		renderer.Json(w, v)
+	case "application/xml":
+		renderer.Xml(w, v)
+	case "text/plain":
+		renderer.Text(w, "%v", v)
+	default:
+		ctx.App.OnNotAcceptable(w, r)
+	}
+}
+
+// An offer for a text/html response used by Renderer.Negotiate.
+type TemplateOffer struct {
+	// A template name
+	Name string
+	// A parameter passed to the template
+	Param interface{}
+}
+
+// Media types that Renderer.Negotiate supports, in order of preference.
+var negotiableMediaTypes = []string{"application/json", "text/html", "application/xml", "text/plain"}
+
+// Negotiate(w http.ResponseWriter, r *http.Request, offers map[string]interface{})
+// Negotiate renders one of the offers that is acceptable for the request.
+// Keys of the offers are "application/json", "application/xml", "text/html" and "text/plain".
+// A value for "text/html" must be a TemplateOffer, and a value for "text/plain" is formatted by "%v".
+// If the request accepts multiple offers equally(e.g. "*/*"), offers are chosen in the above order.
+// App.OnNotAcceptable is called if no offers are acceptable.
+//
+//     app.Renderer.Negotiate(w, r, map[string]interface{}{
+//         "application/json": item,
+//         "text/html":        cidre.TemplateOffer{"item", item},
+//     })
+func (rndr *BaseRenderer) Negotiate(w http.ResponseWriter, r *http.Request, offers map[string]interface{}) {
+	ctx := RequestContext(r)
+	mediatypes := make([]string, 0, len(offers))
+	for _, mediatype := range negotiableMediaTypes {
+		if _, ok := offers[mediatype]; ok {
+			mediatypes = append(mediatypes, mediatype)
+		}
+	}
+	if len(mediatypes) != len(offers) {
+		panic(fmt.Sprintf("Renderer.Negotiate supports only %v", strings.Join(negotiableMediaTypes, ", ")))
+	}
+	w.Header().Add("Vary", "Accept")
+	renderer := ctx.App.Renderer
+	mediatype := ctx.Negotiate(mediatypes...)
+	switch mediatype {
+	case "text/html":
+		offer := offers[mediatype].(TemplateOffer)
+		renderer.Html(w, offer.Name, offer.Param)
+	case "application/json":
+		renderer.Json(w, offers[mediatype])
+	case "application/xml":
+		renderer.Xml(w, offers[mediatype])
+	case "text/plain":
+		renderer.Text(w, "%v", offers[mediatype])
+	default:
+		ctx.App.OnNotAcceptable(w, r)
+	}
+}
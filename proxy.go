@@ -0,0 +1,82 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Returns a handler that proxies requests to the target with the httputil.ReverseProxy.
+// Paths of requests are joined to the path of the target. Hop-by-hop headers are removed,
+// and X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers are set. If the request
+// has been passed through App.ServeHTTP, X-Forwarded-Proto is the Context.Scheme(), and
+// errors are logged by the App's logger. Responses are written through the cidre.ResponseWriter,
+// so the status and the content length are recorded in access logs.
+// If an 'init' function object argument is not nil, this function will call the function
+// with the httputil.ReverseProxy object(e.g. to set a Transport).
+//
+//     target, _ := url.Parse("http://127.0.0.1:9000/api")
+//     root.Get("users", "users", cidre.ReverseProxy(target).ServeHTTP)
+func ReverseProxy(target *url.URL, init ...func(*httputil.ReverseProxy)) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			if ctx, ok := pr.In.Context().Value(contextKey{}).(*Context); ok && ctx.App != nil {
+				pr.Out.Header.Set("X-Forwarded-Proto", ctx.Scheme())
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if ctx := responseContext(w); ctx != nil && ctx.App != nil {
+				ctx.App.log(LogLevelError, fmt.Sprintf("proxy error: %v", err))
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if len(init) > 0 {
+		init[0](proxy)
+	}
+	return proxy
+}
+
+// Removes cookies that have the given names from the request.
+func removeCookies(r *http.Request, names map[string]bool) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !names[cookie.Name] {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// Registers a route that proxies requests with any methods under the given path(including the path itself)
+// to the target. The path of the mount point and the given path are stripped from requests.
+// Proxy routes have the MetaSessionExempt and the MetaCsrfExempt, and session cookies of
+// SessionMiddlewares of the route are not sent to the target.
+//
+//     target, _ := url.Parse("http://127.0.0.1:9000/v1")
+//     root.Proxy("api", "api", target) // "/api/users" -> "http://127.0.0.1:9000/v1/users"
+func (mt *MountPoint) Proxy(n, p string, target *url.URL, middlewares ...interface{}) *Route {
+	path := strings.Trim(p, "/")
+	sessionCookies := map[string]bool{}
+	for _, middleware := range append(MiddlewaresOf(middlewares...), mt.Middlewares...) {
+		if sm, ok := middleware.(*SessionMiddleware); ok {
+			sessionCookies[sm.Config.FullCookieName()] = true
+		}
+	}
+	proxy := ReverseProxy(target, func(proxy *httputil.ReverseProxy) {
+		rewrite := proxy.Rewrite
+		proxy.Rewrite = func(pr *httputil.ProxyRequest) {
+			rewrite(pr)
+			removeCookies(pr.Out, sessionCookies)
+		}
+	})
+	handler := http.StripPrefix(mt.Path+path, proxy)
+	route := mt.Route(n, path+"(?P<path>|/.*)", MethodAny, false, handler.ServeHTTP, middlewares...)
+	route.Meta.Set(MetaSessionExempt, true)
+	route.Meta.Set(MetaCsrfExempt, true)
+	return route
+}
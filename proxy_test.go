@@ -0,0 +1,77 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReverseProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%v %v for=%v host=%v proto=%v secret=%v cookie=%v", r.Method, r.URL.RequestURI(),
+			r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"),
+			r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Secret"), r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL + "/v1")
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	closedTarget, _ := url.Parse(closed.URL)
+
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AccessLogFormat = "{{.req.URL.Path}} {{.res.Status}} {{.res.ContentLength}}"
+	}))
+	logs := []string{}
+	app.AccessLogger = func(level LogLevel, message string) { logs = append(logs, message) }
+	errorLogs := []string{}
+	app.Logger = func(level LogLevel, message string) { errorLogs = append(errorLogs, message) }
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), nil)
+	app.Use(sm, NewCsrfMiddleware(app, DefaultCsrfConfig()))
+	root := app.MountPoint("/")
+	errorIfNotEqual(t, "/api/users", app.BuildUrl(root.Proxy("api", "api", target).Name, "/users"))
+	root.Proxy("down", "down", closedTarget)
+	root.Get("page", "page", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("page"))
+	})
+	app.Setup()
+
+	req := httptest.NewRequest("PATCH", "/api/users/1?q=a", strings.NewReader(""))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Connection", "X-Secret")
+	req.Header.Set("X-Secret", "secret")
+	req.AddCookie(&http.Cookie{Name: sm.Config.FullCookieName(), Value: "session"})
+	req.AddCookie(&http.Cookie{Name: "upstream", Value: "value"})
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	body := "PATCH /v1/users/1?q=a for=192.0.2.1 host=example.com proto=http secret= cookie=upstream=value"
+	errorIfNotEqual(t, http.StatusCreated, writer.Code)
+	errorIfNotEqual(t, "yes", writer.Header().Get("X-Upstream"))
+	errorIfNotEqual(t, "", writer.Header().Get("Set-Cookie"))
+	errorIfNotEqual(t, body, writer.Body.String())
+	errorIfNotEqual(t, fmt.Sprintf("/api/users/1 201 %v", len(body)), logs[0])
+
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, httptest.NewRequest("POST", "/api", nil))
+	errorIfNotEqual(t, http.StatusCreated, writer.Code)
+	errorIfNotEqual(t, "POST /v1/ ", writer.Body.String()[:10])
+	logs = logs[1:]
+
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, httptest.NewRequest("GET", "/page", nil))
+	errorIfNotEqual(t, "page", writer.Body.String())
+
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, httptest.NewRequest("GET", "/down/", nil))
+	errorIfNotEqual(t, http.StatusBadGateway, writer.Code)
+	errorIfNotEqual(t, "/down/ 502 0", logs[2])
+	if len(errorLogs) != 1 || !strings.HasPrefix(errorLogs[0], "proxy error: ") {
+		t.Errorf("proxy errorLogs should be logged, but got %v", errorLogs)
+	}
+}
@@ -2,17 +2,26 @@ package cidre
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // Renderer provides easy way to serialize objects and render template files.
@@ -26,37 +35,192 @@ type Renderer interface {
 	// Writes the contents and the Content-Type header to the http.ResponseWriter.
 	Json(http.ResponseWriter, ...interface{})
 	// Writes the contents and the Content-Type header to the http.ResponseWriter.
+	Jsonp(http.ResponseWriter, ...interface{})
+	// Writes the contents and the Content-Type header to the http.ResponseWriter.
 	Xml(http.ResponseWriter, ...interface{})
 	// Writes the contents and the Content-Type header to the http.ResponseWriter.
 	Text(http.ResponseWriter, ...interface{})
+	// Writes the contents and the Content-Type header to the http.ResponseWriter.
+	Csv(http.ResponseWriter, ...interface{})
+	// Renders an object in a format that is acceptable for the request.
+	Auto(http.ResponseWriter, *http.Request, interface{})
+	// Renders one of the offers that is acceptable for the request.
+	Negotiate(http.ResponseWriter, *http.Request, map[string]interface{})
+	// Same as Html, but writes the given status code before the contents.
+	HtmlStatus(http.ResponseWriter, int, ...interface{})
+	// Same as Json, but writes the given status code before the contents.
+	JsonStatus(http.ResponseWriter, int, ...interface{})
+	// Same as Xml, but writes the given status code before the contents.
+	XmlStatus(http.ResponseWriter, int, ...interface{})
+	// Same as Text, but writes the given status code before the contents.
+	TextStatus(http.ResponseWriter, int, ...interface{})
 }
 
-type BaseRenderer struct{}
+// ErrorRenderer is implemented by Renderers that can return errors instead of panicking.
+// Contents are rendered fully before anything is written, so the response is not modified
+// if an error is returned. A status code 0 means the status is not written explicitly.
+// Methods of the Renderer interface are wrappers that panic with the errors.
+//
+//     if err := app.Renderer.(cidre.ErrorRenderer).RenderHtml(w, 0, "page", param); err != nil {
+//         http.Error(w, "Sorry, an error occurred", http.StatusInternalServerError)
+//     }
+type ErrorRenderer interface {
+	// Same as Html and HtmlStatus, but returns an error.
+	RenderHtml(w http.ResponseWriter, status int, name string, param interface{}) error
+	// Same as Json and JsonStatus, but returns an error.
+	RenderJson(w http.ResponseWriter, status int, obj interface{}) error
+	// Same as Xml and XmlStatus, but returns an error.
+	RenderXml(w http.ResponseWriter, status int, obj interface{}) error
+}
+
+type BaseRenderer struct {
+	jsonIndent            string
+	jsonDisableEscapeHTML bool
+	jsonPrefix            string
+}
+
+// Sets an indentation string for Json responses. An empty string means compact output.
+// default: ""
+func (rndr *BaseRenderer) SetJsonIndent(indent string) {
+	rndr.jsonIndent = indent
+}
+
+// Sets whether '<', '>' and '&' in Json responses are escaped.
+// default: true
+func (rndr *BaseRenderer) SetJsonEscapeHTML(on bool) {
+	rndr.jsonDisableEscapeHTML = !on
+}
+
+// Sets a string written before Json responses. A prefix like ")]}',\n" prevents
+// JSON hijacking, and clients must strip it before parsing responses.
+// Jsonp responses do not have the prefix.
+// default: ""
+func (rndr *BaseRenderer) SetJsonPrefix(prefix string) {
+	rndr.jsonPrefix = prefix
+}
+
+func (rndr *BaseRenderer) newJsonEncoder(w io.Writer) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", rndr.jsonIndent)
+	encoder.SetEscapeHTML(!rndr.jsonDisableEscapeHTML)
+	return encoder
+}
+
+// A route meta key. If a route has a true value with this key, Json responses for
+// GET and HEAD requests have weak ETags and respond with 304 Not Modified if the
+// request's If-None-Match header matches.
+//
+//     root.Get("items", "items", handler).Meta.Set(cidre.MetaJsonEtag, true)
+const MetaJsonEtag = "json_etag"
+
+// Returns a Context object associated with the writer, or nil.
+func responseContext(w io.Writer) *Context {
+	if rw, ok := w.(contextResponseWriter); ok {
+		return rw.Context()
+	}
+	return nil
+}
+
+// Sets the Content-Type header if it is not set, then writes the status code.
+func writeStatus(w http.ResponseWriter, status int, contentType string) {
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(status)
+}
+
+// Writes the rendered contents with the status code. The status code 0 means
+// the status is not written explicitly.
+func writeContents(w http.ResponseWriter, status int, contentType string, contents []byte) {
+	if status == 0 {
+		if len(w.Header().Get("Content-Type")) == 0 {
+			w.Header().Set("Content-Type", contentType)
+		}
+	} else {
+		writeStatus(w, status, contentType)
+	}
+	w.Write(contents)
+}
 
 // Json(w http.ResponseWriter, object interface{})
 func (rndr *BaseRenderer) Json(w http.ResponseWriter, args ...interface{}) {
+	if err := rndr.RenderJson(w, 0, args[0]); err != nil {
+		panic(err)
+	}
+}
+
+// JsonStatus(w http.ResponseWriter, status int, object interface{})
+// Note that JsonStatus does not set ETags even if the route has the MetaJsonEtag flag.
+func (rndr *BaseRenderer) JsonStatus(w http.ResponseWriter, status int, args ...interface{}) {
+	if err := rndr.RenderJson(w, status, args[0]); err != nil {
+		panic(err)
+	}
+}
+
+// Renders the object as JSON. ETags are set only if the status is 0.
+func (rndr *BaseRenderer) RenderJson(w http.ResponseWriter, status int, obj interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString(rndr.jsonPrefix)
+	if err := rndr.newJsonEncoder(&buf).Encode(obj); err != nil {
+		return err
+	}
+	if ctx := responseContext(w); status == 0 && ctx != nil && ctx.Route != nil && ctx.Route.Meta.GetBool(MetaJsonEtag) &&
+		(ctx.Request.Method == "GET" || ctx.Request.Method == "HEAD") {
+		etag := fmt.Sprintf(`W/"%x"`, sha1.Sum(buf.Bytes()))
+		w.Header().Set("ETag", etag)
+		if etagMatches(ctx.Request.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+	writeContents(w, status, "application/json; charset=UTF-8", buf.Bytes())
+	return nil
+}
+
+var jsonpCallbackPattern = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$.]*$`)
+
+// Jsonp(w http.ResponseWriter, callback string, object interface{})
+// Jsonp panics if the callback name is not a valid JavaScript identifier.
+func (rndr *BaseRenderer) Jsonp(w http.ResponseWriter, args ...interface{}) {
+	callback := args[0].(string)
+	if !jsonpCallbackPattern.MatchString(callback) {
+		panic(fmt.Sprintf("Invalid JSONP callback name: '%v'", callback))
+	}
 	if len(w.Header().Get("Content-Type")) == 0 {
-		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Type", "application/javascript")
 	}
-	obj := args[0]
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(obj); err != nil {
+	var buf bytes.Buffer
+	if err := rndr.newJsonEncoder(&buf).Encode(args[1]); err != nil {
 		panic(err)
 	}
+	bts := bytes.TrimRight(buf.Bytes(), "\n")
+	w.Write([]byte(BuildString(len(callback)+len(bts)+3, callback, "(", string(bts), ");")))
 }
 
 // Xml(w http.ResponseWriter, object interface{})
 func (rndr *BaseRenderer) Xml(w http.ResponseWriter, args ...interface{}) {
-	if len(w.Header().Get("Content-Type")) == 0 {
-		w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	if err := rndr.RenderXml(w, 0, args[0]); err != nil {
+		panic(err)
 	}
-	obj := args[0]
-	encoder := xml.NewEncoder(w)
-	if err := encoder.Encode(obj); err != nil {
+}
+
+// XmlStatus(w http.ResponseWriter, status int, object interface{})
+func (rndr *BaseRenderer) XmlStatus(w http.ResponseWriter, status int, args ...interface{}) {
+	if err := rndr.RenderXml(w, status, args[0]); err != nil {
 		panic(err)
 	}
 }
 
+// Renders the object as XML.
+func (rndr *BaseRenderer) RenderXml(w http.ResponseWriter, status int, obj interface{}) error {
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(obj); err != nil {
+		return err
+	}
+	writeContents(w, status, "application/xml; charset=UTF-8", buf.Bytes())
+	return nil
+}
+
 // Text(w http.ResponseWriter, format string, formatargs ...interface{})
 func (rndr *BaseRenderer) Text(w http.ResponseWriter, args ...interface{}) {
 	if len(w.Header().Get("Content-Type")) == 0 {
@@ -67,12 +231,55 @@ func (rndr *BaseRenderer) Text(w http.ResponseWriter, args ...interface{}) {
 	fmt.Fprintf(w, format, formatargs...)
 }
 
+// TextStatus(w http.ResponseWriter, status int, format string, formatargs ...interface{})
+func (rndr *BaseRenderer) TextStatus(w http.ResponseWriter, status int, args ...interface{}) {
+	writeStatus(w, status, "text/plain; charset=UTF-8")
+	rndr.Text(w, args...)
+}
+
+// Csv(w http.ResponseWriter, records [][]string, filename string)
+// If the filename is not empty, a Content-Disposition header is set to download the contents as a file.
+func (rndr *BaseRenderer) Csv(w http.ResponseWriter, args ...interface{}) {
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	}
+	records := args[0].([][]string)
+	if len(args) > 1 && len(args[1].(string)) != 0 {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": args[1].(string)}))
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.WriteAll(records); err != nil {
+		panic(err)
+	}
+}
+
 // HtmlTemplateRendererConfig is a configuration object for the HtmlTemplateRenderer
 type HtmlTemplateRendererConfig struct {
 	TemplateDirectory string
 	LeftDelim         string
 	RightDelim        string
 	FuncMap           template.FuncMap
+	// A function that maps a logical template name to an actual template name
+	// based on the request context(e.g. tenants, themes).
+	// The context is nil if the writer is not a cidre.ResponseWriter.
+	// Note that names passed to the `include` pipeline are not resolved.
+	// default: nil
+	TemplateResolver func(string, *Context) string
+	// An alternative to the TemplateDirectory(e.g. embed.FS).
+	// If this value is not nil, the TemplateDirectory is ignored.
+	//
+	//     //go:embed templates
+	//     var templates embed.FS
+	//     sub, _ := fs.Sub(templates, "templates")
+	//     config.TemplateFS = sub
+	//
+	// default: nil
+	TemplateFS fs.FS
+	// Re-reads and re-parses template files on each RenderTemplateFile call if true.
+	// Layouts are re-detected, and template files added after Compile are loaded.
+	// This option is useful for development, and is enabled by AppConfig.Debug.
+	// default: false
+	Reload bool
 }
 
 // Returns a HtmlTemplateRendererConfig object that has default values set.
@@ -81,9 +288,12 @@ type HtmlTemplateRendererConfig struct {
 func DefaultHtmlTemplateRendererConfig(init ...func(*HtmlTemplateRendererConfig)) *HtmlTemplateRendererConfig {
 	rndr := &HtmlTemplateRendererConfig{
 		TemplateDirectory: "",
+		TemplateFS:        nil,
 		LeftDelim:         "{{",
 		RightDelim:        "}}",
 		FuncMap:           template.FuncMap{},
+		TemplateResolver:  nil,
+		Reload:            false,
 	}
 	if len(init) > 0 {
 		init[0](rndr)
@@ -101,9 +311,18 @@ func DefaultHtmlTemplateRendererConfig(init ...func(*HtmlTemplateRendererConfig)
 //     |     |- main_layout.tpl
 //     |     |- admin_layout.tpl
 //     |
+//     |- admin
+//     |     |
+//     |     |- index.tpl
+//     |
 //     |- page1.tpl
 //     |- page2.tpl
 //
+// Templates are named by their paths relative to the template directory without
+// the extension, like "layout/main_layout" and "admin/index". A name without directories
+// like "main_layout" can also be used if only one template has the name. Names are
+// resolved in the same way by renderers, `extends` comments and `include` pipelines.
+//
 // HtmlTemplateRenderer supports layout by providing an `yield` pipeline.
 //
 // page1.tpl
@@ -115,6 +334,28 @@ func DefaultHtmlTemplateRendererConfig(init ...func(*HtmlTemplateRendererConfig)
 //    {{ yield }}
 //    </body></html>
 //
+// Layouts can also extend other layouts.
+//
+// admin_layout.tpl
+//    {{/* extends main_layout */}}
+//    <div class="admin">{{ yield }}</div>
+//
+// Pages can provide sections with html/template's `define` actions, and layouts
+// retrieve them with `yield "name"`. If the page(or inner layouts) does not define the section,
+// the layout's own definition is used as the default, or an empty string if the layout
+// does not define it either.
+//
+// page1.tpl
+//    {{/* extends main_layout */}}
+//    {{ define "title" }}Page1{{ end }}
+//    <div>content</div>
+//
+// main_layout.tpl
+//    <html><head><title>{{ yield "title" }}</title></head><body>
+//    {{ yield }}
+//    </body></html>
+//    {{ define "title" }}Default title{{ end }}
+//
 // An `include` pileline is like an html/template's `template` pipeline, but
 // it accepts "name" parameter dynamically.
 //
@@ -125,75 +366,230 @@ func DefaultHtmlTemplateRendererConfig(init ...func(*HtmlTemplateRendererConfig)
 type HtmlTemplateRenderer struct {
 	BaseRenderer
 	Config    *HtmlTemplateRendererConfig
+	mutex     sync.RWMutex
 	templates map[string]*template.Template
-	layouts   map[string]string
+	// templates that are never executed, since html/template can not clone executed templates.
+	bases   map[string]*template.Template
+	layouts map[string]string
+	paths   map[string]string
+	// template names by their base names, like "index" -> ["admin/index", "public/index"]
+	names map[string][]string
+	// paths, modification times and sizes of the template files at the last compilation.
+	stamp        string
+	compileMutex sync.Mutex
 }
 
 func NewHtmlTemplateRenderer(config *HtmlTemplateRendererConfig) *HtmlTemplateRenderer {
 	rndr := &HtmlTemplateRenderer{
 		Config:    config,
 		templates: make(map[string]*template.Template),
+		bases:     make(map[string]*template.Template),
 		layouts:   make(map[string]string),
+		paths:     make(map[string]string),
+		names:     make(map[string][]string),
 	}
 	return rndr
 }
 
 func (rndr *HtmlTemplateRenderer) SetTemplate(name string, tpl *template.Template) {
+	base, err := tpl.Clone()
+	if err != nil {
+		panic(err)
+	}
+	rndr.mutex.Lock()
+	defer rndr.mutex.Unlock()
 	rndr.templates[name] = tpl
+	rndr.bases[name] = base
 }
 
 func (rndr *HtmlTemplateRenderer) GetTemplate(name string) (*template.Template, bool) {
+	rndr.mutex.RLock()
+	defer rndr.mutex.RUnlock()
 	v, ok := rndr.templates[name]
 	return v, ok
 }
 
 func (rndr *HtmlTemplateRenderer) SetLayout(name, layout string) {
+	rndr.mutex.Lock()
+	defer rndr.mutex.Unlock()
 	rndr.layouts[name] = layout
 }
 
 func (rndr *HtmlTemplateRenderer) GetLayout(name string) (string, bool) {
+	rndr.mutex.RLock()
+	defer rndr.mutex.RUnlock()
 	v, ok := rndr.layouts[name]
 	return v, ok
 }
 
+// Compiles all template files. Compile panics if a template file can not be read or parsed.
 func (rndr *HtmlTemplateRenderer) Compile() {
-	if len(rndr.Config.TemplateDirectory) == 0 {
-		return
+	if err := rndr.compile(); err != nil {
+		panic(err)
+	}
+}
+
+func (rndr *HtmlTemplateRenderer) compile() error {
+	var firstErr error
+	stamp := rndr.walkTemplates(func(tplname, path string) {
+		if err := rndr.loadTemplate(tplname, path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	})
+	rndr.mutex.Lock()
+	rndr.stamp = stamp
+	rndr.mutex.Unlock()
+	return firstErr
+}
+
+// Calls the function for each template file, and returns a string that changes
+// if template files are added, removed or modified.
+func (rndr *HtmlTemplateRenderer) walkTemplates(f func(tplname, path string)) string {
+	var stamp strings.Builder
+	if rndr.Config.TemplateFS != nil {
+		fs.WalkDir(rndr.Config.TemplateFS, ".", func(path string, entry fs.DirEntry, err error) error {
+			filename := pathpkg.Base(path)
+			if err != nil || entry.IsDir() || !strings.HasSuffix(filename, ".tpl") {
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				fmt.Fprintf(&stamp, "%v:%v:%v\n", path, info.ModTime().UnixNano(), info.Size())
+			}
+			if f != nil {
+				f(path[0:len(path)-len(".tpl")], path)
+			}
+			return nil
+		})
+	} else if len(rndr.Config.TemplateDirectory) != 0 {
+		filepath.Walk(rndr.Config.TemplateDirectory, func(path string, file os.FileInfo, err error) error {
+			filename := filepath.Base(path)
+			if err != nil || !strings.HasSuffix(filename, ".tpl") {
+				return nil
+			}
+			rel, err := filepath.Rel(rndr.Config.TemplateDirectory, path)
+			if err != nil {
+				return nil
+			}
+			fmt.Fprintf(&stamp, "%v:%v:%v\n", path, file.ModTime().UnixNano(), file.Size())
+			if f != nil {
+				rel = filepath.ToSlash(rel)
+				f(rel[0:len(rel)-len(".tpl")], path)
+			}
+			return nil
+		})
+	}
+	return stamp.String()
+}
+
+// Reads and parses the template file, then caches it by the given name.
+func (rndr *HtmlTemplateRenderer) loadTemplate(tplname, path string) error {
+	var bts []byte
+	var err error
+	if rndr.Config.TemplateFS != nil {
+		bts, err = fs.ReadFile(rndr.Config.TemplateFS, path)
+	} else {
+		bts, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return err
 	}
 
 	funcMap := template.FuncMap{
-		"include": func(name string, param interface{}) template.HTML {
+		"include": func(name string, param interface{}) (template.HTML, error) {
 			var buf bytes.Buffer
-			rndr.RenderTemplateFile(&buf, name, param)
-			return template.HTML(buf.String())
+			err := rndr.renderTemplateFile(&buf, name, param)
+			return template.HTML(buf.String()), err
 		},
 		"raw": func(h string) template.HTML { return template.HTML(h) },
 		// parse time dummy function
-		"yield": func() template.HTML { return template.HTML("") },
+		"yield": func(...string) template.HTML { return template.HTML("") },
+		// replaced if the request has been passed through a CsrfMiddleware
+		"csrf_token": func() string { return "" },
+		"csrf_field": func() template.HTML { return template.HTML("") },
 	}
 
 	extendsReg := regexp.MustCompile(regexp.QuoteMeta(rndr.Config.LeftDelim) + `/\*\s*extends\s*([^\s]+)\s*\*/` + regexp.QuoteMeta(rndr.Config.RightDelim))
-	filepath.Walk(rndr.Config.TemplateDirectory, func(path string, file os.FileInfo, err error) error {
-		filename := filepath.Base(path)
-		if err != nil || !strings.HasSuffix(filename, ".tpl") {
-			return nil
-		}
-		tplname := filename[0 : len(filename)-len(".tpl")]
-		bts, err1 := ioutil.ReadFile(path)
-		if err1 != nil {
-			panic(err1)
+	matches := extendsReg.FindAllSubmatch(bts, -1)
+	tplobj, err := template.New("").Delims(rndr.Config.LeftDelim, rndr.Config.RightDelim).Funcs(rndr.Config.FuncMap).Funcs(funcMap).Parse(string(bts))
+	if err != nil {
+		return err
+	}
+	base, err := tplobj.Clone()
+	if err != nil {
+		return err
+	}
+	rndr.mutex.Lock()
+	defer rndr.mutex.Unlock()
+	rndr.bases[tplname] = base
+	if len(matches) > 0 {
+		rndr.layouts[tplname] = string(matches[0][1])
+	} else {
+		delete(rndr.layouts, tplname)
+	}
+	rndr.templates[tplname] = tplobj
+	if _, ok := rndr.paths[tplname]; !ok {
+		base := pathpkg.Base(tplname)
+		rndr.names[base] = append(rndr.names[base], tplname)
+	}
+	rndr.paths[tplname] = path
+	return nil
+}
+
+// Returns a template name for the given name. A name without directories is resolved
+// if only one template has the name. lookupTemplateName panics if the name is ambiguous.
+func (rndr *HtmlTemplateRenderer) lookupTemplateName(name string) (string, bool) {
+	rndr.mutex.RLock()
+	defer rndr.mutex.RUnlock()
+	if _, ok := rndr.templates[name]; ok {
+		return name, true
+	}
+	candidates := rndr.names[name]
+	switch len(candidates) {
+	case 0:
+		return name, false
+	case 1:
+		return candidates[0], true
+	}
+	files := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		files = append(files, rndr.paths[candidate])
+	}
+	sort.Strings(files)
+	panic(fmt.Sprintf("Template name '%v' is ambiguous: %v", name, strings.Join(files, ", ")))
+}
+
+// Resolves the template name, and reloads the template if Config.Reload is true.
+// Templates are compiled again only if template files have been changed since the last compilation.
+func (rndr *HtmlTemplateRenderer) resolveTemplate(name string) (string, error) {
+	resolved, ok := rndr.lookupTemplateName(name)
+	if !rndr.Config.Reload {
+		return resolved, nil
+	}
+	if !ok {
+		// the template file may have been added after Compile.
+		rndr.compileMutex.Lock()
+		defer rndr.compileMutex.Unlock()
+		rndr.mutex.RLock()
+		stamp := rndr.stamp
+		rndr.mutex.RUnlock()
+		if rndr.walkTemplates(nil) == stamp {
+			return resolved, nil
 		}
-		matches := extendsReg.FindAllSubmatch(bts, -1)
-		if len(matches) > 0 {
-			rndr.SetLayout(tplname, string(matches[0][1]))
+		if err := rndr.compile(); err != nil {
+			return "", err
 		}
-		tplobj, err2 := template.New("").Delims(rndr.Config.LeftDelim, rndr.Config.RightDelim).Funcs(rndr.Config.FuncMap).Funcs(funcMap).Parse(string(bts))
-		if err2 != nil {
-			panic(err2)
+		resolved, _ = rndr.lookupTemplateName(name)
+		return resolved, nil
+	}
+	rndr.mutex.RLock()
+	path, ok := rndr.paths[resolved]
+	rndr.mutex.RUnlock()
+	if ok {
+		if err := rndr.loadTemplate(resolved, path); err != nil {
+			return "", err
 		}
-		rndr.SetTemplate(tplname, tplobj)
-		return nil
-	})
+	}
+	return resolved, nil
 }
 
 func (rndr *HtmlTemplateRenderer) getTempalte(name string) *template.Template {
@@ -204,33 +600,259 @@ func (rndr *HtmlTemplateRenderer) getTempalte(name string) *template.Template {
 	return tpl
 }
 
+func (rndr *HtmlTemplateRenderer) resolveTemplateName(w io.Writer, name string) string {
+	if rndr.Config.TemplateResolver == nil {
+		return name
+	}
+	return rndr.Config.TemplateResolver(name, responseContext(w))
+}
+
+// Renders the template. If the writer is a cidre.ResponseWriter for a request that has been passed through
+// a CsrfMiddleware, `csrf_token` and `csrf_field` functions embed the CSRF token of the request.
+// RenderTemplateFile panics with a *TemplateError if the template fails to execute.
 func (rndr *HtmlTemplateRenderer) RenderTemplateFile(w io.Writer, name string, param interface{}) {
+	if err := rndr.executeTemplateFile(w, w, name, param); err != nil {
+		panic(err)
+	}
+}
+
+// Renders the template into the out. The w is used to get the request context.
+func (rndr *HtmlTemplateRenderer) executeTemplateFile(out, w io.Writer, name string, param interface{}) error {
+	return rndr.renderTemplateFileFunc(out, rndr.resolveTemplateName(w, name), param, csrfTemplateFuncs(responseContext(w)))
+}
+
+// Same as RenderTemplateFile, but the given functions override functions of the template,
+// its layouts and templates included by the `include` pipeline. The cached templates are not modified.
+// Functions must be declared in the HtmlTemplateRendererConfig.FuncMap because templates are parsed at compile time.
+//
+//     config.FuncMap["current_user"] = func() string { return "" }
+//     ...
+//     renderer.RenderTemplateFileFunc(w, "form", param, template.FuncMap{
+//         "current_user": func() string { return user.Name },
+//     })
+func (rndr *HtmlTemplateRenderer) RenderTemplateFileFunc(w io.Writer, name string, param interface{}, funcs template.FuncMap) {
+	if csrfFuncs := csrfTemplateFuncs(responseContext(w)); csrfFuncs != nil {
+		for key, value := range funcs {
+			csrfFuncs[key] = value
+		}
+		funcs = csrfFuncs
+	}
+	if err := rndr.renderTemplateFileFunc(w, rndr.resolveTemplateName(w, name), param, funcs); err != nil {
+		panic(err)
+	}
+}
+
+// Returns a copy of the template with the given functions.
+func (rndr *HtmlTemplateRenderer) templateWithFuncs(name string, funcs template.FuncMap) *template.Template {
+	rndr.getTempalte(name)
+	rndr.mutex.RLock()
+	base := rndr.bases[name]
+	rndr.mutex.RUnlock()
+	tpl, err := base.Clone()
+	if err != nil {
+		panic(err)
+	}
+	if funcs != nil {
+		tpl.Funcs(funcs)
+		tpl.Funcs(template.FuncMap{
+			"include": func(name string, param interface{}) (template.HTML, error) {
+				var buf bytes.Buffer
+				err := rndr.renderTemplateFileFunc(&buf, name, param, funcs)
+				return template.HTML(buf.String()), err
+			},
+		})
+	}
+	return tpl
+}
+
+func (rndr *HtmlTemplateRenderer) renderTemplateFile(w io.Writer, name string, param interface{}) error {
+	return rndr.renderTemplateFileFunc(w, name, param, nil)
+}
+
+// Renders the template and its layouts into a buffer, then writes the buffer to the writer
+// only if all templates are successfully executed.
+func (rndr *HtmlTemplateRenderer) renderTemplateFileFunc(w io.Writer, name string, param interface{}, funcs template.FuncMap) error {
+	name, err := rndr.resolveTemplate(name)
+	if err != nil {
+		return err
+	}
 	tpl := rndr.getTempalte(name)
+	if funcs != nil {
+		tpl = rndr.templateWithFuncs(name, funcs)
+	}
 	var buf bytes.Buffer
 	if err := tpl.Execute(&buf, param); err != nil {
-		panic(err)
+		return rndr.newTemplateError(name, err)
 	}
-	layout, ok := rndr.GetLayout(name)
-	if ok {
-		laytoutpl, _ := rndr.getTempalte(layout).Clone()
+	// layouts can extend other layouts: renders each layout into the `yield` of its parent.
+	chain := []string{name}
+	// templates that may define sections, from the innermost one.
+	sources := []*template.Template{tpl}
+	for layout, ok := rndr.GetLayout(name); ok; layout, ok = rndr.GetLayout(layout) {
+		layout, err = rndr.resolveTemplate(layout)
+		if err != nil {
+			return err
+		}
+		for _, n := range chain {
+			if n == layout {
+				panic(fmt.Sprintf("Cyclic template layouts: %v -> %v", strings.Join(chain, " -> "), layout))
+			}
+		}
+		chain = append(chain, layout)
+		laytoutpl := rndr.templateWithFuncs(layout, funcs)
+		content := template.HTML(buf.String())
+		sources = append(sources, laytoutpl)
+		sectionSources := sources
 		laytoutpl.Funcs(template.FuncMap{
-			"yield": func() template.HTML {
-				return template.HTML(buf.String())
+			"yield": func(section ...string) (template.HTML, error) {
+				if len(section) == 0 {
+					return content, nil
+				}
+				return executeSection(sectionSources, section[0], param)
 			},
 		})
-		if err := laytoutpl.Execute(w, param); err != nil {
-			panic(err)
+		buf.Reset()
+		if err := laytoutpl.Execute(&buf, param); err != nil {
+			return rndr.newTemplateError(layout, err)
+		}
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Executes the first template that defines the section.
+func executeSection(sources []*template.Template, name string, param interface{}) (template.HTML, error) {
+	for _, source := range sources {
+		if tpl := source.Lookup(name); tpl != nil {
+			var buf bytes.Buffer
+			if err := tpl.Execute(&buf, param); err != nil {
+				return "", err
+			}
+			return template.HTML(buf.String()), nil
 		}
-	} else {
-		w.Write(buf.Bytes())
 	}
+	return "", nil
 }
 
+// Html(w http.ResponseWriter, name string, param interface{})
+// Html panics with a *TemplateError if the template fails to execute. Nothing is written
+// to the writer in that case, so App.OnPanic can respond with a clean error page.
 func (rndr *HtmlTemplateRenderer) Html(w http.ResponseWriter, args ...interface{}) {
-	if len(w.Header().Get("Content-Type")) == 0 {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if err := rndr.RenderHtml(w, 0, args[0].(string), args[1]); err != nil {
+		panic(err)
+	}
+}
+
+// HtmlStatus(w http.ResponseWriter, status int, name string, param interface{})
+func (rndr *HtmlTemplateRenderer) HtmlStatus(w http.ResponseWriter, status int, args ...interface{}) {
+	if err := rndr.RenderHtml(w, status, args[0].(string), args[1]); err != nil {
+		panic(err)
+	}
+}
+
+// Renders the template. RenderHtml returns a *TemplateError if the template fails to execute.
+func (rndr *HtmlTemplateRenderer) RenderHtml(w http.ResponseWriter, status int, name string, param interface{}) error {
+	var buf bytes.Buffer
+	if err := rndr.executeTemplateFile(&buf, w, name, param); err != nil {
+		return err
+	}
+	writeContents(w, status, "text/html; charset=UTF-8", buf.Bytes())
+	return nil
+}
+
+// TemplateError is an error occurred while executing a template.
+type TemplateError struct {
+	// A name of the template
+	Name string
+	// A path of the template file, or an empty string if the template is not loaded from a file.
+	Path string
+	// A line number of the failing action, or 0 if it is unknown.
+	Line int
+	// Contents of the template file
+	Source string
+	// An error returned by the html/template
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+var templateErrorLinePattern = regexp.MustCompile(`^template: [^:]*:(\d+):`)
+
+// Returns a TemplateError for the given error. Errors that occurred in templates included by
+// the `include` pipeline are returned as they are, since they point to the actual failing line.
+func (rndr *HtmlTemplateRenderer) newTemplateError(name string, err error) error {
+	var tplErr *TemplateError
+	if errors.As(err, &tplErr) {
+		return tplErr
+	}
+	tplErr = &TemplateError{Name: name, Err: err}
+	var escapeErr *template.Error
+	if errors.As(err, &escapeErr) {
+		tplErr.Line = escapeErr.Line
+	} else if matches := templateErrorLinePattern.FindStringSubmatch(err.Error()); matches != nil {
+		tplErr.Line, _ = strconv.Atoi(matches[1])
+	}
+	rndr.mutex.RLock()
+	path, ok := rndr.paths[name]
+	rndr.mutex.RUnlock()
+	if ok {
+		tplErr.Path = path
+		var bts []byte
+		if rndr.Config.TemplateFS != nil {
+			bts, _ = fs.ReadFile(rndr.Config.TemplateFS, path)
+		} else {
+			bts, _ = ioutil.ReadFile(path)
+		}
+		tplErr.Source = string(bts)
 	}
-	name := args[0].(string)
-	param := args[1]
-	rndr.RenderTemplateFile(w, name, param)
+	return tplErr
+}
+
+type templateErrorLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+// Returns source lines around the failing line.
+func (e *TemplateError) sourceLines(around int) []templateErrorLine {
+	if e.Line == 0 || len(e.Source) == 0 {
+		return nil
+	}
+	lines := strings.Split(e.Source, "\n")
+	result := []templateErrorLine{}
+	for i := e.Line - around; i <= e.Line+around; i++ {
+		if i > 0 && i <= len(lines) {
+			result = append(result, templateErrorLine{i, lines[i-1], i == e.Line})
+		}
+	}
+	return result
+}
+
+var templateErrorPage = template.Must(template.New("cidre.templateerror").Parse(`<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>Template error</title></head><body>
+<h1>Template error in '{{ .Err.Name }}'</h1>
+{{ if .Err.Path }}<p>{{ .Err.Path }}{{ if .Err.Line }}, line {{ .Err.Line }}{{ end }}</p>{{ end }}
+<pre>{{ .Err.Err }}</pre>
+{{ if .Lines }}<pre>{{ range .Lines }}{{ if .Current }}<strong>{{ printf "%5d" .Number }}: {{ .Text }}</strong>{{ else }}{{ printf "%5d" .Number }}: {{ .Text }}{{ end }}
+{{ end }}</pre>{{ end }}
+<pre>{{ .Stack }}</pre>
+</body></html>`))
+
+// Writes an HTML page that describes the template error with 500 Internal Server Error.
+func writeTemplateErrorPage(w http.ResponseWriter, err *TemplateError, stack []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusInternalServerError)
+	templateErrorPage.Execute(w, map[string]interface{}{
+		"Err":   err,
+		"Lines": err.sourceLines(3),
+		"Stack": string(stack),
+	})
 }
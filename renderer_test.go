@@ -1,11 +1,17 @@
 package cidre
 
 import (
+	"fmt"
+	"html/template"
+	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 )
 
 type testRenderViewStruct struct {
@@ -36,10 +42,632 @@ func TestRendererJsonAndXml(t *testing.T) {
 	writer := httptest.NewRecorder()
 	renderer.Json(writer, &testRenderViewStruct{"ABCDE", 10})
 	errorIfNotEqual(t, `{"Value":"ABCDE","Int":10}`, strings.TrimSpace(writer.Body.String()))
-	errorIfNotEqual(t, "application/json", writer.Header().Get("Content-Type"))
+	errorIfNotEqual(t, "application/json; charset=UTF-8", writer.Header().Get("Content-Type"))
 
 	writer = httptest.NewRecorder()
 	renderer.Xml(writer, &testRenderViewStruct{"ABCDE", 10})
 	errorIfNotEqual(t, `<testRenderViewStruct><Value>ABCDE</Value><Int>10</Int></testRenderViewStruct>`, strings.TrimSpace(writer.Body.String()))
 	errorIfNotEqual(t, "application/xml; charset=UTF-8", writer.Header().Get("Content-Type"))
 }
+
+func TestRendererTemplateResolver(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	tpldir := filepath.Join(filepath.Dir(file), "_testdata")
+	app := NewApp(DefaultAppConfig())
+	app.Renderer = NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateDirectory = tpldir
+			config.TemplateResolver = func(name string, ctx *Context) string {
+				if ctx.Request.URL.Query().Get("theme") == "theme2" {
+					return name + "2"
+				}
+				return name + "1"
+			}
+		}))
+	app.Renderer.Compile()
+	root := app.MountPoint("/")
+	root.Get("page", "page", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.Html(w, "page", &testRenderViewStruct{"V1", 0})
+	})
+
+	req, _ := http.NewRequest("GET", "/page?theme=theme1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "HEADER\n\n<p>PAGE1:V1</p>\n<p>COMMON</p>\n\n\nFOOTER\n", writer.Body.String())
+
+	req, _ = http.NewRequest("GET", "/page?theme=theme2", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "PAGE2:V1\n", writer.Body.String())
+}
+
+func TestRendererTemplateFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout/layout1.tpl": &fstest.MapFile{Data: []byte("HEADER\n{{ yield }}\nFOOTER\n")},
+		"page1.tpl":          &fstest.MapFile{Data: []byte("{{/* extends layout1 */}}\n<p>PAGE1:{{ .Value }}</p>\n{{ include \"common\" . }}\n")},
+		"common.tpl":         &fstest.MapFile{Data: []byte("<p>COMMON</p>\n")},
+		"readme.txt":         &fstest.MapFile{Data: []byte("not a template")},
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateFS = fsys
+		}))
+	renderer.Compile()
+	writer := httptest.NewRecorder()
+	renderer.Html(writer, "page1", &testRenderViewStruct{"V1", 0})
+	errorIfNotEqual(t, "HEADER\n\n<p>PAGE1:V1</p>\n<p>COMMON</p>\n\n\nFOOTER\n", writer.Body.String())
+	_, ok := renderer.GetTemplate("readme")
+	errorIfNotEqual(t, false, ok)
+}
+
+func TestRendererJsonEtag(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.Renderer = NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig())
+	root := app.MountPoint("/")
+	root.Get("items", "items", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.Json(w, &testRenderViewStruct{"ABCDE", 10})
+	}).Meta.Set(MetaJsonEtag, true)
+	root.Get("items2", "items2", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.Json(w, &testRenderViewStruct{"ABCDE", 10})
+	})
+
+	req, _ := http.NewRequest("GET", "/items", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, 200, writer)
+	AssertJSONEquals(t, `{"Value":"ABCDE","Int":10}`, writer)
+	etag := writer.Header().Get("ETag")
+	errorIfNotEqual(t, true, strings.HasPrefix(etag, `W/"`))
+
+	req, _ = http.NewRequest("GET", "/items", nil)
+	req.Header.Set("If-None-Match", etag)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	AssertStatus(t, 304, writer)
+	errorIfNotEqual(t, "", writer.Body.String())
+
+	req, _ = http.NewRequest("GET", "/items2", nil)
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, "", writer.Header().Get("ETag"))
+}
+
+func TestRendererReload(t *testing.T) {
+	for _, reload := range []bool{false, true} {
+		tpldir := t.TempDir()
+		path := filepath.Join(tpldir, "page.tpl")
+		os.WriteFile(path, []byte("OLD:{{.Value}}"), 0644)
+		renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+			func(config *HtmlTemplateRendererConfig) {
+				config.TemplateDirectory = tpldir
+				config.Reload = reload
+			}))
+		renderer.Compile()
+		writer := httptest.NewRecorder()
+		renderer.Html(writer, "page", &testRenderViewStruct{"V1", 0})
+		errorIfNotEqual(t, "OLD:V1", writer.Body.String())
+
+		os.WriteFile(path, []byte("NEW:{{.Value}}"), 0644)
+		writer = httptest.NewRecorder()
+		renderer.Html(writer, "page", &testRenderViewStruct{"V1", 0})
+		if reload {
+			errorIfNotEqual(t, "NEW:V1", writer.Body.String())
+		} else {
+			errorIfNotEqual(t, "OLD:V1", writer.Body.String())
+		}
+
+		os.Remove(path)
+		err := renderer.RenderHtml(httptest.NewRecorder(), 0, "page", &testRenderViewStruct{"V1", 0})
+		errorIfNotEqual(t, reload, err != nil)
+	}
+}
+
+func TestRendererJsonp(t *testing.T) {
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig())
+	writer := httptest.NewRecorder()
+	renderer.Jsonp(writer, "jQuery.callback_1", &testRenderViewStruct{"ABCDE", 10})
+	errorIfNotEqual(t, `jQuery.callback_1({"Value":"ABCDE","Int":10});`, writer.Body.String())
+	errorIfNotEqual(t, "application/javascript", writer.Header().Get("Content-Type"))
+
+	for _, callback := range []string{"", "1abc", "alert(1);//", "a b"} {
+		func() {
+			defer func() {
+				if recv := recover(); recv == nil {
+					t.Errorf("should cause panic for an invalid callback '%v'", callback)
+				}
+			}()
+			renderer.Jsonp(httptest.NewRecorder(), callback, &testRenderViewStruct{"ABCDE", 10})
+		}()
+	}
+}
+
+func TestRendererJsonOptions(t *testing.T) {
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig())
+	obj := &testRenderViewStruct{"<a href=\"/?a=1&b=2\">", 10}
+	writer := httptest.NewRecorder()
+	renderer.Json(writer, obj)
+	errorIfNotEqual(t, `{"Value":"\u003ca href=\"/?a=1\u0026b=2\"\u003e","Int":10}`+"\n", writer.Body.String())
+
+	renderer.SetJsonIndent("  ")
+	renderer.SetJsonEscapeHTML(false)
+	writer = httptest.NewRecorder()
+	renderer.Json(writer, obj)
+	errorIfNotEqual(t, "{\n  \"Value\": \"<a href=\\\"/?a=1&b=2\\\">\",\n  \"Int\": 10\n}\n", writer.Body.String())
+
+	renderer.SetJsonIndent("")
+	renderer.SetJsonPrefix(")]}',\n")
+	writer = httptest.NewRecorder()
+	renderer.Json(writer, obj)
+	errorIfNotEqual(t, ")]}',\n{\"Value\":\"<a href=\\\"/?a=1&b=2\\\">\",\"Int\":10}\n", writer.Body.String())
+	errorIfNotEqual(t, "application/json; charset=UTF-8", writer.Header().Get("Content-Type"))
+}
+
+func TestRendererJsonResponses(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+			c.AutoMaxProcs = false
+			c.Debug = debug
+		}))
+		app.Logger = func(LogLevel, string) {}
+		app.AccessLogger = func(LogLevel, string) {}
+		status, contentLength := 0, 0
+		app.Hooks.Add("end_request", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+			status = w.(ResponseWriter).Status()
+			contentLength = w.(ResponseWriter).ContentLength()
+		})
+		root := app.MountPoint("/")
+		root.Get("json", "json", func(w http.ResponseWriter, r *http.Request) {
+			app.Renderer.JsonStatus(w, http.StatusAccepted, &testRenderViewStruct{"ABCDE", 10})
+		})
+		root.Get("broken", "broken", func(w http.ResponseWriter, r *http.Request) {
+			app.Renderer.JsonStatus(w, http.StatusAccepted, map[string]interface{}{"ch": make(chan int)})
+		})
+		app.Setup()
+		client := NewTestClient(app)
+
+		expected := `{"Value":"ABCDE","Int":10}` + "\n"
+		if debug {
+			expected = "{\n  \"Value\": \"ABCDE\",\n  \"Int\": 10\n}\n"
+		}
+		res := client.Get("/json")
+		errorIfNotEqual(t, expected, res.String())
+		errorIfNotEqual(t, http.StatusAccepted, status)
+		errorIfNotEqual(t, len(expected), contentLength)
+
+		res = client.Get("/broken")
+		errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+		errorIfNotEqual(t, http.StatusInternalServerError, status)
+		if strings.Contains(res.String(), `{"ch"`) {
+			t.Errorf("partial contents should not be written, but got '%v'", res.String())
+		}
+	}
+}
+
+func TestRendererCsv(t *testing.T) {
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig())
+	writer := httptest.NewRecorder()
+	renderer.Csv(writer, [][]string{{"name", "address"}, {"alice", "Tokyo, Japan"}, {"bob", `"quoted"`}}, "report.csv")
+	errorIfNotEqual(t, "name,address\nalice,\"Tokyo, Japan\"\nbob,\"\"\"quoted\"\"\"\n", writer.Body.String())
+	errorIfNotEqual(t, "text/csv; charset=UTF-8", writer.Header().Get("Content-Type"))
+	errorIfNotEqual(t, "attachment; filename=report.csv", writer.Header().Get("Content-Disposition"))
+}
+
+func TestRendererStatus(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.TemplateDirectory = filepath.Join(filepath.Dir(file), "_testdata")
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	status := 0
+	app.Hooks.Add("end_request", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		status = w.(ResponseWriter).Status()
+	})
+	root := app.MountPoint("/")
+	root.Post("json", "json", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.JsonStatus(w, http.StatusCreated, &testRenderViewStruct{"ABCDE", 10})
+	})
+	root.Get("xml", "xml", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.XmlStatus(w, http.StatusAccepted, &testRenderViewStruct{"ABCDE", 10})
+	})
+	root.Get("text", "text", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.TextStatus(w, http.StatusUnprocessableEntity, "invalid:%v", 1)
+	})
+	root.Get("html", "html", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.HtmlStatus(w, http.StatusNotFound, "page2", &testRenderViewStruct{"V1", 0})
+	})
+	client := NewTestClient(app)
+
+	res := client.Post("/json", "application/json", nil)
+	errorIfNotEqual(t, http.StatusCreated, res.Status)
+	errorIfNotEqual(t, http.StatusCreated, status)
+	errorIfNotEqual(t, "application/json; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, `{"Value":"ABCDE","Int":10}`, strings.TrimSpace(res.String()))
+
+	res = client.Get("/xml")
+	errorIfNotEqual(t, http.StatusAccepted, res.Status)
+	errorIfNotEqual(t, "application/xml; charset=UTF-8", res.Header.Get("Content-Type"))
+
+	res = client.Get("/text")
+	errorIfNotEqual(t, http.StatusUnprocessableEntity, res.Status)
+	errorIfNotEqual(t, "invalid:1", res.String())
+
+	res = client.Get("/html")
+	errorIfNotEqual(t, http.StatusNotFound, res.Status)
+	errorIfNotEqual(t, "text/html; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, "PAGE2:V1\n", res.String())
+}
+
+func TestRendererTemplateFSReload(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout/layout1.tpl": &fstest.MapFile{Data: []byte("<p>{{ yield }}</p>")},
+		"page1.tpl":          &fstest.MapFile{Data: []byte("{{/* extends layout1 */}}OLD")},
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateFS = fsys
+			config.Reload = true
+		}))
+	renderer.Compile()
+	writer := httptest.NewRecorder()
+	renderer.Html(writer, "page1", nil)
+	errorIfNotEqual(t, "<p>OLD</p>", writer.Body.String())
+
+	fsys["layout/layout1.tpl"] = &fstest.MapFile{Data: []byte("<div>{{ yield }}</div>")}
+	fsys["page1.tpl"] = &fstest.MapFile{Data: []byte("{{/* extends layout1 */}}NEW")}
+	writer = httptest.NewRecorder()
+	renderer.Html(writer, "page1", nil)
+	errorIfNotEqual(t, "<div>NEW</div>", writer.Body.String())
+
+	// pages can switch layouts, and new templates are loaded
+	fsys["layout/layout2.tpl"] = &fstest.MapFile{Data: []byte("<span>{{ yield }}</span>")}
+	fsys["page1.tpl"] = &fstest.MapFile{Data: []byte("{{/* extends layout2 */}}NEW")}
+	writer = httptest.NewRecorder()
+	renderer.Html(writer, "page1", nil)
+	errorIfNotEqual(t, "<span>NEW</span>", writer.Body.String())
+
+	fsys["page1.tpl"] = &fstest.MapFile{Data: []byte("NO LAYOUT")}
+	writer = httptest.NewRecorder()
+	renderer.Html(writer, "page1", nil)
+	errorIfNotEqual(t, "NO LAYOUT", writer.Body.String())
+
+	fsys["page2.tpl"] = &fstest.MapFile{Data: []byte("{{/* extends layout1 */}}PAGE2")}
+	writer = httptest.NewRecorder()
+	renderer.Html(writer, "page2", nil)
+	errorIfNotEqual(t, "<div>PAGE2</div>", writer.Body.String())
+
+	// templates are not compiled again for unknown names if no files are changed
+	layout, _ := renderer.GetTemplate("layout/layout1")
+	func() {
+		defer func() {
+			errorIfNotEqual(t, "template 'missing' not found.", recover())
+		}()
+		renderer.Html(httptest.NewRecorder(), "missing", nil)
+	}()
+	current, _ := renderer.GetTemplate("layout/layout1")
+	errorIfNotEqual(t, layout, current)
+}
+
+func TestRendererReloadConcurrently(t *testing.T) {
+	tpldir := t.TempDir()
+	path := filepath.Join(tpldir, "page.tpl")
+	os.WriteFile(path, []byte("OLD"), 0644)
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateDirectory = tpldir
+			config.Reload = true
+		}))
+	renderer.Compile()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				writer := httptest.NewRecorder()
+				renderer.Html(writer, "page", nil)
+				if body := writer.Body.String(); body != "OLD" && body != "NEW" {
+					t.Errorf("unexpected output: '%v'", body)
+				}
+			}
+		}()
+	}
+	os.WriteFile(path+".tmp", []byte("NEW"), 0644)
+	os.Rename(path+".tmp", path)
+	wg.Wait()
+	writer := httptest.NewRecorder()
+	renderer.Html(writer, "page", nil)
+	errorIfNotEqual(t, "NEW", writer.Body.String())
+}
+
+func TestRendererAuto(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.TemplateDirectory = filepath.Join(filepath.Dir(file), "_testdata")
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.Auto(w, r, &testRenderViewStruct{"V1", 10})
+	}
+	root.Get("item", "item", handler)
+	root.Get("page", "page", handler).Meta.Set(MetaTemplateName, "page2")
+	client := NewTestClient(app)
+	get := func(path, accept string) *TestResponse {
+		req := client.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		return client.Do(req)
+	}
+
+	res := get("/item", "text/html;q=0.9, application/xml")
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "application/xml; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, "Accept", res.Header.Get("Vary"))
+
+	res = get("/item", "*/*")
+	errorIfNotEqual(t, "application/json; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, `{"Value":"V1","Int":10}`, strings.TrimSpace(res.String()))
+
+	res = get("/item", "text/*, application/json;q=0.5")
+	errorIfNotEqual(t, "text/plain; charset=UTF-8", res.Header.Get("Content-Type"))
+
+	res = get("/page", "text/html, */*;q=0.1")
+	errorIfNotEqual(t, "text/html; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, "PAGE2:V1\n", res.String())
+
+	res = get("/item", "image/png")
+	errorIfNotEqual(t, http.StatusNotAcceptable, res.Status)
+
+	res = get("/item", "application/json;q=0, */*")
+	errorIfNotEqual(t, "application/xml; charset=UTF-8", res.Header.Get("Content-Type"))
+
+	app.OnNotAcceptable = func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.TextStatus(w, http.StatusNotAcceptable, "custom")
+	}
+	res = get("/item", "image/png")
+	errorIfNotEqual(t, http.StatusNotAcceptable, res.Status)
+	errorIfNotEqual(t, "custom", res.String())
+}
+
+func TestRendererNestedLayouts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout/site.tpl":    &fstest.MapFile{Data: []byte("<html>{{ yield }}</html>")},
+		"layout/section.tpl": &fstest.MapFile{Data: []byte("{{/* extends site */}}<div>{{ .Value }}:{{ yield }}</div>")},
+		"page.tpl":           &fstest.MapFile{Data: []byte("{{/* extends section */}}<p>{{ .Value }}</p>")},
+		"layout/cycle1.tpl":  &fstest.MapFile{Data: []byte("{{/* extends cycle2 */}}1{{ yield }}")},
+		"layout/cycle2.tpl":  &fstest.MapFile{Data: []byte("{{/* extends cycle1 */}}2{{ yield }}")},
+		"layout/self.tpl":    &fstest.MapFile{Data: []byte("{{/* extends self */}}{{ yield }}")},
+		"cycle.tpl":          &fstest.MapFile{Data: []byte("{{/* extends cycle1 */}}page")},
+		"self_page.tpl":      &fstest.MapFile{Data: []byte("{{/* extends self */}}page")},
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateFS = fsys
+		}))
+	renderer.Compile()
+	writer := httptest.NewRecorder()
+	renderer.Html(writer, "page", &testRenderViewStruct{"V1", 0})
+	errorIfNotEqual(t, "<html><div>V1:<p>V1</p></div></html>", writer.Body.String())
+
+	for _, c := range []struct{ name, message string }{
+		{"cycle", "Cyclic template layouts: cycle -> layout/cycle1 -> layout/cycle2 -> layout/cycle1"},
+		{"self_page", "Cyclic template layouts: self_page -> layout/self -> layout/self"},
+	} {
+		func() {
+			defer func() {
+				errorIfNotEqual(t, c.message, fmt.Sprint(recover()))
+			}()
+			renderer.Html(httptest.NewRecorder(), c.name, nil)
+		}()
+	}
+}
+
+func TestRendererNegotiate(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+		c.TemplateDirectory = filepath.Join(filepath.Dir(file), "_testdata")
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Get("item", "item", func(w http.ResponseWriter, r *http.Request) {
+		item := &testRenderViewStruct{"V1", 10}
+		app.Renderer.Negotiate(w, r, map[string]interface{}{
+			"text/plain":       "V1",
+			"application/json": item,
+			"text/html":        TemplateOffer{"page2", item},
+		})
+	})
+	client := NewTestClient(app)
+	get := func(accept string) *TestResponse {
+		req := client.NewRequest("GET", "/item", nil)
+		req.Header.Set("Accept", accept)
+		return client.Do(req)
+	}
+
+	res := get("application/json")
+	errorIfNotEqual(t, "application/json; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, `{"Value":"V1","Int":10}`, strings.TrimSpace(res.String()))
+	errorIfNotEqual(t, "Accept", res.Header.Get("Vary"))
+
+	res = get("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	errorIfNotEqual(t, "text/html; charset=UTF-8", res.Header.Get("Content-Type"))
+	errorIfNotEqual(t, "PAGE2:V1\n", res.String())
+
+	res = get("text/plain;q=0.5, application/json;q=0.1")
+	errorIfNotEqual(t, "V1", res.String())
+
+	res = get("*/*")
+	errorIfNotEqual(t, "application/json; charset=UTF-8", res.Header.Get("Content-Type"))
+
+	res = get("")
+	errorIfNotEqual(t, "application/json; charset=UTF-8", res.Header.Get("Content-Type"))
+
+	res = get("application/xml")
+	errorIfNotEqual(t, http.StatusNotAcceptable, res.Status)
+}
+
+func TestRendererTemplateFileFunc(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout/site.tpl": &fstest.MapFile{Data: []byte("<html>{{ user }}:{{ yield }}</html>")},
+		"page.tpl":        &fstest.MapFile{Data: []byte(`{{/* extends site */}}<p>{{ user }}:{{ .Value }}</p>{{ include "part" . }}{{ raw "<br>" }}`)},
+		"part.tpl":        &fstest.MapFile{Data: []byte("<i>{{ user }}</i>")},
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateFS = fsys
+			config.FuncMap["user"] = func() string { return "guest" }
+		}))
+	renderer.Compile()
+
+	var buf strings.Builder
+	renderer.RenderTemplateFile(&buf, "page", &testRenderViewStruct{"V1", 0})
+	errorIfNotEqual(t, "<html>guest:<p>guest:V1</p><i>guest</i><br></html>", buf.String())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := fmt.Sprintf("user%d", i)
+			var buf strings.Builder
+			renderer.RenderTemplateFileFunc(&buf, "page", &testRenderViewStruct{"V1", 0}, template.FuncMap{
+				"user": func() string { return user },
+			})
+			errorIfNotEqual(t, fmt.Sprintf("<html>%s:<p>%s:V1</p><i>%s</i><br></html>", user, user, user), buf.String())
+		}(i)
+	}
+	wg.Wait()
+
+	buf.Reset()
+	renderer.RenderTemplateFile(&buf, "page", &testRenderViewStruct{"V1", 0})
+	errorIfNotEqual(t, "<html>guest:<p>guest:V1</p><i>guest</i><br></html>", buf.String())
+}
+
+func TestRendererTemplateSubdirectories(t *testing.T) {
+	tpldir := t.TempDir()
+	for path, content := range map[string]string{
+		"layout/main.tpl":   "<html>{{ yield }}</html>",
+		"admin/layout.tpl":  "{{/* extends main */}}<div class=\"admin\">{{ yield }}</div>",
+		"admin/index.tpl":   "{{/* extends admin/layout */}}ADMIN{{ include \"admin/menu\" . }}",
+		"admin/menu.tpl":    "<ul></ul>",
+		"public/index.tpl":  "{{/* extends layout/main */}}PUBLIC{{ include \"footer\" . }}",
+		"public/footer.tpl": "<footer></footer>",
+	} {
+		os.MkdirAll(filepath.Join(tpldir, filepath.Dir(path)), 0755)
+		os.WriteFile(filepath.Join(tpldir, path), []byte(content), 0644)
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateDirectory = tpldir
+		}))
+	renderer.Compile()
+
+	writer := httptest.NewRecorder()
+	renderer.Html(writer, "admin/index", nil)
+	errorIfNotEqual(t, `<html><div class="admin">ADMIN<ul></ul></div></html>`, writer.Body.String())
+	writer = httptest.NewRecorder()
+	renderer.Html(writer, "public/index", nil)
+	errorIfNotEqual(t, "<html>PUBLIC<footer></footer></html>", writer.Body.String())
+
+	// unambiguous names without directories
+	writer = httptest.NewRecorder()
+	renderer.Html(writer, "footer", nil)
+	errorIfNotEqual(t, "<footer></footer>", writer.Body.String())
+
+	defer func() {
+		expected := fmt.Sprintf("Template name 'index' is ambiguous: %v, %v",
+			filepath.Join(tpldir, "admin", "index.tpl"), filepath.Join(tpldir, "public", "index.tpl"))
+		errorIfNotEqual(t, expected, fmt.Sprint(recover()))
+	}()
+	renderer.Html(httptest.NewRecorder(), "index", nil)
+}
+
+func TestRendererSections(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout/site.tpl": &fstest.MapFile{Data: []byte(
+			`<title>{{ yield "title" }}</title><head>{{ yield "head" }}</head><body>{{ yield }}</body>{{ define "title" }}Default{{ end }}`)},
+		"layout/admin.tpl": &fstest.MapFile{Data: []byte(
+			`{{/* extends site */}}{{ define "head" }}<link href="admin.css">{{ end }}<div>{{ yield "title" }}|{{ yield }}</div>`)},
+		"provided.tpl": &fstest.MapFile{Data: []byte(
+			`{{/* extends site */}}{{ define "title" }}{{ .Value }}{{ end }}{{ define "head" }}<meta name="{{ .Value }}">{{ end }}<p>BODY</p>`)},
+		"missing.tpl": &fstest.MapFile{Data: []byte(`{{/* extends site */}}<p>BODY</p>`)},
+		"nested.tpl":  &fstest.MapFile{Data: []byte(`{{/* extends admin */}}{{ define "title" }}Admin{{ end }}<p>BODY</p>`)},
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateFS = fsys
+		}))
+	renderer.Compile()
+	for _, c := range []struct{ name, expected string }{
+		{"provided", `<title>V1</title><head><meta name="V1"></head><body><p>BODY</p></body>`},
+		{"missing", `<title>Default</title><head></head><body><p>BODY</p></body>`},
+		{"nested", `<title>Admin</title><head><link href="admin.css"></head><body><div>Admin|<p>BODY</p></div></body>`},
+	} {
+		writer := httptest.NewRecorder()
+		renderer.Html(writer, c.name, &testRenderViewStruct{"V1", 0})
+		errorIfNotEqual(t, c.expected, writer.Body.String())
+	}
+
+	// sections work with per-request functions
+	writer := httptest.NewRecorder()
+	renderer.RenderTemplateFileFunc(writer, "provided", &testRenderViewStruct{"V2", 0}, template.FuncMap{})
+	errorIfNotEqual(t, `<title>V2</title><head><meta name="V2"></head><body><p>BODY</p></body>`, writer.Body.String())
+}
+
+func TestRendererTemplateError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.tpl":  &fstest.MapFile{Data: []byte("<html>{{ yield }}</html>")},
+		"broken.tpl":  &fstest.MapFile{Data: []byte("{{/* extends layout */}}\n<p>BEFORE</p>\n{{ .Missing }}\n<p>AFTER</p>")},
+		"include.tpl": &fstest.MapFile{Data: []byte(`<p>BEFORE</p>{{ include "broken" . }}`)},
+	}
+	renderer := NewHtmlTemplateRenderer(DefaultHtmlTemplateRendererConfig(
+		func(config *HtmlTemplateRendererConfig) {
+			config.TemplateFS = fsys
+		}))
+	var _ ErrorRenderer = renderer
+	for _, name := range []string{"broken", "include"} {
+		writer := httptest.NewRecorder()
+		renderer.Compile()
+		err := renderer.RenderHtml(writer, http.StatusCreated, name, &testRenderViewStruct{"V1", 0})
+		tplErr, ok := err.(*TemplateError)
+		if !ok {
+			t.Fatalf("*TemplateError expected, but got %#v", err)
+		}
+		errorIfNotEqual(t, "broken", tplErr.Name)
+		errorIfNotEqual(t, "broken.tpl", tplErr.Path)
+		errorIfNotEqual(t, 3, tplErr.Line)
+		errorIfNotEqual(t, 0, writer.Body.Len())
+		errorIfNotEqual(t, 0, len(writer.Header()))
+	}
+
+	for _, debug := range []bool{false, true} {
+		app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+			c.Debug = debug
+		}))
+		app.Logger = func(LogLevel, string) {}
+		app.AccessLogger = func(LogLevel, string) {}
+		app.Renderer = renderer
+		app.MountPoint("/").Get("page", "page", func(w http.ResponseWriter, r *http.Request) {
+			app.Renderer.Html(w, "broken", &testRenderViewStruct{"V1", 0})
+		})
+		app.Setup()
+		res := NewTestClient(app).Get("/page")
+		errorIfNotEqual(t, http.StatusInternalServerError, res.Status)
+		if strings.Contains(res.String(), "<p>BEFORE</p>") {
+			t.Errorf("partial contents should not be written, but got '%v'", res.String())
+		}
+		if !debug {
+			errorIfNotEqual(t, "Internal Server Error\n", res.String())
+			continue
+		}
+		errorIfNotEqual(t, "text/html; charset=UTF-8", res.Header.Get("Content-Type"))
+		for _, expected := range []string{"Template error in 'broken'", "broken.tpl, line 3",
+			"can&#39;t evaluate field Missing", "<strong>    3: {{ .Missing }}</strong>", "    2: &lt;p&gt;BEFORE&lt;/p&gt;"} {
+			if !strings.Contains(res.String(), expected) {
+				t.Errorf("error page should contain '%v', but got '%v'", expected, res.String())
+			}
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package cidre
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,18 +18,62 @@ type SessionConfig struct {
 	// default: gossessionid
 	CookieName   string
 	CookieDomain string
-	// default: false
+	// default: false, the Secure attribute is always set if the App serves HTTPS.
 	CookieSecure  bool
 	CookiePath    string
 	CookieExpires time.Duration
+	// A SameSite attribute of the cookie, "Lax", "Strict", "None" or "" (the attribute is omitted).
+	// "None" requires the Secure attribute.
+	// default: ""
+	CookieSameSite string
+	// A Max-Age attribute of the cookie. If this value is 0, the attribute is omitted.
+	// default: 0
+	CookieMaxAge time.Duration
+	// Omits the Domain attribute so that the cookie is sent only to the host that set it,
+	// not to its subdomains. If this value is false and the CookieDomain is empty,
+	// the host of the request is used as the domain.
+	// default: false
+	CookieHostOnly bool
+	// A prefix of the cookie name, "__Host-" or "__Secure-".
+	// Attributes required by the prefix are set automatically.
+	// default: ""
+	CookiePrefix string
 	// A term used to authenticate the cookie value using HMAC
 	Secret string
+	// Terms used to authenticate the cookie value instead of the Secret. The first one is used to
+	// sign cookies, and all of them are used to validate cookies. Cookies signed with old secrets are
+	// re-signed with the first one, so secrets can be rotated without invalidating sessions.
+	// default: nil
+	Secrets []string
+	// Accepts cookies signed by older versions of cidre(see ValidateSignedStringCompat)
+	// until the LegacySignaturesDeadline. Cookies are always signed in the current format,
+	// so this option can be disabled after all sessions signed in the old format have been expired.
+	// Legacy signatures are forgeable: anyone who has a legacy-signed cookie can sign any value.
+	// Forged session ids are useless unless they exist in the store, but cookies of the
+	// CookieSessionStore contain whole sessions, so this option can not be used with the CookieSessionStore.
+	// default: false
+	AcceptLegacySignatures bool
+	// Legacy signatures are rejected after this time. This value is required if
+	// AcceptLegacySignatures is true.
+	// default: zero time
+	LegacySignaturesDeadline time.Time
 	// default: "cidre.MemorySessionStore"
 	SessionStore string
+	// Gc is disabled if this value is 0 or less.
 	// default: 30m
 	GcInterval time.Duration
 	// default: 30m
 	LifeTime time.Duration
+	// A resolution of the last access time. Sessions that have not been modified are saved
+	// only if the last access time stored in the session store is older than this value,
+	// so read-only requests do not write sessions every time.
+	// default: 1m
+	LastAccessTimeResolution time.Duration
+	// A function to be called if the session cookie has an invalid signature, for example,
+	// it has been signed with an old Secret or corrupted. A new session is created
+	// regardless of this function.
+	// default: nil
+	OnInvalidCookie func(http.ResponseWriter, *http.Request, error)
 }
 
 // Returns a SessionConfig object that has default values set.
@@ -35,15 +81,24 @@ type SessionConfig struct {
 // will call the function with the SessionConfig object.
 func DefaultSessionConfig(init ...func(*SessionConfig)) *SessionConfig {
 	self := &SessionConfig{
-		CookieName:    "gosessionid",
-		CookieDomain:  "",
-		CookieSecure:  false,
-		CookiePath:    "",
-		CookieExpires: 0,
-		Secret:        "",
-		SessionStore:  "cidre.MemorySessionStore",
-		GcInterval:    time.Minute * 30,
-		LifeTime:      time.Minute * 30,
+		CookieName:               "gosessionid",
+		CookieDomain:             "",
+		CookieSecure:             false,
+		CookiePath:               "",
+		CookieExpires:            0,
+		CookieSameSite:           "",
+		CookieMaxAge:             0,
+		CookieHostOnly:           false,
+		CookiePrefix:             "",
+		Secret:                   "",
+		Secrets:                  nil,
+		AcceptLegacySignatures:   false,
+		LegacySignaturesDeadline: time.Time{},
+		SessionStore:             "cidre.MemorySessionStore",
+		GcInterval:               time.Minute * 30,
+		LifeTime:                 time.Minute * 30,
+		LastAccessTimeResolution: time.Minute,
+		OnInvalidCookie:          nil,
 	}
 	if len(init) > 0 {
 		init[0](self)
@@ -51,90 +106,343 @@ func DefaultSessionConfig(init ...func(*SessionConfig)) *SessionConfig {
 	return self
 }
 
+const (
+	CookiePrefixHost   = "__Host-"
+	CookiePrefixSecure = "__Secure-"
+)
+
+// Validates the cookie settings against requirements of the CookiePrefix.
+func (sc *SessionConfig) Validate() error {
+	switch sc.CookiePrefix {
+	case "", CookiePrefixSecure:
+	case CookiePrefixHost:
+		if len(sc.CookieDomain) != 0 {
+			return errors.New("Session cookie with the __Host- prefix must not have a domain.")
+		}
+		if len(sc.CookiePath) != 0 && sc.CookiePath != "/" {
+			return errors.New("Session cookie with the __Host- prefix must have a path '/'.")
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown session cookie prefix: '%v'", sc.CookiePrefix))
+	}
+	sameSite, err := sc.sameSite()
+	if err != nil {
+		return err
+	}
+	if sameSite == http.SameSiteNoneMode && !sc.CookieSecure && len(sc.CookiePrefix) == 0 {
+		return errors.New("Session cookie with SameSite=None must be secure.")
+	}
+	if sc.AcceptLegacySignatures && sc.LegacySignaturesDeadline.IsZero() {
+		return errors.New("LegacySignaturesDeadline is required if AcceptLegacySignatures is true.")
+	}
+	return nil
+}
+
+func (sc *SessionConfig) sameSite() (http.SameSite, error) {
+	switch strings.ToLower(sc.CookieSameSite) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Unknown session cookie SameSite: '%v'", sc.CookieSameSite))
+}
+
+// Returns a secret used to sign cookies.
+func (sc *SessionConfig) signingSecret() string {
+	if len(sc.Secrets) != 0 {
+		return sc.Secrets[0]
+	}
+	return sc.Secret
+}
+
+// Returns secrets used to validate cookies.
+func (sc *SessionConfig) validationSecrets() []string {
+	if len(sc.Secrets) != 0 {
+		return sc.Secrets
+	}
+	return []string{sc.Secret}
+}
+
+// Validates the signed string with the secrets.
+func (sc *SessionConfig) validateSignedString(signedString string) (string, error) {
+	var err error
+	for _, secret := range sc.validationSecrets() {
+		var value string
+		if sc.AcceptLegacySignatures && time.Now().Before(sc.LegacySignaturesDeadline) {
+			value, err = ValidateSignedStringCompat(signedString, secret)
+		} else {
+			value, err = ValidateSignedString(signedString, secret)
+		}
+		if err == nil {
+			return value, nil
+		}
+	}
+	return "", err
+}
+
+// Returns a lifetime of the session, the MaxAge of the session if it is set, or the LifeTime.
+func (sc *SessionConfig) sessionLifeTime(session *Session) time.Duration {
+	if session.MaxAge > 0 {
+		return session.MaxAge
+	}
+	return sc.LifeTime
+}
+
+// Returns a cookie name with the CookiePrefix.
+func (sc *SessionConfig) FullCookieName() string {
+	return sc.CookiePrefix + sc.CookieName
+}
+
+// Route.Meta key to disable sessions for the route(e.g. metrics and API endpoints).
+// The SessionMiddleware does not load sessions nor write cookies for the route, so
+// Context.Session is nil in handlers. Routes protected by the CsrfMiddleware must also
+// have the MetaCsrfExempt.
+//
+//     root.Get("metrics", "metrics", handler).Meta.Set(cidre.MetaSessionExempt, true)
+const MetaSessionExempt = "session_exempt"
+
 // Middleware for session management.
+// Hooks(registered to App.Hooks):
+//   - session_created(http.ResponseWriter, *http.Request, *Session) : a new session has been created in the store
+//   - session_loaded(http.ResponseWriter, *http.Request, *Session) : an existing session has been loaded
+//   - session_destroyed(http.ResponseWriter, *http.Request, *Session) : a killed session has been deleted,
+//     or an expired session has been removed by the Gc. The Gc calls hooks with nil http.ResponseWriter and
+//     *http.Request, and only if the store implements the SessionGcReporter or the SessionGcReporterV2.
+//     Sessions evicted or expired in the MemorySessionStore are also reported with nil http.ResponseWriter
+//     and *http.Request.
 type SessionMiddleware struct {
 	app    *App
 	Config *SessionConfig
-	Store  SessionStore
+	// A SessionStore, or nil if the middleware uses a SessionStoreV2 that is not an adapter of SessionStore.
+	Store SessionStore
+	// A store used by the middleware. If the middleware is created with a SessionStore,
+	// StoreV2 is an adapter of the Store.
+	StoreV2 SessionStoreV2
+	encoder SessionCookieEncoder
+	gcMutex sync.Mutex
+	gcStop  chan bool
+	gcDone  chan bool
 }
 
 // Returns a new SessionMiddleware object.
+// A session store is created by the DynamicObjectFactory with the Config.SessionStore name.
 func NewSessionMiddleware(app *App, config *SessionConfig, storeConfig interface{}) *SessionMiddleware {
+	DynamicObjectFactory.Register(MemorySessionStore{}, CookieSessionStore{}, FileSessionStore{})
+	store, err := newSessionStore(config.SessionStore)
+	if err != nil {
+		panic(err)
+	}
+	return NewSessionMiddlewareWithStore(app, config, store, storeConfig)
+}
+
+// Returns a new SessionMiddleware object that uses the given SessionStore.
+// Config.SessionStore is ignored.
+func NewSessionMiddlewareWithStore(app *App, config *SessionConfig, store SessionStore, storeConfig interface{}) *SessionMiddleware {
+	if store == nil {
+		panic("Session store must not be nil.")
+	}
+	sm := NewSessionMiddlewareWithStoreV2(app, config, &sessionStoreAdapter{store}, storeConfig)
+	sm.Store = store
+	sm.encoder, _ = store.(SessionCookieEncoder)
+	return sm
+}
+
+// Returns a new SessionMiddleware object that uses the given SessionStoreV2.
+// Config.SessionStore is ignored.
+func NewSessionMiddlewareWithStoreV2(app *App, config *SessionConfig, store SessionStoreV2, storeConfig interface{}) *SessionMiddleware {
 	sm := &SessionMiddleware{app: app, Config: config}
-	if len(sm.Config.Secret) == 0 {
+	if len(sm.Config.signingSecret()) == 0 {
 		panic("Session secret must not be empty.")
 	}
-	DynamicObjectFactory.Register(MemorySessionStore{})
-	store, _ := DynamicObjectFactory.New(sm.Config.SessionStore).(SessionStore)
-	sm.Store = store
-	sm.Store.Init(sm, storeConfig)
+	if err := sm.Config.Validate(); err != nil {
+		panic(err)
+	}
+	if store == nil {
+		panic("Session store must not be nil.")
+	}
+	sm.StoreV2 = store
+	sm.StoreV2.Init(sm, storeConfig)
+	sm.encoder, _ = store.(SessionCookieEncoder)
+	if adapter, ok := store.(*sessionStoreAdapter); ok {
+		sm.encoder, _ = adapter.SessionStore.(SessionCookieEncoder)
+	}
 
+	if sm.encoder != nil {
+		if sm.Config.AcceptLegacySignatures {
+			panic("AcceptLegacySignatures can not be used with session stores that store sessions in cookies.")
+		}
+		return sm
+	}
 	app.Hooks.Add("start_server", func(w http.ResponseWriter, r *http.Request, data interface{}) {
-		time.AfterFunc(sm.Config.GcInterval, sm.Gc)
+		sm.StartGc()
+	})
+	app.Hooks.Add("stop_server", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		sm.Stop()
 	})
 
 	return sm
 }
 
+func newSessionStore(name string) (SessionStore, error) {
+	obj, err := DynamicObjectFactory.NewSafe(name)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Session store '%v' is not registered to the DynamicObjectFactory.", name))
+	}
+	store, ok := obj.(SessionStore)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Session store '%v'(%T) does not implement the cidre.SessionStore interface.", name, obj))
+	}
+	return store, nil
+}
+
 func (sm *SessionMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := RequestContext(r)
-	if !ctx.IsDynamicRoute() {
+	if !ctx.IsDynamicRoute() || ctx.Route.Meta.GetBool(MetaSessionExempt) {
 		ctx.MiddlewareChain.DoNext(w, r)
 	} else {
 		if !strings.HasPrefix(r.URL.Path, sm.Config.CookiePath) {
 			return
 		}
-		func() {
-			sm.Store.Lock()
-			defer sm.Store.Unlock()
-			signedString, _ := r.Cookie(sm.Config.CookieName)
-			var session *Session
-			if signedString != nil {
-				sessionId, err := ValidateSignedString(signedString.Value, sm.Config.Secret)
-				if err != nil {
-					panic(err)
+		signedString, _ := r.Cookie(sm.Config.FullCookieName())
+		var session *Session
+		var err error
+		if signedString != nil {
+			var sessionId string
+			sessionId, err = sm.Config.validateSignedString(signedString.Value)
+			if err != nil {
+				// discards the cookie, a new session will be created below.
+				sm.app.log(LogLevelDebug, fmt.Sprintf("invalid session cookie: %v", err))
+				if sm.Config.OnInvalidCookie != nil {
+					sm.Config.OnInvalidCookie(w, r, err)
 				}
-				session = sm.Store.Load(sessionId)
 			} else {
-				session = sm.Store.NewSession()
-			}
-			if session != nil {
-				ctx.Session = session
-				session.UpdateLastAccessTime()
+				if pinner, ok := sm.Store.(sessionPinner); ok {
+					// the session is not evicted while the request is served.
+					pinner.pinSession(sessionId)
+					defer pinner.unpinSession(sessionId)
+				}
+				session, err = sm.loadSession(r.Context(), sessionId)
+				sm.reportRemovedSessions()
+				if err != nil {
+					sm.app.OnSessionError(w, r, err)
+					return
+				}
+				if session == nil {
+					sm.app.log(LogLevelDebug, "unknown or expired session cookie")
+				} else {
+					// stores may build sessions with Set or Update.
+					session.dirty = false
+					sm.app.Hooks.Run("session_loaded", HookDirectionNormal, w, r, session)
+				}
 			}
-		}()
+		}
+		if session == nil {
+			// a cookie is missing, or a session is unknown or expired:
+			// issues a new session id rather than reusing the given one when
+			// the session is written.
+			session = newLazySession(func(s *Session) {
+				created, err := sm.StoreV2.NewSession(r.Context())
+				sm.reportRemovedSessions()
+				if err != nil {
+					panic(err)
+				}
+				s.Id = created.Id
+				sm.app.Hooks.Run("session_created", HookDirectionNormal, w, r, s)
+			})
+		}
+		ctx.Session = session
+		session.touch(sm.Config.LastAccessTimeResolution)
 
+		encodeFailed := false
 		w.(ResponseWriter).Hooks().Add("before_write_header", func(w http.ResponseWriter, rnil *http.Request, statusCode interface{}) {
 			if strings.Index(r.URL.Path, sm.Config.CookiePath) != 0 {
 				return
 			}
-			sm.Store.Lock()
-			defer sm.Store.Unlock()
-            domain := sm.Config.CookieDomain
-            if len(domain) == 0 {
-              domain = strings.Split(r.Host,":")[0]
-            }
 			cookie := &http.Cookie{
-				Domain: domain,
-				Secure: sm.Config.CookieSecure,
-				Path:   sm.Config.CookiePath,
-                HttpOnly: true,
+				Domain:   sm.Config.CookieDomain,
+				Secure:   sm.Config.CookieSecure || sm.app.Config.IsTLS(),
+				Path:     sm.Config.CookiePath,
+				HttpOnly: true,
+			}
+			switch sm.Config.CookiePrefix {
+			case CookiePrefixHost:
+				cookie.Domain = ""
+				cookie.Path = "/"
+				cookie.Secure = true
+			case CookiePrefixSecure:
+				cookie.Secure = true
+			}
+			if sm.Config.CookieHostOnly {
+				cookie.Domain = ""
+			} else if len(cookie.Domain) == 0 && sm.Config.CookiePrefix != CookiePrefixHost {
+				cookie.Domain = strings.Split(r.Host, ":")[0]
 			}
 			if sm.Config.CookieExpires != 0 {
 				cookie.Expires = time.Now().Add(sm.Config.CookieExpires)
 			}
+			if sm.Config.CookieMaxAge > 0 {
+				cookie.MaxAge = int(sm.Config.CookieMaxAge / time.Second)
+			}
+			cookie.SameSite, _ = sm.Config.sameSite()
 			session := ctx.Session
 			if session == nil {
 				return
 			}
+			if session.IsLazy() {
+				if signedString != nil {
+					// discards the invalid or stale cookie.
+					cookie.Name = sm.Config.FullCookieName()
+					cookie.MaxAge = -1
+					http.SetCookie(w, cookie)
+				}
+				return
+			}
+			if session.MaxAge > 0 {
+				cookie.Expires = time.Now().Add(session.MaxAge)
+				cookie.MaxAge = int(session.MaxAge / time.Second)
+			}
 			if session.Killed {
 				cookie.MaxAge = -1
-				sm.Store.Delete(session.Id)
-			} else {
-				sm.Store.Save(session)
 			}
-			cookie.Name = sm.Config.CookieName
-			cookie.Value = SignString(session.Id, sm.Config.Secret)
+			if session.IsDirty() {
+				err := sm.saveSession(r.Context(), session)
+				sm.reportRemovedSessions()
+				if err != nil {
+					sm.app.log(LogLevelError, fmt.Sprintf("session error: %v", err))
+				} else if session.Killed {
+					sm.app.Hooks.Run("session_destroyed", HookDirectionNormal, w, r, session)
+				}
+				session.dirty = false
+			}
+			if encodeFailed {
+				return
+			}
+			value := session.Id
+			if sm.encoder != nil && !session.Killed {
+				v, err := sm.encoder.EncodeSession(session)
+				if err != nil {
+					// OnSessionError writes an error response, that runs this hook again.
+					// The response that the handler writes after this is dropped.
+					encodeFailed = true
+					sm.app.OnSessionError(w, r, err)
+					discardResponse(w)
+					return
+				}
+				value = v
+			}
+			cookie.Name = sm.Config.FullCookieName()
+			cookie.Value = SignString(value, sm.Config.signingSecret())
+			if size := len(cookie.String()); sm.encoder != nil && size > MaxCookieSize {
+				encodeFailed = true
+				sm.app.OnSessionError(w, r, errors.New(fmt.Sprintf("CookieSessionStore: the session cookie is too large(%v bytes, max %v bytes).", size, MaxCookieSize)))
+				discardResponse(w)
+				return
+			}
 			http.SetCookie(w, cookie)
 		})
 
@@ -143,20 +451,133 @@ func (sm *SessionMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (sm *SessionMiddleware) loadSession(ctx context.Context, sessionId string) (*Session, error) {
+	unlock, err := sm.StoreV2.LockSession(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return sm.StoreV2.Load(ctx, sessionId)
+}
+
+// Saves the session, or deletes it if the session has been killed.
+func (sm *SessionMiddleware) saveSession(ctx context.Context, session *Session) error {
+	unlock, err := sm.StoreV2.LockSession(ctx, session.Id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if session.Killed {
+		return sm.StoreV2.Delete(ctx, session.Id)
+	}
+	return sm.StoreV2.Save(ctx, session)
+}
+
+// Starts a goroutine that runs Gc every Config.GcInterval.
+// StartGc does nothing if Config.GcInterval is 0 or less.
+func (sm *SessionMiddleware) StartGc() {
+	sm.gcMutex.Lock()
+	defer sm.gcMutex.Unlock()
+	if sm.gcStop != nil || sm.Config.GcInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(sm.Config.GcInterval)
+	stop, done := make(chan bool), make(chan bool)
+	sm.gcStop, sm.gcDone = stop, done
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sm.Gc()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the GC goroutine. Stop waits for a running Gc to finish.
+func (sm *SessionMiddleware) Stop() {
+	sm.gcMutex.Lock()
+	defer sm.gcMutex.Unlock()
+	if sm.gcStop == nil {
+		return
+	}
+	close(sm.gcStop)
+	<-sm.gcDone
+	sm.gcStop, sm.gcDone = nil, nil
+}
+
+// Stops the GC goroutine. Close is the same as Stop, and is provided for io.Closer.
+func (sm *SessionMiddleware) Close() error {
+	sm.Stop()
+	return nil
+}
+
 func (sm *SessionMiddleware) Gc() {
-	sm.Store.Lock()
-	defer sm.Store.Unlock()
-	sm.app.Logger(LogLevelDebug, "Session Gc")
-	sm.Store.Gc()
-	time.AfterFunc(sm.Config.GcInterval, sm.Gc)
+	sm.app.log(LogLevelDebug, "Session Gc")
+	reporter, ok := sm.StoreV2.(SessionGcReporterV2)
+	if !ok {
+		if err := sm.StoreV2.Gc(context.Background()); err != nil {
+			sm.app.log(LogLevelError, fmt.Sprintf("session error: %v", err))
+		}
+		return
+	}
+	sessions, err := reporter.GcSessions(context.Background())
+	if err != nil {
+		sm.app.log(LogLevelError, fmt.Sprintf("session error: %v", err))
+	}
+	for _, session := range sessions {
+		sm.app.Hooks.Run("session_destroyed", HookDirectionNormal, nil, nil, session)
+	}
+}
+
+// A store that removes sessions while loading and saving sessions, and reports them later.
+type removedSessionsReporter interface {
+	popRemovedSessions() []*Session
+}
+
+// An optional interface for stores that do not evict sessions used by in-flight requests.
+type sessionPinner interface {
+	pinSession(sessionId string)
+	unpinSession(sessionId string)
+}
+
+// Fires the session_destroyed hook for sessions removed by the last store operation.
+// Hooks are called without store locks like Gc.
+func (sm *SessionMiddleware) reportRemovedSessions() {
+	reporter, ok := sm.Store.(removedSessionsReporter)
+	if !ok {
+		return
+	}
+	for _, session := range reporter.popRemovedSessions() {
+		sm.app.Hooks.Run("session_destroyed", HookDirectionNormal, nil, nil, session)
+	}
 }
 
 // Session value container.
+//
+// The SessionMiddleware does not create sessions for requests without valid session cookies
+// until values are written to the session. Such a session has an empty Id until Set, Update,
+// Del, Pop or AddFlash is called. Writing to the session panics if the store fails to create
+// the session.
+//
+// The SessionMiddleware saves the session only if it has been modified by Set, Update, Del, Pop,
+// AddFlash, Flash, Flashes or Kill. Values modified in place(e.g. elements of a map stored in
+// the session) must be written back with Set, or the session must be marked by MarkDirty.
 type Session struct {
 	Dict
 	Killed         bool
 	Id             string
 	LastAccessTime time.Time
+	// A lifetime of the session that overrides SessionConfig.LifeTime, CookieExpires and
+	// CookieMaxAge(e.g. "keep me signed in"). 0 means the session uses the SessionConfig.
+	MaxAge time.Duration
+	// a function that creates the session in the store, nil if the session has been created.
+	create func(*Session)
+	dirty  bool
 }
 
 const FlashKey = "_flash"
@@ -166,36 +587,188 @@ func NewSession(id string) *Session {
 		Dict:   NewDict(),
 		Killed: false, Id: id,
 		LastAccessTime: time.Now()}
-	self.Set(FlashKey, make(map[string][]string))
+	self.Dict.Set(FlashKey, NewFlashMessages())
 	return self
 }
 
+func newLazySession(create func(*Session)) *Session {
+	self := NewSession("")
+	self.create = create
+	return self
+}
+
+// Returns true if the session has not been created in the session store yet.
+func (sess *Session) IsLazy() bool {
+	return sess.create != nil
+}
+
+// Returns true if the session has been modified and needs to be saved.
+func (sess *Session) IsDirty() bool {
+	return sess.dirty
+}
+
+// Marks the session as modified so that the SessionMiddleware saves it.
+func (sess *Session) MarkDirty() {
+	sess.materialize()
+	sess.dirty = true
+}
+
+func (sess *Session) materialize() {
+	if create := sess.create; create != nil {
+		sess.create = nil
+		create(sess)
+	}
+}
+
+func (sess *Session) Set(key string, value interface{}) Dict {
+	sess.MarkDirty()
+	return sess.Dict.Set(key, value)
+}
+
+func (sess *Session) Update(other map[string]interface{}) {
+	sess.MarkDirty()
+	sess.Dict.Update(other)
+}
+
+func (sess *Session) Del(key string) Dict {
+	sess.MarkDirty()
+	return sess.Dict.Del(key)
+}
+
+func (sess *Session) Pop(key string) interface{} {
+	v := sess.Get(key)
+	sess.Del(key)
+	return v
+}
+
+// Updates the last access time and marks the session as modified.
 func (sess *Session) UpdateLastAccessTime() {
 	sess.LastAccessTime = time.Now()
+	sess.dirty = true
+}
+
+// Updates the last access time. The session is marked as modified only if
+// the last access time is older than the given resolution.
+func (sess *Session) touch(resolution time.Duration) {
+	now := time.Now()
+	if now.Sub(sess.LastAccessTime) >= resolution {
+		sess.dirty = true
+	}
+	sess.LastAccessTime = now
+}
+
+// Sets the lifetime of the session and its cookie.
+//
+//     if form.RememberMe {
+//         ctx.Session.SetMaxAge(30 * 24 * time.Hour)
+//     }
+func (sess *Session) SetMaxAge(maxAge time.Duration) {
+	sess.MarkDirty()
+	sess.MaxAge = maxAge
 }
 
 func (sess *Session) Kill() {
 	sess.Killed = true
+	sess.dirty = true
+}
+
+// FlashMessages is a container of flash messages stored in a session.
+// Messages are copied on read, so returned values are not affected by subsequent changes.
+type FlashMessages struct {
+	// Messages by categories. This field is exported for serialization.
+	Messages map[string][]string
+}
+
+// Returns a new FlashMessages object.
+func NewFlashMessages() *FlashMessages {
+	return &FlashMessages{Messages: make(map[string][]string)}
+}
+
+// Adds a message to the given category.
+func (fm *FlashMessages) Add(category string, message string) {
+	fm.Messages[category] = append(fm.Messages[category], message)
+}
+
+// Returns a copy of messages associated with the given category, and removes them.
+func (fm *FlashMessages) Get(category string) []string {
+	v := fm.Peek(category)
+	delete(fm.Messages, category)
+	return v
+}
+
+// Returns a copy of messages associated with the given category without removing them.
+func (fm *FlashMessages) Peek(category string) []string {
+	v := fm.Messages[category]
+	result := make([]string, len(v))
+	copy(result, v)
+	return result
+}
+
+// Returns a copy of all messages, and removes them.
+func (fm *FlashMessages) All() map[string][]string {
+	result := fm.PeekAll()
+	fm.Messages = make(map[string][]string)
+	return result
+}
+
+// Returns a copy of all messages without removing them.
+func (fm *FlashMessages) PeekAll() map[string][]string {
+	result := make(map[string][]string, len(fm.Messages))
+	for category, messages := range fm.Messages {
+		result[category] = append([]string(nil), messages...)
+	}
+	return result
+}
+
+// Returns flash messages of the session. Flash messages stored by older versions of
+// cidre(map[string][]string) or decoded from JSON(map[string]interface{}) are converted to a FlashMessages.
+// The session is marked as modified because the returned object may be modified.
+func (sess *Session) FlashMessages() *FlashMessages {
+	sess.MarkDirty()
+	return sess.flashMessages()
+}
+
+func (sess *Session) flashMessages() *FlashMessages {
+	switch v := sess.Get(FlashKey).(type) {
+	case *FlashMessages:
+		return v
+	case map[string][]string:
+		fm := &FlashMessages{Messages: v}
+		sess.Dict.Set(FlashKey, fm)
+		return fm
+	case map[string]interface{}:
+		fm := NewFlashMessages()
+		if messages, ok := v["Messages"].(map[string]interface{}); ok {
+			v = messages
+		}
+		for category, values := range v {
+			if values, ok := values.([]interface{}); ok {
+				for _, value := range values {
+					fm.Add(category, fmt.Sprint(value))
+				}
+			}
+		}
+		sess.Dict.Set(FlashKey, fm)
+		return fm
+	}
+	fm := NewFlashMessages()
+	sess.Dict.Set(FlashKey, fm)
+	return fm
 }
 
 // Adds a flash message to the session
 func (sess *Session) AddFlash(category string, message string) {
-	flash := sess.Get(FlashKey).(map[string][]string)
-	if _, ok := flash[category]; !ok {
-		flash[category] = make([]string, 0, 10)
-	}
-	flash[category] = append(flash[category], message)
+	sess.MarkDirty()
+	sess.flashMessages().Add(category, message)
 }
 
 // Returns a flash message associated with the given category.
 func (sess *Session) Flash(category string) []string {
-	flash := sess.Get(FlashKey).(map[string][]string)
-	v, ok := flash[category]
-	delete(flash, category)
-	if !ok {
-		return make([]string, 0, 10)
+	fm := sess.flashMessages()
+	if _, ok := fm.Messages[category]; ok {
+		sess.MarkDirty()
 	}
-	return v
+	return fm.Get(category)
 }
 
 // Returns a list of flash messages from the session.
@@ -206,9 +779,56 @@ func (sess *Session) Flash(category string) []string {
 //     messages := session.Flashes()
 //     // -> {"info":["info message1", "info message2"], "error":["error message"]}
 func (sess *Session) Flashes() map[string][]string {
-	flash := sess.Get(FlashKey).(map[string][]string)
-	sess.Set(FlashKey, make(map[string][]string))
-	return flash
+	fm := sess.flashMessages()
+	if len(fm.Messages) != 0 {
+		sess.MarkDirty()
+	}
+	return fm.All()
+}
+
+// Returns a copy of flash messages associated with the given category without removing them.
+func (sess *Session) PeekFlash(category string) []string {
+	return sess.flashMessages().Peek(category)
+}
+
+// Returns a copy of flash messages from the session without removing them.
+func (sess *Session) PeekFlashes() map[string][]string {
+	return sess.flashMessages().PeekAll()
+}
+
+func init() {
+	gob.Register(&FlashMessages{})
+	// flash messages stored by older versions
+	gob.Register(map[string][]string{})
+}
+
+type sessionData struct {
+	Id             string
+	LastAccessTime time.Time
+	Values         map[string]interface{}
+	MaxAge         time.Duration
+}
+
+// Serializes the session with encoding/gob.
+func encodeSession(session *Session) ([]byte, error) {
+	var buf bytes.Buffer
+	sd := sessionData{session.Id, session.LastAccessTime, session.Dict, session.MaxAge}
+	if err := gob.NewEncoder(&buf).Encode(&sd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSession(data []byte) (*Session, error) {
+	var sd sessionData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&sd); err != nil {
+		return nil, err
+	}
+	session := NewSession(sd.Id)
+	session.LastAccessTime = sd.LastAccessTime
+	session.MaxAge = sd.MaxAge
+	session.Update(sd.Values)
+	return session, nil
 }
 
 // SessionStore is an interface for custom session stores.
@@ -220,33 +840,164 @@ type SessionStore interface {
 	Exists(string) bool
 	NewSession() *Session
 	Save(*Session)
+	// Returns nil if the session does not exist.
 	Load(string) *Session
 	Delete(string)
 	Gc()
 	Count() int
 }
 
+// SessionStoreV2 is an interface for session stores that may fail, like network-backed stores.
+// Unlike the SessionStore, methods receive a context.Context of the request and return errors, and
+// sessions are locked individually by LockSession instead of a store-wide lock.
+// A SessionStoreV2 must be safe for concurrent use.
+// See the KeyValueSessionStore for examples.
+type SessionStoreV2 interface {
+	Init(*SessionMiddleware, interface{})
+	// Locks the session while the middleware loads, saves or deletes it.
+	// LockSession returns a function that unlocks the session.
+	LockSession(context.Context, string) (func(), error)
+	NewSession(context.Context) (*Session, error)
+	// Returns nil without errors if the session does not exist.
+	Load(context.Context, string) (*Session, error)
+	Save(context.Context, *Session) error
+	Delete(context.Context, string) error
+	Gc(context.Context) error
+}
+
+// SessionGcReporter is an optional interface for SessionStores that report sessions removed by the Gc.
+// The SessionMiddleware calls GcSessions instead of Gc, and fires the session_destroyed hook for
+// each removed session.
+type SessionGcReporter interface {
+	// Removes expired sessions like Gc, and returns the removed sessions.
+	GcSessions() []*Session
+}
+
+// SessionGcReporterV2 is a SessionStoreV2 version of the SessionGcReporter.
+type SessionGcReporterV2 interface {
+	// Removes expired sessions like Gc, and returns the removed sessions.
+	GcSessions(context.Context) ([]*Session, error)
+}
+
+// An adapter that makes a SessionStore a SessionStoreV2 using the store-wide lock.
+type sessionStoreAdapter struct {
+	SessionStore
+}
+
+func (sa *sessionStoreAdapter) LockSession(context.Context, string) (func(), error) {
+	// operations are serialized by the store-wide lock.
+	return func() {}, nil
+}
+
+func (sa *sessionStoreAdapter) NewSession(context.Context) (*Session, error) {
+	sa.Lock()
+	defer sa.Unlock()
+	return sa.SessionStore.NewSession(), nil
+}
+
+func (sa *sessionStoreAdapter) Load(ctx context.Context, sessionId string) (*Session, error) {
+	sa.Lock()
+	defer sa.Unlock()
+	return sa.SessionStore.Load(sessionId), nil
+}
+
+func (sa *sessionStoreAdapter) Save(ctx context.Context, session *Session) error {
+	sa.Lock()
+	defer sa.Unlock()
+	sa.SessionStore.Save(session)
+	return nil
+}
+
+func (sa *sessionStoreAdapter) Delete(ctx context.Context, sessionId string) error {
+	sa.Lock()
+	defer sa.Unlock()
+	sa.SessionStore.Delete(sessionId)
+	return nil
+}
+
+func (sa *sessionStoreAdapter) Gc(context.Context) error {
+	sa.Lock()
+	defer sa.Unlock()
+	sa.SessionStore.Gc()
+	return nil
+}
+
+func (sa *sessionStoreAdapter) GcSessions(ctx context.Context) ([]*Session, error) {
+	reporter, ok := sa.SessionStore.(SessionGcReporter)
+	if !ok {
+		return nil, sa.Gc(ctx)
+	}
+	sa.Lock()
+	defer sa.Unlock()
+	return reporter.GcSessions(), nil
+}
+
+// MemorySessionStoreConfig is a configuration object for the MemorySessionStore
+type MemorySessionStoreConfig struct {
+	// Maximum number of sessions. If the store is full, least recently accessed
+	// sessions are evicted before new sessions are created. 0 means no limit.
+	// Sessions used by in-flight requests are not evicted, so the number of sessions
+	// may exceed this value while such requests are served.
+	// default: 0
+	MaxSessions int
+}
+
+// Returns a MemorySessionStoreConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the MemorySessionStoreConfig object.
+func DefaultMemorySessionStoreConfig(init ...func(*MemorySessionStoreConfig)) *MemorySessionStoreConfig {
+	self := &MemorySessionStoreConfig{
+		MaxSessions: 0,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+// SessionStoreStats is a statistics of a session store.
+type SessionStoreStats struct {
+	// Number of sessions currently stored
+	Count int
+	// Number of sessions created
+	Created uint64
+	// Number of sessions evicted because the store is full
+	Evicted uint64
+	// Number of sessions deleted because they have been expired
+	Expired uint64
+}
+
 type MemorySessionStore struct {
 	sync.Mutex
 	middleware *SessionMiddleware
-	store      map[string]*Session
+	config     *MemorySessionStoreConfig
+	store      map[string]*list.Element
+	// sessions ordered from most recently accessed to least recently accessed
+	lru   *list.List
+	stats SessionStoreStats
+	// sessions evicted or expired by NewSession, Save and Load, and not reported yet.
+	removed []*Session
+	// numbers of in-flight requests for session ids. These sessions are not evicted.
+	pinned map[string]int
 }
 
 func (ms *MemorySessionStore) Init(middleware *SessionMiddleware, cfg interface{}) {
 	ms.middleware = middleware
-	ms.store = make(map[string]*Session, 30)
+	config, ok := cfg.(*MemorySessionStoreConfig)
+	if !ok || config == nil {
+		config = DefaultMemorySessionStoreConfig()
+	}
+	ms.config = config
+	ms.store = make(map[string]*list.Element, 30)
+	ms.lru = list.New()
+	ms.pinned = make(map[string]int)
 }
 
+// Number of random bytes in session ids.
+const sessionIdBytes = 32
+
 func (ms *MemorySessionStore) NewSessionId() string {
-	for true {
-		now := time.Now().Unix()
-		random := strconv.Itoa(rand.Int())
-		sessionId := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%v%v%v", now, random, ms.middleware.Config.Secret))))
-		if !ms.Exists(sessionId) {
-			return sessionId
-		}
-	}
-	return ""
+	return GenerateRandomId(sessionIdBytes)
 }
 
 func (ms *MemorySessionStore) Exists(sessionId string) bool {
@@ -255,37 +1006,119 @@ func (ms *MemorySessionStore) Exists(sessionId string) bool {
 }
 
 func (ms *MemorySessionStore) NewSession() *Session {
+	ms.evict(ms.config.MaxSessions - 1)
 	session := NewSession(ms.NewSessionId())
-	ms.store[session.Id] = session
+	ms.store[session.Id] = ms.lru.PushFront(session)
+	ms.stats.Created += 1
 	return session
 }
 
-func (ms *MemorySessionStore) Save(*Session) { /* Nothing to do */ }
+func (ms *MemorySessionStore) Save(session *Session) {
+	if elem, ok := ms.store[session.Id]; ok {
+		elem.Value = session
+		ms.lru.MoveToFront(elem)
+		return
+	}
+	// the session has been evicted or deleted while the request was served.
+	ms.evict(ms.config.MaxSessions - 1)
+	ms.store[session.Id] = ms.lru.PushFront(session)
+}
+
+// Evicts least recently accessed sessions until the number of sessions is
+// not greater than the given size.
+func (ms *MemorySessionStore) evict(size int) {
+	if ms.config.MaxSessions <= 0 {
+		return
+	}
+	for elem := ms.lru.Back(); elem != nil && ms.lru.Len() > size; {
+		prev := elem.Prev()
+		session := elem.Value.(*Session)
+		if ms.pinned[session.Id] == 0 {
+			ms.Delete(session.Id)
+			ms.removed = append(ms.removed, session)
+			ms.stats.Evicted += 1
+		}
+		elem = prev
+	}
+}
 
+func (ms *MemorySessionStore) pinSession(sessionId string) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.pinned[sessionId] += 1
+}
+
+func (ms *MemorySessionStore) unpinSession(sessionId string) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.pinned[sessionId] -= 1
+	if ms.pinned[sessionId] <= 0 {
+		delete(ms.pinned, sessionId)
+	}
+}
+
+func (ms *MemorySessionStore) popRemovedSessions() []*Session {
+	ms.Lock()
+	defer ms.Unlock()
+	removed := ms.removed
+	ms.removed = nil
+	return removed
+}
+
+// Returns a session associated with the given id, or nil if the session
+// does not exist or has been expired.
 func (ms *MemorySessionStore) Load(sessionId string) *Session {
-	session, ok := ms.store[sessionId]
-	if ok {
-		return session
+	elem, ok := ms.store[sessionId]
+	if !ok {
+		return nil
 	}
-	return ms.NewSession()
+	session := elem.Value.(*Session)
+	if time.Now().Sub(session.LastAccessTime) > ms.middleware.Config.sessionLifeTime(session) {
+		ms.Delete(sessionId)
+		ms.removed = append(ms.removed, session)
+		ms.stats.Expired += 1
+		return nil
+	}
+	ms.lru.MoveToFront(elem)
+	return session
 }
 
 func (ms *MemorySessionStore) Delete(sessionId string) {
-	delete(ms.store, sessionId)
+	if elem, ok := ms.store[sessionId]; ok {
+		ms.lru.Remove(elem)
+		delete(ms.store, sessionId)
+	}
 }
 
 func (ms *MemorySessionStore) Count() int {
 	return len(ms.store)
 }
 
+// Returns a statistics of the store. Stats locks the store.
+func (ms *MemorySessionStore) Stats() SessionStoreStats {
+	ms.Lock()
+	defer ms.Unlock()
+	stats := ms.stats
+	stats.Count = len(ms.store)
+	return stats
+}
+
 func (ms *MemorySessionStore) Gc() {
-	delkeys := make([]string, 0, len(ms.store)/10)
-	for k, v := range ms.store {
-		if (time.Now().Sub(v.LastAccessTime)) > ms.middleware.Config.LifeTime {
-			delkeys = append(delkeys, k)
+	ms.GcSessions()
+}
+
+// Removes expired sessions, and returns the removed sessions.
+func (ms *MemorySessionStore) GcSessions() []*Session {
+	removed := make([]*Session, 0, len(ms.store)/10)
+	for _, elem := range ms.store {
+		session := elem.Value.(*Session)
+		if (time.Now().Sub(session.LastAccessTime)) > ms.middleware.Config.sessionLifeTime(session) {
+			removed = append(removed, session)
 		}
 	}
-	for _, key := range delkeys {
-		ms.Delete(key)
+	for _, session := range removed {
+		ms.Delete(session.Id)
 	}
+	ms.stats.Expired += uint64(len(removed))
+	return removed
 }
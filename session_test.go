@@ -0,0 +1,749 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionCookiePrefix(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.CookiePrefix = CookiePrefixHost
+	}), nil))
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("visited", true)
+		fmt.Fprint(w, "ok")
+	})
+	req, _ := http.NewRequest("GET", "http://localhost:8080/page1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	cookies := writer.Result().Cookies()
+	errorIfNotEqual(t, 1, len(cookies))
+	errorIfNotEqual(t, "__Host-gosessionid", cookies[0].Name)
+	errorIfNotEqual(t, "", cookies[0].Domain)
+	errorIfNotEqual(t, "/", cookies[0].Path)
+	errorIfNotEqual(t, true, cookies[0].Secure)
+
+	app = NewApp(DefaultAppConfig())
+	app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.CookiePrefix = CookiePrefixSecure
+		c.CookiePath = "/"
+	}), nil))
+	root = app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("visited", true)
+		fmt.Fprint(w, "ok")
+	})
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	cookies = writer.Result().Cookies()
+	errorIfNotEqual(t, "__Secure-gosessionid", cookies[0].Name)
+	errorIfNotEqual(t, "localhost", cookies[0].Domain)
+	errorIfNotEqual(t, true, cookies[0].Secure)
+}
+
+func TestSessionCookiePrefixValidation(t *testing.T) {
+	cases := []func(*SessionConfig){
+		func(c *SessionConfig) { c.CookiePrefix = CookiePrefixHost; c.CookieDomain = "example.com" },
+		func(c *SessionConfig) { c.CookiePrefix = CookiePrefixHost; c.CookiePath = "/admin" },
+		func(c *SessionConfig) { c.CookiePrefix = "__Unknown-" },
+		func(c *SessionConfig) { c.CookieSameSite = "None" },
+		func(c *SessionConfig) { c.CookieSameSite = "Unknown" },
+	}
+	for i, init := range cases {
+		config := DefaultSessionConfig(init)
+		config.Secret = "secret"
+		if err := config.Validate(); err == nil {
+			t.Errorf("case %v: Validate should return an error", i)
+		}
+		func() {
+			defer func() {
+				if recv := recover(); recv == nil {
+					t.Errorf("case %v: NewSessionMiddleware should cause panic", i)
+				}
+			}()
+			NewSessionMiddleware(NewApp(DefaultAppConfig()), config, nil)
+		}()
+	}
+	config := DefaultSessionConfig(func(c *SessionConfig) { c.CookiePrefix = CookiePrefixHost; c.CookiePath = "/" })
+	errorIfNotEqual(t, nil, config.Validate())
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	_, file, _, _ := runtime.Caller(0)
+	config := DefaultSessionConfig()
+	ParseIniFile(filepath.Join(filepath.Dir(file), "_testdata", "session.ini"), ConfigMapping{"session", config})
+	errorIfNotEqual(t, "Strict", config.CookieSameSite)
+	errorIfNotEqual(t, time.Hour, config.CookieMaxAge)
+	errorIfNotEqual(t, true, config.CookieHostOnly)
+
+	app := NewApp(DefaultAppConfig())
+	app.Use(NewSessionMiddleware(app, config, nil))
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("visited", true)
+		fmt.Fprint(w, "ok")
+	})
+	req, _ := http.NewRequest("GET", "http://www.example.com/page1", nil)
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	header := writer.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Max-Age=3600", "HttpOnly", "SameSite=Strict"} {
+		if !strings.Contains(header, "; "+attr) {
+			t.Errorf("Set-Cookie should contain '%v', but got '%v'", attr, header)
+		}
+	}
+	if strings.Contains(header, "Domain=") {
+		t.Errorf("Set-Cookie should not contain a domain, but got '%v'", header)
+	}
+
+	config.CookieSameSite = "None"
+	config.CookieSecure = true
+	config.CookieHostOnly = false
+	errorIfNotEqual(t, nil, config.Validate())
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	header = writer.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Domain=www.example.com", "Secure", "SameSite=None"} {
+		if !strings.Contains(header, "; "+attr) {
+			t.Errorf("Set-Cookie should contain '%v', but got '%v'", attr, header)
+		}
+	}
+}
+
+func TestSessionGcStop(t *testing.T) {
+	var mutex sync.Mutex
+	count := 0
+	app := NewApp(DefaultAppConfig())
+	app.Logger = func(level LogLevel, message string) {
+		if message == "Session Gc" {
+			mutex.Lock()
+			count += 1
+			mutex.Unlock()
+		}
+	}
+	getCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return count
+	}
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.GcInterval = 5 * time.Millisecond
+	}), nil)
+	app.Hooks.Run("start_server", HookDirectionNormal, nil, nil, app)
+	time.Sleep(50 * time.Millisecond)
+	if getCount() == 0 {
+		t.Error("Gc should run periodically")
+	}
+	app.Hooks.Run("stop_server", HookDirectionReverse, nil, nil, app)
+	stopped := getCount()
+	time.Sleep(50 * time.Millisecond)
+	errorIfNotEqual(t, stopped, getCount())
+
+	// Stop is idempotent
+	sm.Stop()
+}
+
+func TestSessionGcRestart(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.Logger = func(LogLevel, string) {}
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		c.GcInterval = time.Millisecond
+	}), nil)
+	for i := 0; i < 2; i++ {
+		app.Hooks.Run("start_server", HookDirectionNormal, nil, nil, app)
+		done := sm.gcDone
+		errorIfNotEqual(t, true, done != nil)
+		errorIfNotEqual(t, nil, sm.Close())
+		select {
+		case <-done:
+		default:
+			t.Error("Gc goroutine should be finished")
+		}
+	}
+
+	sm.Config.GcInterval = 0
+	sm.StartGc()
+	errorIfNotEqual(t, true, sm.gcDone == nil)
+	sm.Stop()
+}
+
+func newSessionTestApp(init func(*SessionConfig)) (*App, *SessionMiddleware) {
+	app := NewApp(DefaultAppConfig())
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+		if init != nil {
+			init(c)
+		}
+	}), nil)
+	app.Use(sm)
+	root := app.MountPoint("/")
+	root.Get("page1", "page1", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		session.Set("visited", true)
+		fmt.Fprint(w, session.Id)
+	})
+	return app, sm
+}
+
+func TestSessionUnknownId(t *testing.T) {
+	app, sm := newSessionTestApp(nil)
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: SignString("forged", "secret")})
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	if writer.Body.String() == "forged" {
+		t.Error("unknown session id should not be reused")
+	}
+	AssertCookie(t, "gosessionid", SignString(writer.Body.String(), "secret"), writer)
+	errorIfNotEqual(t, false, sm.Store.Exists("forged"))
+	errorIfNotEqual(t, true, sm.Store.Load("forged") == nil)
+}
+
+func TestSessionLazy(t *testing.T) {
+	app, sm := newSessionTestApp(nil)
+	root := app.MountPoint("/")
+	root.Get("read", "read", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		fmt.Fprintf(w, "%v:%v:%v", session.Id, len(session.Flashes()), session.GetString("name"))
+	})
+	root.Get("flash", "flash", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.AddFlash("info", "saved")
+		fmt.Fprint(w, "ok")
+	})
+	client := NewTestClient(app)
+
+	res := client.Get("/read")
+	errorIfNotEqual(t, ":0:", res.String())
+	errorIfNotEqual(t, 0, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, 0, sm.Store.Count())
+
+	res = client.Get("/flash")
+	errorIfNotEqual(t, 1, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, 1, sm.Store.Count())
+	id := res.Context.Session.Id
+	errorIfNotEqual(t, true, len(id) != 0)
+
+	res = client.Get("/read")
+	errorIfNotEqual(t, id+":1:", res.String())
+}
+
+func TestSessionInvalidCookie(t *testing.T) {
+	var invalidErr error
+	app, sm := newSessionTestApp(func(c *SessionConfig) {
+		c.OnInvalidCookie = func(w http.ResponseWriter, r *http.Request, err error) {
+			invalidErr = err
+		}
+	})
+	for _, value := range []string{"garbage", SignString("forged", "oldsecret")} {
+		invalidErr = nil
+		req, _ := http.NewRequest("GET", "/page1", nil)
+		req.AddCookie(&http.Cookie{Name: "gosessionid", Value: value})
+		writer := httptest.NewRecorder()
+		app.ServeHTTP(writer, req)
+		errorIfNotEqual(t, http.StatusOK, writer.Code)
+		errorIfNotEqual(t, true, invalidErr != nil)
+		errorIfNotEqual(t, true, sm.Store.Exists(writer.Body.String()))
+		AssertCookie(t, "gosessionid", SignString(writer.Body.String(), "secret"), writer)
+	}
+}
+
+func TestSessionLegacySignature(t *testing.T) {
+	app, sm := newSessionTestApp(func(c *SessionConfig) {
+		c.AcceptLegacySignatures = true
+		c.LegacySignaturesDeadline = time.Now().Add(time.Hour)
+	})
+	session := sm.Store.NewSession()
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: legacySignString(session.Id, "secret")})
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, session.Id, writer.Body.String())
+	AssertCookie(t, "gosessionid", SignString(session.Id, "secret"), writer)
+
+	// legacy signatures are rejected after the deadline
+	sm.Config.LegacySignaturesDeadline = time.Now().Add(-time.Second)
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: legacySignString(session.Id, "secret")})
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	if writer.Body.String() == session.Id {
+		t.Error("legacy signatures should be rejected after the deadline")
+	}
+
+	for _, c := range []struct {
+		init    func(*SessionConfig)
+		message string
+	}{
+		{func(c *SessionConfig) {}, "LegacySignaturesDeadline is required if AcceptLegacySignatures is true."},
+		{func(c *SessionConfig) {
+			c.LegacySignaturesDeadline = time.Now().Add(time.Hour)
+			c.SessionStore = "cidre.CookieSessionStore"
+		}, "AcceptLegacySignatures can not be used with session stores that store sessions in cookies."},
+	} {
+		func() {
+			defer func() {
+				errorIfNotEqual(t, c.message, fmt.Sprint(recover()))
+			}()
+			NewSessionMiddleware(NewApp(DefaultAppConfig()), DefaultSessionConfig(func(config *SessionConfig) {
+				config.Secret = "secret"
+				config.AcceptLegacySignatures = true
+				c.init(config)
+			}), nil)
+		}()
+	}
+}
+
+func TestSessionSecretRotation(t *testing.T) {
+	app, sm := newSessionTestApp(func(c *SessionConfig) {
+		c.Secret = ""
+		c.Secrets = []string{"A"}
+	})
+	writer := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	app.ServeHTTP(writer, req)
+	sessionId := writer.Body.String()
+	AssertCookie(t, "gosessionid", SignString(sessionId, "A"), writer)
+
+	sm.Config.Secrets = []string{"B", "A"}
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: SignString(sessionId, "A")})
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, sessionId, writer.Body.String())
+	AssertCookie(t, "gosessionid", SignString(sessionId, "B"), writer)
+
+	sm.Config.Secrets = []string{"C", "B"}
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: SignString(sessionId, "A")})
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	if writer.Body.String() == sessionId {
+		t.Error("session signed with a removed secret should not be reused")
+	}
+}
+
+func TestSessionExpiredId(t *testing.T) {
+	app, sm := newSessionTestApp(func(c *SessionConfig) {
+		c.LifeTime = time.Minute
+	})
+	session := sm.Store.NewSession()
+	session.LastAccessTime = time.Now().Add(-2 * time.Minute)
+	req, _ := http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: SignString(session.Id, "secret")})
+	writer := httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	if writer.Body.String() == session.Id {
+		t.Error("expired session id should not be reused")
+	}
+	errorIfNotEqual(t, false, sm.Store.Exists(session.Id))
+
+	session = sm.Store.NewSession()
+	req, _ = http.NewRequest("GET", "/page1", nil)
+	req.AddCookie(&http.Cookie{Name: "gosessionid", Value: SignString(session.Id, "secret")})
+	writer = httptest.NewRecorder()
+	app.ServeHTTP(writer, req)
+	errorIfNotEqual(t, session.Id, writer.Body.String())
+}
+
+type testNotSessionStore struct{}
+
+func TestSessionStoreFactory(t *testing.T) {
+	DynamicObjectFactory.Register(testNotSessionStore{})
+	for _, c := range []struct{ name, message string }{
+		{"cidre.UnknownSessionStore", "Session store 'cidre.UnknownSessionStore' is not registered to the DynamicObjectFactory."},
+		{"cidre.testNotSessionStore", "Session store 'cidre.testNotSessionStore'(*cidre.testNotSessionStore) does not implement the cidre.SessionStore interface."},
+	} {
+		func() {
+			defer func() {
+				recv := recover()
+				if recv == nil {
+					t.Errorf("NewSessionMiddleware should cause panic: %v", c.name)
+					return
+				}
+				errorIfNotEqual(t, c.message, fmt.Sprint(recv))
+			}()
+			NewSessionMiddleware(NewApp(DefaultAppConfig()), DefaultSessionConfig(func(sc *SessionConfig) {
+				sc.Secret = "secret"
+				sc.SessionStore = c.name
+			}), nil)
+		}()
+	}
+
+	store := &MemorySessionStore{}
+	sm := NewSessionMiddlewareWithStore(NewApp(DefaultAppConfig()), DefaultSessionConfig(func(sc *SessionConfig) {
+		sc.Secret = "secret"
+		sc.SessionStore = "cidre.UnknownSessionStore"
+	}), store, nil)
+	errorIfNotEqual(t, SessionStore(store), sm.Store)
+}
+
+func TestMemorySessionStoreMaxSessions(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), DefaultMemorySessionStoreConfig(func(c *MemorySessionStoreConfig) {
+		c.MaxSessions = 3
+	}))
+	app.Use(sm)
+	destroyed := []string{}
+	app.Hooks.Add("session_destroyed", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		destroyed = append(destroyed, data.(*Session).GetString("name"))
+	})
+	metrics := NewMetricsMiddleware(app, DefaultMetricsConfig())
+	metrics.SessionStats = sm.Store.(*MemorySessionStore).Stats
+	root := app.MountPoint("/")
+	root.Get("login", "login", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		session.Set("name", r.URL.Query().Get("name"))
+		fmt.Fprint(w, session.Id)
+	})
+	root.Get("name", "name", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RequestContext(r).Session.GetString("name"))
+	})
+
+	clients := make([]*TestClient, 5)
+	for i := range clients {
+		clients[i] = NewTestClient(app)
+		clients[i].Get(fmt.Sprintf("/login?name=user%d", i))
+		if i == 2 {
+			// accesses the first session, so that the second session is evicted first.
+			errorIfNotEqual(t, "user0", clients[0].Get("/name").String())
+		}
+	}
+	errorIfNotEqual(t, 3, sm.Store.Count())
+	errorIfNotEqual(t, "user1,user2", strings.Join(destroyed, ","))
+	for i, name := range []string{"user0", "", "", "user3", "user4"} {
+		errorIfNotEqual(t, name, clients[i].Get("/name").String())
+	}
+
+	stats := sm.Store.(*MemorySessionStore).Stats()
+	errorIfNotEqual(t, SessionStoreStats{Count: 3, Created: 5, Evicted: 2, Expired: 0}, stats)
+	var buf strings.Builder
+	metrics.WriteMetrics(&buf)
+	for _, line := range []string{"cidre_sessions 3", "cidre_sessions_created_total 5", "cidre_sessions_evicted_total 2"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics should contain '%v', but got:\n%v", line, buf.String())
+		}
+	}
+}
+
+func TestMemorySessionStoreMaxSessionsInFlight(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	sm := NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), DefaultMemorySessionStoreConfig(func(c *MemorySessionStoreConfig) {
+		c.MaxSessions = 2
+	}))
+	app.Use(sm)
+	var destroyed []string
+	var destroyedMutex sync.Mutex
+	app.Hooks.Add("session_destroyed", func(w http.ResponseWriter, r *http.Request, data interface{}) {
+		destroyedMutex.Lock()
+		defer destroyedMutex.Unlock()
+		destroyed = append(destroyed, data.(*Session).GetString("name"))
+	})
+	entered, release := make(chan bool, 1), make(chan bool)
+	root := app.MountPoint("/")
+	root.Get("login", "login", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("name", r.URL.Query().Get("name"))
+		fmt.Fprint(w, "ok")
+	})
+	root.Get("wait", "wait", func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+		fmt.Fprint(w, RequestContext(r).Session.GetString("name"))
+	})
+
+	client := NewTestClient(app)
+	client.Get("/login?name=user0")
+	body := make(chan string)
+	go func() { body <- client.Get("/wait").String() }()
+	<-entered
+	// other clients create sessions while the read-only request is served.
+	for i := 1; i <= 3; i++ {
+		NewTestClient(app).Get(fmt.Sprintf("/login?name=user%d", i))
+	}
+	close(release)
+	errorIfNotEqual(t, "user0", <-body)
+	errorIfNotEqual(t, "user0", client.Get("/wait").String())
+	destroyedMutex.Lock()
+	defer destroyedMutex.Unlock()
+	errorIfNotEqual(t, "user1,user2", strings.Join(destroyed, ","))
+}
+
+func TestSessionPeekFlash(t *testing.T) {
+	session := NewSession("id")
+	session.AddFlash("info", "message1")
+	session.AddFlash("info", "message2")
+	session.AddFlash("error", "message3")
+
+	peeked := session.PeekFlash("info")
+	errorIfNotEqual(t, 2, len(peeked))
+	peeked[0] = "modified"
+	errorIfNotEqual(t, "message1", session.PeekFlash("info")[0])
+	errorIfNotEqual(t, 0, len(session.PeekFlash("unknown")))
+
+	flashes := session.PeekFlashes()
+	errorIfNotEqual(t, 2, len(flashes))
+	delete(flashes, "error")
+	errorIfNotEqual(t, 1, len(session.PeekFlash("error")))
+
+	errorIfNotEqual(t, 2, len(session.Flash("info")))
+	errorIfNotEqual(t, 0, len(session.PeekFlash("info")))
+	errorIfNotEqual(t, 1, len(session.Flashes()))
+	errorIfNotEqual(t, 0, len(session.PeekFlashes()))
+}
+
+func TestSessionFlashesCopy(t *testing.T) {
+	session := NewSession("id")
+	session.AddFlash("info", "message1")
+	flashes := session.Flashes()
+	session.AddFlash("info", "message2")
+	errorIfNotEqual(t, "message1", strings.Join(flashes["info"], ","))
+	flashes["info"][0] = "modified"
+	errorIfNotEqual(t, "message2", strings.Join(session.PeekFlash("info"), ","))
+}
+
+// A session store that serializes sessions like network-backed stores.
+type testGobSessionStore struct {
+	MemorySessionStore
+	data map[string][]byte
+}
+
+func (gs *testGobSessionStore) Save(session *Session) {
+	data, err := encodeSession(session)
+	if err != nil {
+		panic(err)
+	}
+	gs.data[session.Id] = data
+}
+
+func (gs *testGobSessionStore) Load(sessionId string) *Session {
+	data, ok := gs.data[sessionId]
+	if !ok {
+		return nil
+	}
+	session, err := decodeSession(data)
+	if err != nil {
+		panic(err)
+	}
+	return session
+}
+
+func TestSessionFlashesSerialization(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	store := &testGobSessionStore{data: make(map[string][]byte)}
+	app.Use(NewSessionMiddlewareWithStore(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), store, nil))
+	root := app.MountPoint("/")
+	root.Get("add", "add", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		session.AddFlash("info", "message1")
+		session.AddFlash("info", "message2")
+		fmt.Fprint(w, "ok")
+	})
+	root.Get("show", "show", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		peeked := session.PeekFlashes()
+		fmt.Fprintf(w, "%v:%v", strings.Join(peeked["info"], ","), strings.Join(session.Flash("info"), ","))
+	})
+	client := NewTestClient(app)
+	client.Get("/add")
+	errorIfNotEqual(t, "message1,message2:message1,message2", client.Get("/show").String())
+	errorIfNotEqual(t, ":", client.Get("/show").String())
+
+	// flash messages stored by older versions or decoded from JSON
+	session := NewSession("id")
+	session.Dict.Set(FlashKey, map[string][]string{"info": {"message1"}})
+	errorIfNotEqual(t, "message1", strings.Join(session.Flash("info"), ","))
+	session.Dict.Set(FlashKey, map[string]interface{}{"Messages": map[string]interface{}{"info": []interface{}{"message2"}}})
+	errorIfNotEqual(t, "message2", strings.Join(session.Flashes()["info"], ","))
+}
+
+type testCountingSessionStore struct {
+	MemorySessionStore
+	saves int
+	locks int
+}
+
+func (cs *testCountingSessionStore) Lock() {
+	cs.locks += 1
+	cs.MemorySessionStore.Lock()
+}
+
+func (cs *testCountingSessionStore) Save(session *Session) {
+	cs.saves += 1
+	cs.MemorySessionStore.Save(session)
+}
+
+func TestSessionDirtyTracking(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	store := &testCountingSessionStore{}
+	app.Use(NewSessionMiddlewareWithStore(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), store, nil))
+	root := app.MountPoint("/")
+	root.Get("read", "read", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RequestContext(r).Session.GetString("key"))
+	})
+	root.Get("write", "write", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("key", "value")
+		fmt.Fprint(w, "ok")
+	})
+	client := NewTestClient(app)
+
+	client.Get("/write")
+	errorIfNotEqual(t, 1, store.saves)
+	store.saves = 0
+	errorIfNotEqual(t, "value", client.Get("/read").String())
+	errorIfNotEqual(t, 0, store.saves)
+	client.Get("/write")
+	errorIfNotEqual(t, 1, store.saves)
+
+	// the last access time is persisted if it is older than the resolution
+	store.saves = 0
+	for _, elem := range store.store {
+		elem.Value.(*Session).LastAccessTime = time.Now().Add(-2 * time.Minute)
+	}
+	client.Get("/read")
+	errorIfNotEqual(t, 1, store.saves)
+}
+
+func TestSessionExempt(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	store := &testCountingSessionStore{}
+	app.Use(NewSessionMiddlewareWithStore(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), store, nil))
+	root := app.MountPoint("/")
+	root.Get("page", "page", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("key", "value")
+		fmt.Fprint(w, "ok")
+	})
+	root.Get("metrics", "metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, RequestContext(r).Session == nil)
+	}).Meta.Set(MetaSessionExempt, true)
+	client := NewTestClient(app)
+
+	res := client.Get("/page")
+	errorIfNotEqual(t, 1, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, "value", res.Context.Session.GetString("key"))
+
+	store.locks = 0
+	res = client.Get("/metrics")
+	errorIfNotEqual(t, "true", res.String())
+	errorIfNotEqual(t, 0, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, 0, store.locks)
+
+	res = client.Get("/page")
+	errorIfNotEqual(t, 1, len(res.Header.Values("Set-Cookie")))
+	errorIfNotEqual(t, true, store.locks > 0)
+}
+
+func TestSessionHooks(t *testing.T) {
+	app, sm := newSessionTestApp(nil)
+	app.AccessLogger = func(LogLevel, string) {}
+	events := []string{}
+	for _, name := range []string{"session_created", "session_loaded", "session_destroyed"} {
+		name := name
+		app.Hooks.Add(name, func(w http.ResponseWriter, r *http.Request, data interface{}) {
+			events = append(events, fmt.Sprintf("%v:%v:%v", name, r != nil, data.(*Session).GetString("user")))
+		})
+	}
+	root := app.MountPoint("/")
+	root.Get("login", "login", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Set("user", "alice")
+		fmt.Fprint(w, "ok")
+	})
+	root.Get("logout", "logout", func(w http.ResponseWriter, r *http.Request) {
+		RequestContext(r).Session.Kill()
+		fmt.Fprint(w, "ok")
+	})
+	client := NewTestClient(app)
+
+	client.Get("/login")
+	client.Get("/page1")
+	client.Get("/logout")
+	errorIfNotEqual(t, "session_created:true:,session_loaded:true:alice,session_loaded:true:alice,session_destroyed:true:alice",
+		strings.Join(events, ","))
+
+	NewTestClient(app).Get("/login")
+	for _, elem := range sm.Store.(*MemorySessionStore).store {
+		elem.Value.(*Session).LastAccessTime = time.Now().Add(-time.Hour)
+	}
+	events = events[:0]
+	sm.Gc()
+	errorIfNotEqual(t, "session_destroyed:false:alice", strings.Join(events, ","))
+	errorIfNotEqual(t, 0, sm.Store.Count())
+
+	// expired sessions found by Load are also reported
+	client = NewTestClient(app)
+	client.Get("/login")
+	for _, elem := range sm.Store.(*MemorySessionStore).store {
+		elem.Value.(*Session).LastAccessTime = time.Now().Add(-time.Hour)
+	}
+	events = events[:0]
+	client.Get("/page1")
+	errorIfNotEqual(t, "session_destroyed:false:alice,session_created:true:", strings.Join(events, ","))
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	app, sm := newSessionTestApp(func(c *SessionConfig) {
+		c.LifeTime = time.Minute
+	})
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Get("login", "login", func(w http.ResponseWriter, r *http.Request) {
+		session := RequestContext(r).Session
+		session.Set("user", "alice")
+		if r.FormValue("remember") == "1" {
+			session.SetMaxAge(30 * 24 * time.Hour)
+		}
+		fmt.Fprint(w, "ok")
+	})
+
+	res := NewTestClient(app).Get("/login?remember=1")
+	header := res.Header.Get("Set-Cookie")
+	if !strings.Contains(header, "; Max-Age=2592000") || !strings.Contains(header, "; Expires=") {
+		t.Errorf("Set-Cookie should have the max age of the session, but got '%v'", header)
+	}
+	res = NewTestClient(app).Get("/login")
+	header = res.Header.Get("Set-Cookie")
+	if strings.Contains(header, "Max-Age=") || strings.Contains(header, "Expires=") {
+		t.Errorf("Set-Cookie should not have a max age, but got '%v'", header)
+	}
+
+	for _, elem := range sm.Store.(*MemorySessionStore).store {
+		elem.Value.(*Session).LastAccessTime = time.Now().Add(-time.Hour)
+	}
+	sm.Gc()
+	errorIfNotEqual(t, 1, sm.Store.Count())
+	for _, elem := range sm.Store.(*MemorySessionStore).store {
+		errorIfNotEqual(t, 30*24*time.Hour, elem.Value.(*Session).MaxAge)
+	}
+
+	session := NewSession("id")
+	session.SetMaxAge(time.Hour)
+	data, _ := encodeSession(session)
+	decoded, _ := decodeSession(data)
+	errorIfNotEqual(t, time.Hour, decoded.MaxAge)
+}
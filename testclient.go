@@ -0,0 +1,113 @@
+package cidre
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+// TestClient sends requests to an App without network listeners.
+// TestClient keeps cookies across requests, so session flows can be tested end-to-end.
+//
+//     client := cidre.NewTestClient(app)
+//     res := client.PostForm("/login", url.Values{"name": {"alice"}})
+//     res = client.Get("/mypage")
+//     if res.Status != 200 || res.Context.Session.GetString("name") != "alice" {
+//         t.Error("login failed")
+//     }
+type TestClient struct {
+	App *App
+	// A base URL of requests, default: "http://example.com"
+	BaseURL string
+	// A cookie jar that stores cookies across requests. Set nil to disable cookies.
+	Jar http.CookieJar
+}
+
+// TestResponse is a response returned by the TestClient.
+type TestResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// A Context object that was used while handling the request.
+	Context *Context
+	// An underlying ResponseRecorder
+	Recorder *httptest.ResponseRecorder
+}
+
+type testClientKey struct{}
+
+// Returns a new TestClient object.
+func NewTestClient(app *App) *TestClient {
+	jar, _ := cookiejar.New(nil)
+	return &TestClient{
+		App:     app,
+		BaseURL: "http://example.com",
+		Jar:     jar,
+	}
+}
+
+// Returns a new http.Request object. A relative path is resolved against the BaseURL.
+func (tc *TestClient) NewRequest(method, path string, body io.Reader) *http.Request {
+	if !strings.Contains(path, "://") {
+		path = strings.TrimRight(tc.BaseURL, "/") + path
+	}
+	return httptest.NewRequest(method, path, body)
+}
+
+// Sends the given request to the App. Do runs App.Setup if the App is not set up yet.
+func (tc *TestClient) Do(req *http.Request) *TestResponse {
+	if tc.App.accessLogTemplate == nil {
+		tc.App.Setup()
+	}
+	if tc.Jar != nil {
+		for _, cookie := range tc.Jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+	}
+	req = req.WithContext(context.WithValue(req.Context(), testClientKey{}, true))
+	recorder := httptest.NewRecorder()
+	tc.App.ServeHTTP(recorder, req)
+	res := recorder.Result()
+	if tc.Jar != nil {
+		tc.Jar.SetCookies(req.URL, res.Cookies())
+	}
+	return &TestResponse{
+		Status:   recorder.Code,
+		Header:   recorder.Header(),
+		Body:     recorder.Body.Bytes(),
+		Context:  RequestContext(req),
+		Recorder: recorder,
+	}
+}
+
+// Sends a GET request.
+func (tc *TestClient) Get(path string) *TestResponse {
+	return tc.Do(tc.NewRequest("GET", path, nil))
+}
+
+// Sends a POST request with the given body.
+func (tc *TestClient) Post(path, contentType string, body io.Reader) *TestResponse {
+	req := tc.NewRequest("POST", path, body)
+	req.Header.Set("Content-Type", contentType)
+	return tc.Do(req)
+}
+
+// Sends a POST request with the given form values.
+func (tc *TestClient) PostForm(path string, values url.Values) *TestResponse {
+	return tc.Post(path, "application/x-www-form-urlencoded", strings.NewReader(values.Encode()))
+}
+
+// Returns the response body as a string.
+func (res *TestResponse) String() string {
+	return string(res.Body)
+}
+
+// Decodes the response body as JSON into the given object.
+func (res *TestResponse) Json(v interface{}) error {
+	return json.Unmarshal(res.Body, v)
+}
@@ -0,0 +1,46 @@
+package cidre
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestTestClient(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	app.Use(NewSessionMiddleware(app, DefaultSessionConfig(func(c *SessionConfig) {
+		c.Secret = "secret"
+	}), nil))
+	root := app.MountPoint("/")
+	root.Post("login", "login", func(w http.ResponseWriter, r *http.Request) {
+		ctx := RequestContext(r)
+		ctx.Session.Set("name", r.PostFormValue("name"))
+		ctx.Set("action", "login")
+		fmt.Fprint(w, "ok")
+	})
+	root.Get("mypage", "mypage", func(w http.ResponseWriter, r *http.Request) {
+		app.Renderer.Json(w, map[string]interface{}{"name": RequestContext(r).Session.GetString("name")})
+	})
+
+	client := NewTestClient(app)
+	res := client.PostForm("/login", url.Values{"name": {"alice"}})
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "ok", res.String())
+	errorIfNotEqual(t, "login", res.Context.GetString("action"))
+
+	res = client.Get("/mypage")
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "application/json; charset=UTF-8", res.Header.Get("Content-Type"))
+	var data map[string]string
+	errorIfNotEqual(t, nil, res.Json(&data))
+	errorIfNotEqual(t, "alice", data["name"])
+	errorIfNotEqual(t, "alice", res.Context.Session.GetString("name"))
+
+	res = client.Get("/notfound")
+	errorIfNotEqual(t, http.StatusNotFound, res.Status)
+	errorIfNotEqual(t, (*Route)(nil), res.Context.Route)
+}
@@ -0,0 +1,294 @@
+package cidre
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UploadedFile represents a file uploaded as a part of a multipart form.
+type UploadedFile struct {
+	// A name of the file sent by the client. Do not use this value as a local file path.
+	Filename string
+	// A size of the file in bytes.
+	Size int64
+	// A content type sniffed from the contents. The Content-Type header sent by the client is not used.
+	ContentType string
+	header      *multipart.FileHeader
+}
+
+func newUploadedFile(header *multipart.FileHeader) (*UploadedFile, error) {
+	file := &UploadedFile{
+		Filename: header.Filename,
+		Size:     header.Size,
+		header:   header,
+	}
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	file.ContentType = http.DetectContentType(buf[:n])
+	return file, nil
+}
+
+// Opens the uploaded file.
+func (uf *UploadedFile) Open() (multipart.File, error) {
+	return uf.header.Open()
+}
+
+// Returns the multipart.FileHeader of the uploaded file.
+func (uf *UploadedFile) Header() *multipart.FileHeader {
+	return uf.header
+}
+
+// Saves the uploaded file to the given path.
+// The path is cleaned, and relative paths that point outside of the current directory are rejected.
+func (uf *UploadedFile) Save(dst string) error {
+	dst, err := cleanUploadPath(dst)
+	if err != nil {
+		return err
+	}
+	src, err := uf.header.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func cleanUploadPath(dst string) (string, error) {
+	dst = filepath.Clean(dst)
+	if dst == ".." || strings.HasPrefix(dst, ".."+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf("upload: destination '%v' is outside of the current directory", dst))
+	}
+	return dst, nil
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// Parses a multipart form at most once, so that the method overwriting in App.ServeHTTP,
+// UploadMiddleware and handlers do not consume the request body twice.
+func (ctx *Context) parseMultipartForm() error {
+	r := ctx.Request
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if ctx.multipartErr != nil {
+		return ctx.multipartErr
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, ctx.App.Config.MaxUploadSize)
+	ctx.multipartErr = r.ParseMultipartForm(ctx.App.Config.MaxMultipartMemory)
+	return ctx.multipartErr
+}
+
+// Returns the first file for the given form field name.
+// FormFile returns http.ErrMissingFile if the field does not exist, and
+// a *http.MaxBytesError if the request body is larger than AppConfig.MaxUploadSize.
+func (ctx *Context) FormFile(name string) (*UploadedFile, error) {
+	if err := ctx.parseMultipartForm(); err != nil {
+		return nil, err
+	}
+	headers := ctx.Request.MultipartForm.File[name]
+	if len(headers) == 0 {
+		return nil, http.ErrMissingFile
+	}
+	return newUploadedFile(headers[0])
+}
+
+// Same as FormFile, but returns the opened file and the multipart.FileHeader like http.Request.FormFile.
+// The returned file must be closed by the caller.
+func (ctx *Context) MultipartFile(name string) (multipart.File, *multipart.FileHeader, error) {
+	file, err := ctx.FormFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, file.Header(), nil
+}
+
+// Saves the first file for the given form field name to the given path.
+// The path is cleaned, and relative paths that point outside of the current directory are rejected.
+// If the path is a directory, the file is saved in the directory with the base name of
+// the file name sent by the client.
+func (ctx *Context) SaveUploadedFile(name string, dst string) error {
+	file, err := ctx.FormFile(name)
+	if err != nil {
+		return err
+	}
+	dst, err = cleanUploadPath(dst)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		base := filepath.Base(filepath.Clean("/" + filepath.ToSlash(file.Filename)))
+		if base == string(filepath.Separator) || base == "." {
+			return errors.New(fmt.Sprintf("upload: invalid file name '%v'", file.Filename))
+		}
+		dst = filepath.Join(dst, base)
+	}
+	return file.Save(dst)
+}
+
+// UploadConfig is a configuration object for the UploadMiddleware
+type UploadConfig struct {
+	// Maximum size of each uploaded file. If this value is 0, sizes are limited only by AppConfig.MaxUploadSize.
+	// default: 0
+	MaxFileSize int64
+	// Allowed file extensions like ".png". If this value is empty, all extensions are allowed.
+	// default: nil
+	AllowedExtensions []string
+	// Allowed content types like "image/png" or "image/*". Content types are sniffed from the file contents.
+	// If this value is empty, all content types are allowed.
+	// default: nil
+	AllowedTypes []string
+}
+
+// Returns an UploadConfig object that has default values set.
+// If an 'init' function object argument is not nil, this function
+// will call the function with the UploadConfig object.
+func DefaultUploadConfig(init ...func(*UploadConfig)) *UploadConfig {
+	self := &UploadConfig{
+		MaxFileSize:       0,
+		AllowedExtensions: nil,
+		AllowedTypes:      nil,
+	}
+	if len(init) > 0 {
+		init[0](self)
+	}
+	return self
+}
+
+// UploadError is an error that occurs when an uploaded file violates an UploadConfig.
+type UploadError struct {
+	// A form field name of the file
+	Field string
+	// A name of the file sent by the client
+	Filename string
+	// A HTTP status code to be used for responses
+	Status int
+	// An underlying error
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("upload: field '%v', file '%v': %v", e.Field, e.Filename, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+func (uc *UploadConfig) check(field string, file *UploadedFile) error {
+	if uc.MaxFileSize > 0 && file.Size > uc.MaxFileSize {
+		return &UploadError{field, file.Filename, http.StatusRequestEntityTooLarge,
+			errors.New(fmt.Sprintf("file size exceeds %v bytes", uc.MaxFileSize))}
+	}
+	if len(uc.AllowedExtensions) != 0 {
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		allowed := false
+		for _, allowedExt := range uc.AllowedExtensions {
+			if strings.ToLower("."+strings.TrimPrefix(allowedExt, ".")) == ext {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &UploadError{field, file.Filename, http.StatusUnsupportedMediaType,
+				errors.New(fmt.Sprintf("extension '%v' is not allowed", ext))}
+		}
+	}
+	if len(uc.AllowedTypes) != 0 {
+		mediatype, _, _ := mime.ParseMediaType(file.ContentType)
+		allowed := false
+		for _, typ := range uc.AllowedTypes {
+			typ = strings.ToLower(typ)
+			if typ == mediatype || (strings.HasSuffix(typ, "/*") && strings.HasPrefix(mediatype, typ[:len(typ)-1])) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &UploadError{field, file.Filename, http.StatusUnsupportedMediaType,
+				errors.New(fmt.Sprintf("content type '%v' is not allowed", mediatype))}
+		}
+	}
+	return nil
+}
+
+// Middleware that checks uploaded files before handlers see them.
+// UploadMiddleware responds with 413 Request Entity Too Large if the request body or a file is too large, and
+// 415 Unsupported Media Type if a file has a disallowed extension or content type.
+//
+//     uploads := app.MountPoint("/uploads/")
+//     uploads.Use(cidre.NewUploadMiddleware(cidre.DefaultUploadConfig(func(c *cidre.UploadConfig) {
+//         c.MaxFileSize = 1 << 20
+//         c.AllowedTypes = []string{"image/*"}
+//     })))
+type UploadMiddleware struct {
+	Config *UploadConfig
+}
+
+// Returns a new UploadMiddleware object.
+func NewUploadMiddleware(config *UploadConfig) *UploadMiddleware {
+	return &UploadMiddleware{Config: config}
+}
+
+func (um *UploadMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(r)
+	if !isMultipartRequest(r) {
+		ctx.MiddlewareChain.DoNext(w, r)
+		return
+	}
+	if err := ctx.parseMultipartForm(); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		}
+		return
+	}
+	for field, headers := range ctx.Request.MultipartForm.File {
+		for _, header := range headers {
+			file, err := newUploadedFile(header)
+			if err == nil {
+				err = um.Config.check(field, file)
+			}
+			if err != nil {
+				status := http.StatusBadRequest
+				var uploadError *UploadError
+				if errors.As(err, &uploadError) {
+					status = uploadError.Status
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+	}
+	ctx.MiddlewareChain.DoNext(w, r)
+}
@@ -0,0 +1,183 @@
+package cidre
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestMultipartRequest(fields map[string]string, field, filename string, content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if len(field) != 0 {
+		fw, _ := mw.CreateFormFile(field, filename)
+		fw.Write(content)
+	}
+	mw.Close()
+	req, _ := http.NewRequest("POST", "http://example.com/upload", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestContextFormFile(t *testing.T) {
+	dir := t.TempDir()
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	var uploaded *UploadedFile
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		file, err := RequestContext(r).FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploaded = file
+		if err := file.Save(filepath.Join(dir, "saved.txt")); err != nil {
+			t.Error(err)
+		}
+		if err := file.Save("../saved.txt"); err == nil {
+			t.Error("paths outside of the current directory should be rejected")
+		}
+		w.Write([]byte(RequestContext(r).Route.Method))
+	}
+	root.Post("upload", "upload", handler)
+	root.Put("upload_put", "upload", handler)
+	client := NewTestClient(app)
+
+	res := client.Do(newTestMultipartRequest(nil, "file", "hello.txt", []byte("hello, world")))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "hello.txt", uploaded.Filename)
+	errorIfNotEqual(t, int64(12), uploaded.Size)
+	errorIfNotEqual(t, "text/plain; charset=utf-8", uploaded.ContentType)
+	saved, _ := os.ReadFile(filepath.Join(dir, "saved.txt"))
+	errorIfNotEqual(t, "hello, world", string(saved))
+
+	res = client.Do(newTestMultipartRequest(map[string]string{"_method": "PUT"}, "file", "put.txt", []byte("put")))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "PUT", res.String())
+	saved, _ = os.ReadFile(filepath.Join(dir, "saved.txt"))
+	errorIfNotEqual(t, "put", string(saved))
+
+	res = client.Do(newTestMultipartRequest(map[string]string{"name": "value"}, "", "", nil))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+	errorIfNotEqual(t, http.ErrMissingFile.Error()+"\n", res.String())
+
+	app.Config.MaxUploadSize = 100
+	res = client.Do(newTestMultipartRequest(nil, "file", "large.txt", bytes.Repeat([]byte("a"), 1000)))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+}
+
+func TestContextSaveUploadedFile(t *testing.T) {
+	dir := t.TempDir()
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	dst := ""
+	root.Post("upload", "upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := RequestContext(r).SaveUploadedFile("file", dst); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	client := NewTestClient(app)
+
+	dst = filepath.Join(dir, "sub", "..", "saved.txt")
+	res := client.Do(newTestMultipartRequest(nil, "file", "hello.txt", []byte("hello")))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	saved, _ := os.ReadFile(filepath.Join(dir, "saved.txt"))
+	errorIfNotEqual(t, "hello", string(saved))
+
+	// client file names can not escape from the directory
+	dst = dir
+	res = client.Do(newTestMultipartRequest(nil, "file", "../../escaped.txt", []byte("escaped")))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	saved, _ = os.ReadFile(filepath.Join(dir, "escaped.txt"))
+	errorIfNotEqual(t, "escaped", string(saved))
+
+	dst = "../saved.txt"
+	res = client.Do(newTestMultipartRequest(nil, "file", "hello.txt", []byte("hello")))
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+}
+
+func TestAppMaxMultipartMemory(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.MaxMultipartMemory = 10
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	onDisk := map[string]bool{}
+	tempFile := ""
+	root.Post("upload", "upload", func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"small", "large"} {
+			f, header, err := RequestContext(r).MultipartFile(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			errorIfNotEqual(t, name+".txt", header.Filename)
+			var osFile *os.File
+			osFile, onDisk[name] = f.(*os.File)
+			if onDisk[name] {
+				tempFile = osFile.Name()
+			}
+			f.Close()
+		}
+	})
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("small", "small.txt")
+	fw.Write([]byte("abc"))
+	fw, _ = mw.CreateFormFile("large", "large.txt")
+	fw.Write(bytes.Repeat([]byte("a"), 100))
+	mw.Close()
+	req, _ := http.NewRequest("POST", "http://example.com/upload", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res := NewTestClient(app).Do(req)
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, false, onDisk["small"])
+	errorIfNotEqual(t, true, onDisk["large"])
+	if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+		t.Errorf("temporary file %v should be removed after the request", tempFile)
+	}
+}
+
+func TestUploadMiddleware(t *testing.T) {
+	app := NewApp(DefaultAppConfig())
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Use(NewUploadMiddleware(DefaultUploadConfig(func(c *UploadConfig) {
+		c.MaxFileSize = 100
+		c.AllowedExtensions = []string{".txt", "CSV"}
+		c.AllowedTypes = []string{"text/*"}
+	})))
+	root.Post("upload", "upload", func(w http.ResponseWriter, r *http.Request) {
+		file, _ := RequestContext(r).FormFile("file")
+		w.Write([]byte(file.Filename))
+	})
+	client := NewTestClient(app)
+
+	res := client.Do(newTestMultipartRequest(nil, "file", "ok.txt", []byte("ok")))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "ok.txt", res.String())
+
+	res = client.Do(newTestMultipartRequest(nil, "file", "ok.csv", []byte("a,b")))
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+
+	res = client.Do(newTestMultipartRequest(nil, "file", "large.txt", bytes.Repeat([]byte("a"), 101)))
+	errorIfNotEqual(t, http.StatusRequestEntityTooLarge, res.Status)
+
+	res = client.Do(newTestMultipartRequest(nil, "file", "image.png", []byte("text")))
+	errorIfNotEqual(t, http.StatusUnsupportedMediaType, res.Status)
+
+	res = client.Do(newTestMultipartRequest(nil, "file", "image.txt", []byte("\x89PNG\x0D\x0A\x1A\x0A")))
+	errorIfNotEqual(t, http.StatusUnsupportedMediaType, res.Status)
+
+	app.Config.MaxUploadSize = 100
+	res = client.Do(newTestMultipartRequest(nil, "file", "ok.txt", bytes.Repeat([]byte("a"), 50)))
+	errorIfNotEqual(t, http.StatusRequestEntityTooLarge, res.Status)
+}
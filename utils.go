@@ -2,45 +2,71 @@ package cidre
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 /* DynamicObjectFactory {{{ */
 
-type dynamicObjectFactory map[string]reflect.Type
-
-var dynamicObjectFactoryCh = make(chan bool, 1)
+type dynamicObjectFactory struct {
+	mutex sync.RWMutex
+	types map[string]reflect.Type
+}
 
 // DynamicObjectFactory provides functions to create an object by string name.
+// DynamicObjectFactory is safe for concurrent use.
 //
 //     package mypackage
 //
 //     type MyObject struct {}
 //     DynamicObjectFactory.Register(MyObject{})
 //     DynamicObjectFactory.New("mypackage.MyObject")
-var DynamicObjectFactory = make(dynamicObjectFactory)
+var DynamicObjectFactory = &dynamicObjectFactory{types: make(map[string]reflect.Type)}
 
-func (self dynamicObjectFactory) Register(infs ...interface{}) {
-	dynamicObjectFactoryCh <- true
-	defer func() { <-dynamicObjectFactoryCh }()
+func (self *dynamicObjectFactory) Register(infs ...interface{}) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	for _, inf := range infs {
 		typ := reflect.TypeOf(inf)
-		self[typ.String()] = typ
+		self.types[typ.String()] = typ
 	}
 }
 
-func (self dynamicObjectFactory) New(name string) interface{} {
-	dynamicObjectFactoryCh <- true
-	defer func() { <-dynamicObjectFactoryCh }()
-	typ, ok := self[name]
+// Returns true if a type with the given name is registered.
+func (self *dynamicObjectFactory) Has(name string) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	_, ok := self.types[name]
+	return ok
+}
+
+// Returns a pointer to a new object of the given type name, or an error if the type is not registered.
+func (self *dynamicObjectFactory) NewSafe(name string) (interface{}, error) {
+	self.mutex.RLock()
+	typ, ok := self.types[name]
+	self.mutex.RUnlock()
 	if !ok {
-		panic("DynamicObjectFactory: type name " + name + " not found.")
+		return nil, errors.New("DynamicObjectFactory: type name " + name + " not found.")
+	}
+	return reflect.New(typ).Interface(), nil
+}
+
+// Returns a pointer to a new object of the given type name. New panics if the type is not registered.
+func (self *dynamicObjectFactory) New(name string) interface{} {
+	obj, err := self.NewSafe(name)
+	if err != nil {
+		panic(err.Error())
 	}
-	return reflect.New(typ).Interface()
+	return obj
 }
 
 // }}}
@@ -87,28 +113,107 @@ func (self Dict) Has(key string) bool {
 	return ok
 }
 
-func (self Dict) GetString(key string) string {
-	if v, ok := self[key]; ok {
-		return v.(string)
-	} else {
-		return ""
+// Returns a string value associated with the given key.
+// The second return value is false if the key is missing or the value is not a string.
+func (self Dict) TryString(key string) (string, bool) {
+	v, ok := self[key].(string)
+	return v, ok
+}
+
+// Returns an int value associated with the given key. An int64 value is converted to an int.
+// The second return value is false if the key is missing or the value is not an int.
+func (self Dict) TryInt(key string) (int, bool) {
+	switch v := self[key].(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
 	}
+	return 0, false
+}
+
+// Returns an int64 value associated with the given key.
+// The second return value is false if the key is missing or the value is not an int64.
+func (self Dict) TryInt64(key string) (int64, bool) {
+	v, ok := self[key].(int64)
+	return v, ok
 }
 
+// Returns a float64 value associated with the given key.
+// The second return value is false if the key is missing or the value is not a float64.
+func (self Dict) TryFloat64(key string) (float64, bool) {
+	v, ok := self[key].(float64)
+	return v, ok
+}
+
+// Returns a time.Duration value associated with the given key.
+// The second return value is false if the key is missing or the value is not a time.Duration.
+func (self Dict) TryDuration(key string) (time.Duration, bool) {
+	v, ok := self[key].(time.Duration)
+	return v, ok
+}
+
+// Returns a []string value associated with the given key.
+// The second return value is false if the key is missing or the value is not a []string.
+func (self Dict) TryStringSlice(key string) ([]string, bool) {
+	v, ok := self[key].([]string)
+	return v, ok
+}
+
+// Returns a bool value associated with the given key.
+// The second return value is false if the key is missing or the value is not a bool.
+func (self Dict) TryBool(key string) (bool, bool) {
+	v, ok := self[key].(bool)
+	return v, ok
+}
+
+// Returns a string value associated with the given key, or an empty string if
+// the key is missing or the value is not a string.
+func (self Dict) GetString(key string) string {
+	v, _ := self.TryString(key)
+	return v
+}
+
+// Returns an int value associated with the given key, or 0 if
+// the key is missing or the value is not an int.
 func (self Dict) GetInt(key string) int {
-	if v, ok := self[key]; ok {
-		return v.(int)
-	} else {
-		return 0
-	}
+	v, _ := self.TryInt(key)
+	return v
+}
+
+// Returns an int64 value associated with the given key, or 0 if
+// the key is missing or the value is not an int64.
+func (self Dict) GetInt64(key string) int64 {
+	v, _ := self.TryInt64(key)
+	return v
+}
+
+// Returns a float64 value associated with the given key, or 0 if
+// the key is missing or the value is not a float64.
+func (self Dict) GetFloat64(key string) float64 {
+	v, _ := self.TryFloat64(key)
+	return v
 }
 
+// Returns a time.Duration value associated with the given key, or 0 if
+// the key is missing or the value is not a time.Duration.
+func (self Dict) GetDuration(key string) time.Duration {
+	v, _ := self.TryDuration(key)
+	return v
+}
+
+// Returns a []string value associated with the given key, or nil if
+// the key is missing or the value is not a []string.
+func (self Dict) GetStringSlice(key string) []string {
+	v, _ := self.TryStringSlice(key)
+	return v
+}
+
+// Returns a bool value associated with the given key, or false if
+// the key is missing or the value is not a bool.
 func (self Dict) GetBool(key string) bool {
-	if v, ok := self[key]; ok {
-		return v.(bool)
-	} else {
-		return false
-	}
+	v, _ := self.TryBool(key)
+	return v
 }
 
 func (self Dict) Set(key string, value interface{}) Dict {
@@ -134,18 +239,62 @@ func BuildString(ca int, ss ...string) string {
 	return string(buf)
 }
 
-// Returns a string with a HMAC signature.
+// Returns a hex encoded string of nbytes random bytes read from crypto/rand.
+// Ids with 16 or more bytes are unguessable and collisions are negligible.
+// GenerateRandomId panics if the random number generator fails.
+func GenerateRandomId(nbytes int) string {
+	buf := make([]byte, nbytes)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+const signatureSeparator = "----"
+
+// Returns a string with a HMAC-SHA256 signature.
 func SignString(value, key string) string {
-	return fmt.Sprintf("%x----%s", hmac.New(sha1.New, []byte(key)).Sum([]byte(value)), value)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return BuildString(64+len(signatureSeparator)+len(value), hex.EncodeToString(mac.Sum(nil)), signatureSeparator, value)
 }
 
 // Returns a string if HMAC signature is valid.
 func ValidateSignedString(value, key string) (string, error) {
-	parts := strings.SplitN(value, "----", 2)
-	if parts[0] == fmt.Sprintf("%x", hmac.New(sha1.New, []byte(key)).Sum([]byte(parts[1]))) {
-		return parts[1], nil
+	parts := strings.SplitN(value, signatureSeparator, 2)
+	if len(parts) != 2 {
+		return "", errors.New("data is malformed")
+	}
+	signature, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("data is malformed")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("data is tampered")
+	}
+	return parts[1], nil
+}
+
+// Same as ValidateSignedString, but also accepts strings signed by the SignString
+// of older versions. Legacy signatures do not depend on the value, so anyone who has
+// a legacy-signed string can forge signatures for any values. This function should
+// be used only while migrating, and never for values that are trusted as they are.
+func ValidateSignedStringCompat(value, key string) (string, error) {
+	result, err := ValidateSignedString(value, key)
+	if err == nil {
+		return result, nil
+	}
+	parts := strings.SplitN(value, signatureSeparator, 2)
+	if len(parts) != 2 {
+		return "", err
+	}
+	legacy := []byte(fmt.Sprintf("%x", hmac.New(sha1.New, []byte(key)).Sum([]byte(parts[1]))))
+	if !hmac.Equal([]byte(parts[0]), legacy) {
+		return "", err
 	}
-	return "", errors.New("data is tampered")
+	return parts[1], nil
 }
 
 // }}}
@@ -1,8 +1,14 @@
 package cidre
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testDynamicStruct1 struct{}
@@ -12,12 +18,30 @@ func TestDynamicObjectFactory(t *testing.T) {
 	DynamicObjectFactory.Register(testDynamicStruct1{})
 	errorIfNotEqual(t, reflect.TypeOf(&testDynamicStruct1{}).String(),
 		reflect.TypeOf(DynamicObjectFactory.New("cidre.testDynamicStruct1")).String())
+	errorIfNotEqual(t, true, DynamicObjectFactory.Has("cidre.testDynamicStruct1"))
+	errorIfNotEqual(t, false, DynamicObjectFactory.Has("cidre.testDynamicStruct2"))
 }
 
 func TestBuildString(t *testing.T) {
 	errorIfNotEqual(t, "ABCDE", BuildString(10, "A", "B", "C", "D", "E"))
 }
 
+func TestGenerateRandomId(t *testing.T) {
+	ids := make(map[string]bool, 10000)
+	for i := 0; i < 10000; i++ {
+		id := GenerateRandomId(32)
+		errorIfNotEqual(t, 64, len(id))
+		if strings.Trim(id, "0123456789abcdef") != "" {
+			t.Fatalf("id should be a hex string, but got '%v'", id)
+		}
+		if ids[id] {
+			t.Fatalf("id should be unique, but got '%v' twice", id)
+		}
+		ids[id] = true
+	}
+	errorIfNotEqual(t, 16, len(GenerateRandomId(8)))
+}
+
 func TestSignedString(t *testing.T) {
 	str := "ABCDE"
 	secret := "secret"
@@ -31,4 +55,149 @@ func TestSignedString(t *testing.T) {
 	if _, err := ValidateSignedString(tampered, secret); err == nil {
 		t.Errorf("data has been tampered, but err is nil")
 	}
+	errorIfNotEqual(t, "fcd8386726479c826ee5f3ca86f7a588e64942a03f3d6c2a5aa156ba5dad5622----ABCDE", signed)
+
+	for _, value := range []string{
+		strings.Replace(signed, "ABCDE", "ABCDF", 1),
+		signed[:64] + "----",
+		"",
+		"ABCDE",
+		"zz----ABCDE",
+		"----ABCDE",
+		SignString(str, "other"),
+		legacySignString(str, secret),
+	} {
+		if _, err := ValidateSignedString(value, secret); err == nil {
+			t.Errorf("'%v' should be invalid", value)
+		}
+	}
+	if _, err := ValidateSignedString(signed, "other"); err == nil {
+		t.Errorf("signature with a different key should be invalid")
+	}
+}
+
+func legacySignString(value, key string) string {
+	return fmt.Sprintf("%x----%s", hmac.New(sha1.New, []byte(key)).Sum([]byte(value)), value)
+}
+
+func TestSignedStringCompat(t *testing.T) {
+	secret := "secret"
+	for _, signed := range []string{SignString("ABCDE", secret), legacySignString("ABCDE", secret)} {
+		decoded, err := ValidateSignedStringCompat(signed, secret)
+		errorIfNotEqual(t, nil, err)
+		errorIfNotEqual(t, "ABCDE", decoded)
+	}
+	for _, value := range []string{
+		legacySignString("ABCDE", "other"),
+		"0" + legacySignString("ABCDE", secret)[1:],
+		"ABCDE",
+		"",
+	} {
+		if _, err := ValidateSignedStringCompat(value, secret); err == nil {
+			t.Errorf("'%v' should be invalid", value)
+		}
+	}
+}
+
+func TestDictTypedGetters(t *testing.T) {
+	dict := NewDict()
+	dict.Set("int", 1).Set("int64", int64(2)).Set("float64", 3.5)
+	dict.Set("duration", 4*time.Second).Set("strings", []string{"a", "b"})
+
+	errorIfNotEqual(t, 1, dict.GetInt("int"))
+	errorIfNotEqual(t, 2, dict.GetInt("int64"))
+	errorIfNotEqual(t, int64(2), dict.GetInt64("int64"))
+	errorIfNotEqual(t, 3.5, dict.GetFloat64("float64"))
+	errorIfNotEqual(t, 4*time.Second, dict.GetDuration("duration"))
+	errorIfNotEqual(t, "b", dict.GetStringSlice("strings")[1])
+
+	errorIfNotEqual(t, int64(0), dict.GetInt64("missing"))
+	errorIfNotEqual(t, 0.0, dict.GetFloat64("missing"))
+	errorIfNotEqual(t, time.Duration(0), dict.GetDuration("missing"))
+	errorIfNotEqual(t, 0, len(dict.GetStringSlice("missing")))
+
+	errorIfNotEqual(t, int64(0), dict.GetInt64("float64"))
+	errorIfNotEqual(t, 0.0, dict.GetFloat64("int64"))
+	errorIfNotEqual(t, time.Duration(0), dict.GetDuration("int64"))
+	errorIfNotEqual(t, 0, len(dict.GetStringSlice("int")))
+	errorIfNotEqual(t, "", dict.GetString("int"))
+	errorIfNotEqual(t, 0, dict.GetInt("float64"))
+	errorIfNotEqual(t, false, dict.GetBool("int"))
+}
+
+func TestDictTryGetters(t *testing.T) {
+	dict := NewDict()
+	dict.Set("string", "a").Set("int", 1).Set("int64", int64(2)).Set("bool", true)
+
+	v1, ok := dict.TryString("string")
+	errorIfNotEqual(t, "a", v1)
+	errorIfNotEqual(t, true, ok)
+	v1, ok = dict.TryString("int")
+	errorIfNotEqual(t, "", v1)
+	errorIfNotEqual(t, false, ok)
+	_, ok = dict.TryString("missing")
+	errorIfNotEqual(t, false, ok)
+
+	v2, ok := dict.TryInt("int")
+	errorIfNotEqual(t, 1, v2)
+	errorIfNotEqual(t, true, ok)
+	v2, ok = dict.TryInt("int64")
+	errorIfNotEqual(t, 2, v2)
+	errorIfNotEqual(t, true, ok)
+	v2, ok = dict.TryInt("string")
+	errorIfNotEqual(t, 0, v2)
+	errorIfNotEqual(t, false, ok)
+	_, ok = dict.TryInt("missing")
+	errorIfNotEqual(t, false, ok)
+
+	v3, ok := dict.TryBool("bool")
+	errorIfNotEqual(t, true, v3)
+	errorIfNotEqual(t, true, ok)
+	_, ok = dict.TryBool("string")
+	errorIfNotEqual(t, false, ok)
+	_, ok = dict.TryBool("missing")
+	errorIfNotEqual(t, false, ok)
+
+	_, ok = dict.TryInt64("int")
+	errorIfNotEqual(t, false, ok)
+	_, ok = dict.TryFloat64("int")
+	errorIfNotEqual(t, false, ok)
+	_, ok = dict.TryDuration("int64")
+	errorIfNotEqual(t, false, ok)
+	_, ok = dict.TryStringSlice("string")
+	errorIfNotEqual(t, false, ok)
+}
+
+type testDynamicStruct3 struct{}
+
+func TestDynamicObjectFactoryNewSafe(t *testing.T) {
+	if _, err := DynamicObjectFactory.NewSafe("cidre.unknownStruct"); err == nil {
+		t.Error("NewSafe should return an error for unknown names")
+	}
+	func() {
+		defer func() {
+			if recv := recover(); recv == nil {
+				t.Error("New should cause panic for unknown names")
+			}
+		}()
+		DynamicObjectFactory.New("cidre.unknownStruct")
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			DynamicObjectFactory.Register(testDynamicStruct3{})
+		}()
+		go func() {
+			defer wg.Done()
+			DynamicObjectFactory.NewSafe("cidre.testDynamicStruct3")
+			DynamicObjectFactory.Has("cidre.testDynamicStruct3")
+		}()
+	}
+	wg.Wait()
+	obj, err := DynamicObjectFactory.NewSafe("cidre.testDynamicStruct3")
+	errorIfNotEqual(t, nil, err)
+	errorIfNotEqual(t, "*cidre.testDynamicStruct3", reflect.TypeOf(obj).String())
 }
@@ -0,0 +1,170 @@
+package cidre
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validatable is an interface for objects that can validate themselves.
+// Context.Bind* methods call Validate after objects are bound.
+type Validatable interface {
+	Validate() error
+}
+
+// ValidationErrors is a map of field names to error messages.
+// ValidationErrors is serialized as a JSON object like {"name":["is required"]},
+// and can be used in templates to redisplay forms.
+//
+//     func (f *SignupForm) Validate() error {
+//         errs := cidre.ValidationErrors{}
+//         errs.Check("name", f.Name, cidre.Required(), cidre.MaxLen(50))
+//         errs.Check("age", f.Age, cidre.Range(0, 150))
+//         return errs.Err()
+//     }
+type ValidationErrors map[string][]string
+
+func (ve ValidationErrors) Error() string {
+	fields := make([]string, 0, len(ve))
+	for field := range ve {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	messages := make([]string, 0, len(ve))
+	for _, field := range fields {
+		messages = append(messages, fmt.Sprintf("%v %v", field, strings.Join(ve[field], ", ")))
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// Adds an error message for the given field.
+func (ve ValidationErrors) Add(field, message string) {
+	ve[field] = append(ve[field], message)
+}
+
+// Returns true if the given field has errors.
+func (ve ValidationErrors) Has(field string) bool {
+	return len(ve[field]) != 0
+}
+
+// Returns the first error message for the given field, or an empty string.
+func (ve ValidationErrors) First(field string) string {
+	if messages := ve[field]; len(messages) != 0 {
+		return messages[0]
+	}
+	return ""
+}
+
+// Checks the given value with rules and adds error messages for the field.
+func (ve ValidationErrors) Check(field string, value interface{}, rules ...ValidationRule) {
+	for _, rule := range rules {
+		if message := rule(value); len(message) != 0 {
+			ve.Add(field, message)
+		}
+	}
+}
+
+// Returns nil if there are no errors, otherwise returns itself.
+func (ve ValidationErrors) Err() error {
+	if len(ve) == 0 {
+		return nil
+	}
+	return ve
+}
+
+// ValidationRule checks a value and returns an error message, or an empty string if the value is valid.
+type ValidationRule func(interface{}) string
+
+// Returns a rule that rejects zero values(empty strings, 0, nil, etc).
+func Required() ValidationRule {
+	return func(value interface{}) string {
+		v := reflect.ValueOf(value)
+		if !v.IsValid() || v.IsZero() || ((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0) {
+			return "is required"
+		}
+		return ""
+	}
+}
+
+// Returns a rule that rejects strings longer than n characters and slices longer than n elements.
+func MaxLen(n int) ValidationRule {
+	return func(value interface{}) string {
+		length := 0
+		if s, ok := value.(string); ok {
+			length = utf8.RuneCountInString(s)
+		} else if v := reflect.ValueOf(value); v.Kind() == reflect.Slice || v.Kind() == reflect.Map {
+			length = v.Len()
+		}
+		if length > n {
+			return fmt.Sprintf("must be at most %v characters", n)
+		}
+		return ""
+	}
+}
+
+// Returns a rule that rejects numbers out of the range [min, max].
+func Range(min, max float64) ValidationRule {
+	return func(value interface{}) string {
+		var f float64
+		v := reflect.ValueOf(value)
+		switch {
+		case isIntKind(v.Kind()):
+			f = float64(v.Int())
+		case isUintKind(v.Kind()):
+			f = float64(v.Uint())
+		case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+			f = v.Float()
+		default:
+			return "must be a number"
+		}
+		if f < min || f > max {
+			return fmt.Sprintf("must be between %v and %v", min, max)
+		}
+		return ""
+	}
+}
+
+// Returns a rule that rejects strings that do not match the given regular expression.
+func Match(pattern string) ValidationRule {
+	reg := regexp.MustCompile(pattern)
+	return func(value interface{}) string {
+		if s, ok := value.(string); !ok || !reg.MatchString(s) {
+			return "is invalid"
+		}
+		return ""
+	}
+}
+
+func validate(v interface{}) error {
+	if validatable, ok := v.(Validatable); ok {
+		return validatable.Validate()
+	}
+	return nil
+}
+
+// Binds a request body into the given object like Bind. If binding fails, BindOrReject writes an
+// error response and returns false. ValidationErrors are passed to App.OnValidationError, other errors
+// result in 400 Bad Request.
+//
+//     form := &SignupForm{}
+//     if !ctx.BindOrReject(w, form) {
+//         return
+//     }
+func (ctx *Context) BindOrReject(w http.ResponseWriter, v interface{}) bool {
+	err := ctx.Bind(v)
+	if err == nil {
+		return true
+	}
+	var ve ValidationErrors
+	if errors.As(err, &ve) {
+		ctx.App.OnValidationError(w, ctx.Request, ve)
+	} else {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+	return false
+}
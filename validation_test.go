@@ -0,0 +1,69 @@
+package cidre
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type testSignupForm struct {
+	Name  string `form:"name"`
+	Email string `form:"email"`
+	Age   int    `form:"age"`
+}
+
+func (f *testSignupForm) Validate() error {
+	errs := ValidationErrors{}
+	errs.Check("name", f.Name, Required(), MaxLen(5))
+	errs.Check("email", f.Email, Required(), Match(`^[^@\s]+@[^@\s]+$`))
+	errs.Check("age", f.Age, Range(0, 150))
+	return errs.Err()
+}
+
+func TestValidation(t *testing.T) {
+	app := NewApp(DefaultAppConfig(func(c *AppConfig) {
+		c.AutoMaxProcs = false
+	}))
+	app.AccessLogger = func(LogLevel, string) {}
+	root := app.MountPoint("/")
+	root.Post("signup", "signup", func(w http.ResponseWriter, r *http.Request) {
+		form := &testSignupForm{}
+		if !RequestContext(r).BindOrReject(w, form) {
+			return
+		}
+		fmt.Fprintf(w, "welcome %v", form.Name)
+	})
+	client := NewTestClient(app)
+
+	res := client.PostForm("/signup", url.Values{"name": {"alice_in_wonderland"}, "email": {"alice"}, "age": {"200"}})
+	errorIfNotEqual(t, http.StatusUnprocessableEntity, res.Status)
+	AssertJSONEquals(t, `{"errors":{"name":["must be at most 5 characters"],"email":["is invalid"],"age":["must be between 0 and 150"]}}`, res.Recorder)
+
+	res = client.PostForm("/signup", url.Values{"age": {"20"}})
+	errorIfNotEqual(t, http.StatusUnprocessableEntity, res.Status)
+	AssertJSONEquals(t, `{"errors":{"name":["is required"],"email":["is required","is invalid"]}}`, res.Recorder)
+
+	res = client.PostForm("/signup", url.Values{"name": {"alice"}, "email": {"alice@example.com"}, "age": {"20"}})
+	errorIfNotEqual(t, http.StatusOK, res.Status)
+	errorIfNotEqual(t, "welcome alice", res.String())
+
+	res = client.PostForm("/signup", url.Values{"age": {"twenty"}})
+	errorIfNotEqual(t, http.StatusBadRequest, res.Status)
+}
+
+func TestValidationErrors(t *testing.T) {
+	errs := ValidationErrors{}
+	errorIfNotEqual(t, nil, errs.Err())
+	errs.Check("tags", []string{}, Required())
+	errs.Check("name", "bob", Required(), MaxLen(3))
+	errorIfNotEqual(t, true, errs.Has("tags"))
+	errorIfNotEqual(t, false, errs.Has("name"))
+	errorIfNotEqual(t, "is required", errs.First("tags"))
+	errorIfNotEqual(t, "", errs.First("name"))
+	errorIfNotEqual(t, "validation failed: tags is required", errs.Err().Error())
+
+	var ve ValidationErrors
+	errorIfNotEqual(t, true, errors.As(errs.Err(), &ve))
+}